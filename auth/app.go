@@ -1,18 +1,32 @@
 package auth
 
 import (
-	"github.com/filecoin-project/venus-auth/config"
-	"github.com/gin-gonic/gin"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/errcode"
+	"github.com/filecoin-project/venus-auth/log"
 )
 
 type OAuthApp interface {
+	// middleware
+	RequireAdmin(c *gin.Context)
+
 	Verify(c *gin.Context)
+	Introspect(c *gin.Context)
 	GenerateToken(c *gin.Context)
 	RemoveToken(c *gin.Context)
 	Tokens(c *gin.Context)
 
 	UpdateUser(c *gin.Context)
+	DeleteUser(c *gin.Context)
+	AddMiner(c *gin.Context)
+	RemoveMiner(c *gin.Context)
 	CreateUser(c *gin.Context)
 	ListUsers(c *gin.Context)
 	GetMiner(c *gin.Context)
@@ -24,25 +38,45 @@ type OAuthApp interface {
 	UpsertUserRateLimit(c *gin.Context)
 	GetUserRateLimit(c *gin.Context)
 	DelUserRateLimit(c *gin.Context)
+	TakeRateLimit(c *gin.Context)
+
+	JWKS(c *gin.Context)
+	Revocations(c *gin.Context)
+	ListKeys(c *gin.Context)
+	RotateKey(c *gin.Context)
+	RetireKey(c *gin.Context)
+
+	Backup(c *gin.Context)
 }
 
 type oauthApp struct {
 	srv OAuthService
 }
 
-func NewOAuthApp(secret, dbPath string, cnf *config.DBConfig) (OAuthApp, error) {
-	srv, err := NewOAuthService(secret, dbPath, cnf)
-	if err != nil {
-		return nil, err
-	}
+func NewOAuthApp(srv OAuthService) OAuthApp {
 	return &oauthApp{
 		srv: srv,
-	}, nil
+	}
 }
 
+// BadResponse answers the error with the status of its kind in errcode, 400 if it has none,
+// the code of the kind is in the body.
 func BadResponse(c *gin.Context, err error) {
 	c.Error(err) // nolint
-	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	code := errcode.Code(err)
+	c.JSON(errorStatus(code), &errcode.ErrMsg{Error: err.Error(), Code: code})
+}
+
+func errorStatus(code string) int {
+	switch code {
+	case errcode.CodeNotFound:
+		return http.StatusNotFound
+	case errcode.CodeAlreadyExists:
+		return http.StatusConflict
+	case errcode.CodeUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
 }
 
 func SuccessResponse(c *gin.Context, obj interface{}) {
@@ -51,22 +85,50 @@ func SuccessResponse(c *gin.Context, obj interface{}) {
 
 func Response(c *gin.Context, err error) {
 	if err != nil {
-		c.Error(err) // nolint
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		BadResponse(c, err)
 		return
 	}
 	c.AbortWithStatus(http.StatusOK)
 }
 
+// RequireAdmin only lets through requests carrying a bearer token with admin permission,
+// the token is checked by the service itself, just as /verify does for other services
+func (o *oauthApp) RequireAdmin(c *gin.Context) {
+	token := c.GetHeader(core.ServiceToken)
+	if !strings.HasPrefix(token, "Bearer ") {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrorMissingAuthToken.Error()})
+		return
+	}
+	res, err := o.srv.Verify(c, strings.TrimPrefix(token, "Bearer "))
+	if xerrors.Is(err, errcode.ErrUnavailable) {
+		BadResponse(c, err)
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.Error(err) // nolint
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if res.Perm != core.PermAdmin {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": ErrorPermissionDenied.Error()})
+		return
+	}
+	c.Set(core.FieldName, res.Name)
+	c.Next()
+}
+
 func (o *oauthApp) Verify(c *gin.Context) {
 	req := new(VerifyRequest)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	res, err := o.srv.Verify(c, req.Token)
 	if err != nil {
-		if err == ErrorNonRegisteredToken || err == ErrorVerificationFailed {
+		if err == ErrorNonRegisteredToken || err == ErrorVerificationFailed ||
+			err == ErrorTokenExpired || err == ErrorTokenNotValidYet ||
+			err == ErrorUserNotFound || err == ErrorUserDisabled {
 			c.Error(err) // nolint
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
@@ -78,19 +140,44 @@ func (o *oauthApp) Verify(c *gin.Context) {
 	SuccessResponse(c, res)
 }
 
+func (o *oauthApp) Introspect(c *gin.Context) {
+	req := new(IntrospectRequest)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	res, err := o.srv.Introspect(c, req.Token)
+	if err != nil {
+		BadResponse(c, err)
+		return
+	}
+	if res.Active {
+		c.Set("name", res.Username)
+	}
+	SuccessResponse(c, res)
+}
+
 func (o *oauthApp) GenerateToken(c *gin.Context) {
 	req := new(GenTokenRequest)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	expireAt, notBefore, err := req.Validity(time.Now())
+	if err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	res, err := o.srv.GenerateToken(c, &JWTPayload{
-		Name:  req.Name,
-		Perm:  req.Perm,
-		Extra: req.Extra,
+		Name:      req.Name,
+		Perm:      req.Perm,
+		Extra:     req.Extra,
+		ExpireAt:  expireAt,
+		NotBefore: notBefore,
 	})
 	if err != nil {
 		BadResponse(c, err)
+		return
 	}
 	output := &GenTokenResponse{
 		Token: res,
@@ -101,7 +188,7 @@ func (o *oauthApp) GenerateToken(c *gin.Context) {
 func (o *oauthApp) RemoveToken(c *gin.Context) {
 	req := new(RemoveTokenRequest)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	err := o.srv.RemoveToken(c, req.Token)
@@ -111,10 +198,10 @@ func (o *oauthApp) RemoveToken(c *gin.Context) {
 func (o *oauthApp) Tokens(c *gin.Context) {
 	req := new(GetTokensRequest)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
-	res, err := o.srv.Tokens(c, req.GetSkip(), req.GetLimit())
+	res, err := o.srv.Tokens(c, req.User, req.GetSkip(), req.GetLimit())
 	if err != nil {
 		BadResponse(c, err)
 		return
@@ -125,7 +212,7 @@ func (o *oauthApp) Tokens(c *gin.Context) {
 func (o *oauthApp) CreateUser(c *gin.Context) {
 	req := new(CreateUserRequest)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	// todo check miner exit
@@ -140,7 +227,7 @@ func (o *oauthApp) CreateUser(c *gin.Context) {
 func (o *oauthApp) UpdateUser(c *gin.Context) {
 	req := new(UpdateUserRequest)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	// todo check miner exit
@@ -152,10 +239,50 @@ func (o *oauthApp) UpdateUser(c *gin.Context) {
 	Response(c, err)
 }
 
+func (o *oauthApp) DeleteUser(c *gin.Context) {
+	req := new(DeleteUserRequest)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	res, err := o.srv.DeleteUser(c, req)
+	if err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, res)
+}
+
+func (o *oauthApp) AddMiner(c *gin.Context) {
+	req := new(UserMinerRequest)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	if err := o.srv.AddMiner(c, req); err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, req.Miner)
+}
+
+func (o *oauthApp) RemoveMiner(c *gin.Context) {
+	req := new(UserMinerRequest)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	if err := o.srv.RemoveMiner(c, req); err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, req.Miner)
+}
+
 func (o *oauthApp) ListUsers(c *gin.Context) {
 	req := new(ListUsersRequest)
 	if err := c.ShouldBindQuery(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	res, err := o.srv.ListUsers(c, req)
@@ -169,7 +296,7 @@ func (o *oauthApp) ListUsers(c *gin.Context) {
 func (o *oauthApp) GetMiner(c *gin.Context) {
 	req := new(GetMinerRequest)
 	if err := c.ShouldBindQuery(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	res, err := o.srv.GetMiner(c, req)
@@ -183,7 +310,7 @@ func (o *oauthApp) GetMiner(c *gin.Context) {
 func (o *oauthApp) HasMiner(c *gin.Context) {
 	req := new(HasMinerRequest)
 	if err := c.ShouldBindQuery(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	res, err := o.srv.HasMiner(c, req)
@@ -197,7 +324,7 @@ func (o *oauthApp) HasMiner(c *gin.Context) {
 func (o *oauthApp) GetUser(c *gin.Context) {
 	req := new(GetUserRequest)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	res, err := o.srv.GetUser(c, req)
@@ -209,26 +336,38 @@ func (o *oauthApp) GetUser(c *gin.Context) {
 }
 
 func (o *oauthApp) AddUserRateLimit(c *gin.Context) {
-	req := new(UpsertUserRateLimitReq)
+	req := new(AddUserRateLimitReq)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 
-	res, err := o.srv.UpsertUserRateLimit(c, req)
+	res, err := o.srv.AddUserRateLimit(c, req)
 	if err != nil {
 		BadResponse(c, err)
 		return
 	}
 	SuccessResponse(c, res)
 }
+
 func (o *oauthApp) UpdateUserRateLimit(c *gin.Context) {
+	req := new(UpdateUserRateLimitReq)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
 
+	if err := o.srv.UpdateUserRateLimit(c, req); err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, req.Id)
 }
+
 func (o *oauthApp) UpsertUserRateLimit(c *gin.Context) {
 	req := new(UpsertUserRateLimitReq)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 
@@ -243,7 +382,7 @@ func (o *oauthApp) UpsertUserRateLimit(c *gin.Context) {
 func (o *oauthApp) GetUserRateLimit(c *gin.Context) {
 	req := new(GetUserRateLimitsReq)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 
@@ -258,7 +397,7 @@ func (o *oauthApp) GetUserRateLimit(c *gin.Context) {
 func (o *oauthApp) DelUserRateLimit(c *gin.Context) {
 	req := new(DelUserRateLimitReq)
 	if err := c.ShouldBind(req); err != nil {
-		BadResponse(c, err)
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
 		return
 	}
 	err := o.srv.DelUserRateLimit(c, req)
@@ -268,3 +407,96 @@ func (o *oauthApp) DelUserRateLimit(c *gin.Context) {
 	}
 	SuccessResponse(c, req.Id)
 }
+
+// TakeRateLimit answers 200 whether the call is allowed or not
+func (o *oauthApp) TakeRateLimit(c *gin.Context) {
+	req := new(TakeRateLimitRequest)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	res, err := o.srv.TakeRateLimit(c, req)
+	if err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, res)
+}
+
+func (o *oauthApp) JWKS(c *gin.Context) {
+	res, err := o.srv.JWKS(c)
+	if err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, res)
+}
+
+func (o *oauthApp) Revocations(c *gin.Context) {
+	req := new(RevocationsRequest)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	res, err := o.srv.Revocations(c, req.Epoch, req.Seq)
+	if err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, res)
+}
+
+func (o *oauthApp) ListKeys(c *gin.Context) {
+	res, err := o.srv.ListKeys(c)
+	if err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, res)
+}
+
+func (o *oauthApp) RotateKey(c *gin.Context) {
+	req := new(RotateKeyRequest)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	res, err := o.srv.RotateKey(c, req)
+	if err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, res)
+}
+
+func (o *oauthApp) RetireKey(c *gin.Context) {
+	req := new(RetireKeyRequest)
+	if err := c.ShouldBind(req); err != nil {
+		BadResponse(c, errcode.Wrap(errcode.ErrInvalidArgument, err))
+		return
+	}
+	if err := o.srv.RetireKey(c, req.Kid); err != nil {
+		BadResponse(c, err)
+		return
+	}
+	SuccessResponse(c, req.Kid)
+}
+
+// Backup streams the gzipped archive, a failure after the first bytes are sent only cuts the archive,
+// which is told by its missing summary.
+func (o *oauthApp) Backup(c *gin.Context) {
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", `attachment; filename="venus-auth.backup"`)
+	sum, err := o.srv.Backup(c, c.Writer)
+	if err != nil {
+		if !c.Writer.Written() {
+			c.Header("Content-Type", "application/json")
+			BadResponse(c, err)
+			return
+		}
+		c.Error(err) // nolint
+		c.Abort()
+		return
+	}
+	log.Infof("backup is taken: %+v", *sum)
+}
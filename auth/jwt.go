@@ -5,8 +5,8 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
@@ -19,8 +19,8 @@ import (
 
 	"github.com/filecoin-project/venus-auth/config"
 	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/errcode"
 	"github.com/filecoin-project/venus-auth/storage"
-	"github.com/filecoin-project/venus-auth/util"
 )
 
 var (
@@ -28,6 +28,14 @@ var (
 	ErrorRemoveFailed       = xerrors.New("Remove token failed")
 	ErrorNonRegisteredToken = xerrors.New("A non-registered token")
 	ErrorVerificationFailed = xerrors.New("Verification Failed")
+	ErrorTokenExpired       = xerrors.New("Token expired")
+	ErrorTokenNotValidYet   = xerrors.New("Token not valid yet")
+	ErrorMissingAuthToken   = xerrors.New("Missing bearer token in Authorization header")
+	ErrorPermissionDenied   = xerrors.New("Admin permission required")
+	ErrorUserNotFound       = errcode.New(errcode.ErrNotFound, "User not found")
+	ErrorUserDisabled       = xerrors.New("User is disabled or deleted")
+	ErrorRateLimitExists    = errcode.New(errcode.ErrAlreadyExists, "Rate limit already exists")
+	ErrorRateLimitNotFound  = errcode.New(errcode.ErrNotFound, "Rate limit not found")
 )
 
 var jwtOAuthInstance *jwtOAuth
@@ -39,176 +47,359 @@ type VerifyAop interface {
 type OAuthService interface {
 	GenerateToken(ctx context.Context, cp *JWTPayload) (string, error)
 	Verify(ctx context.Context, token string) (*JWTPayload, error)
+	Introspect(ctx context.Context, token string) (*IntrospectResponse, error)
 	RemoveToken(ctx context.Context, token string) error
-	Tokens(ctx context.Context, skip, limit int64) ([]*TokenInfo, error)
+	// Tokens lists the tokens issued under the name, all of them if the name is empty
+	Tokens(ctx context.Context, name string, skip, limit int64) ([]*TokenInfo, error)
 
 	CreateUser(ctx context.Context, req *CreateUserRequest) (*CreateUserResponse, error)
 	UpdateUser(ctx context.Context, req *UpdateUserRequest) error
+	DeleteUser(ctx context.Context, req *DeleteUserRequest) (*DeleteUserResponse, error)
 	ListUsers(ctx context.Context, req *ListUsersRequest) (ListUsersResponse, error)
 	GetMiner(ctx context.Context, req *GetMinerRequest) (*OutputUser, error)
 	HasMiner(ctx context.Context, req *HasMinerRequest) (bool, error)
+	AddMiner(ctx context.Context, req *UserMinerRequest) error
+	RemoveMiner(ctx context.Context, req *UserMinerRequest) error
 	GetUser(ctx context.Context, req *GetUserRequest) (*OutputUser, error)
 
 	GetUserRateLimits(ctx context.Context, req *GetUserRateLimitsReq) (GetUserRateLimitResponse, error)
+	AddUserRateLimit(ctx context.Context, req *AddUserRateLimitReq) (string, error)
+	UpdateUserRateLimit(ctx context.Context, req *UpdateUserRateLimitReq) error
 	UpsertUserRateLimit(ctx context.Context, req *UpsertUserRateLimitReq) (string, error)
 	DelUserRateLimit(ctx context.Context, req *DelUserRateLimitReq) error
+	TakeRateLimit(ctx context.Context, req *TakeRateLimitRequest) (*TakeRateLimitResponse, error)
+
+	JWKS(ctx context.Context) (*JWKSet, error)
+	// Revocations lists the tokens revoked after seq, for the clients caching verify results
+	Revocations(ctx context.Context, epoch string, seq uint64) (*RevocationsResponse, error)
+	ListKeys(ctx context.Context) ([]*KeyInfo, error)
+	RotateKey(ctx context.Context, req *RotateKeyRequest) (*KeyInfo, error)
+	RetireKey(ctx context.Context, kid string) error
+
+	// Backup writes the archive of the store to w, see storage.Backup
+	Backup(ctx context.Context, w io.Writer) (*storage.BackupSummary, error)
+
+	// Close releases the store, once the requests are drained
+	Close() error
 }
 
 type jwtOAuth struct {
-	secret *jwt.HMACSHA
-	store  storage.Store
-	mp     Mapper
+	store storage.Store
+	mp    Mapper
+	keys  *keyring
+	// requireUser binds tokens to existing users, see config.Config.RequireUser
+	requireUser bool
+	revoked     *revocationLog
 }
 
 type JWTPayload struct {
 	Name  string          `json:"name"`
 	Perm  core.Permission `json:"perm"`
 	Extra string          `json:"ext"`
+	// unix seconds, zero means no limit
+	ExpireAt  int64 `json:"exp,omitempty"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	// ID is random, so that every token issued is a credential of its own
+	ID       string `json:"jti,omitempty"`
+	IssuedAt int64  `json:"iat,omitempty"`
 }
 
-func NewOAuthService(secret string, dbPath string, cnf *config.DBConfig) (OAuthService, error) {
-	sec, err := hex.DecodeString(secret)
+// OpenStore opens the db of the config, and applies its pending migrations
+func OpenStore(dbPath string, cnf *config.Config) (storage.Store, error) {
+	opts, err := MigrateOptions(cnf)
 	if err != nil {
 		return nil, err
 	}
-	store, err := storage.NewStore(cnf, dbPath)
+	store, err := storage.NewStore(cnf.DB, dbPath)
 	if err != nil {
 		return nil, err
 	}
+	if _, err = storage.Migrate(store, opts); err != nil {
+		_ = store.Close()
+		return nil, xerrors.Errorf("migrate db: %w", err)
+	}
+	return store, nil
+}
 
-	// TODO: remove it next version
-	skip, limit := int64(0), int64(20)
-	for {
-		kps, err := store.List(skip, limit)
-		if err != nil {
-			return nil, xerrors.Errorf("list token %v", err)
-		}
-		for _, kp := range kps {
-			if len(kp.Secret) == 0 {
-				kp.Secret = secret
-				log.Infof("update token %s secret %s", kp.Token, secret)
-				if err := store.UpdateToken(kp); err != nil {
-					return nil, xerrors.Errorf("update token(%s) %v", kp.Token, err)
-				}
-			}
-		}
-		if len(kps) == 0 {
-			break
-		}
+// MigrateOptions passes the master secret of the config to the migrations,
+// the tokens without a secret were signed by it.
+func MigrateOptions(cnf *config.Config) (*storage.MigrateOptions, error) {
+	sec, err := hex.DecodeString(cnf.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.MigrateOptions{MasterKid: symmetricKey(sec).Kid}, nil
+}
 
-		skip += limit
+func NewOAuthService(dbPath string, cnf *config.Config) (OAuthService, error) {
+	sec, err := hex.DecodeString(cnf.Secret)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenStore(dbPath, cnf)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.WithEncryption(db, cnf.Encryption)
+	if err != nil {
+		_ = db.Close()
+		return nil, xerrors.Errorf("key-encryption key: %w", err)
+	}
+	keys, err := loadKeyring(store, cnf.SignAlg, sec)
+	if err != nil {
+		_ = store.Close()
+		return nil, err
 	}
 
 	jwtOAuthInstance = &jwtOAuth{
-		secret: jwt.NewHS256(sec),
-		store:  store,
-		mp:     newMapper(),
+		store:       store,
+		mp:          newMapper(),
+		keys:        keys,
+		requireUser: cnf.RequireUser,
+		revoked:     newRevocationLog(),
 	}
 	return jwtOAuthInstance, nil
 }
 
 func (o *jwtOAuth) GenerateToken(ctx context.Context, pl *JWTPayload) (string, error) {
-	// one token, one secret
-	secret, err := config.RandSecret()
+	user, err := o.tokenUser(pl.Name)
 	if err != nil {
-		return "", xerrors.Errorf("rand secret %v", err)
+		return core.EmptyString, err
+	}
+	var userID string
+	if user != nil {
+		userID = user.Id
+	}
+	if o.requireUser {
+		if err = checkUser(user, userID); err != nil {
+			return core.EmptyString, err
+		}
+	}
+	key := o.keys.activeKey()
+	if key == nil {
+		return core.EmptyString, xerrors.Errorf("no active signing key")
 	}
-	tk, err := jwt.Sign(pl, jwt.NewHS256(secret))
+	signed := *pl
+	signed.ID, signed.IssuedAt = uuid.NewString(), time.Now().Unix()
+	tk, err := jwt.Sign(&signed, key.signer, jwt.KeyID(key.kid))
 	if err != nil {
 		return core.EmptyString, xerrors.Errorf("gen token failed :%s", err)
 	}
+	// the token is never issued before, jti is random
 	token := storage.Token(tk)
-	has, err := o.store.Has(token)
-	if err != nil {
-		return core.EmptyString, err
-	}
-	if has {
-		return token.String(), nil
-	}
-
-	err = o.store.Put(&storage.KeyPair{Token: token, Secret: hex.EncodeToString(secret), CreateTime: time.Now(), Name: pl.Name, Perm: pl.Perm, Extra: pl.Extra})
+	err = o.store.Put(&storage.KeyPair{
+		Hash:       token.Hash(),
+		Prefix:     token.Prefix(),
+		Kid:        key.kid,
+		UserID:     userID,
+		CreateTime: time.Now(),
+		ExpireAt:   pl.ExpireAt,
+		NotBefore:  pl.NotBefore,
+		Name:       pl.Name,
+		Perm:       pl.Perm,
+		Extra:      pl.Extra,
+	})
 	if err != nil {
-		return core.EmptyString, xerrors.Errorf("store token failed :%s", err)
+		return core.EmptyString, xerrors.Errorf("store token failed :%w", err)
 	}
 	return token.String(), nil
 }
 
 func (o *jwtOAuth) Verify(ctx context.Context, token string) (*JWTPayload, error) {
+	p, _, err := o.verify(token)
+	return p, err
+}
+
+// verify returns the payload of the token, and the stored record of it
+func (o *jwtOAuth) verify(token string) (*JWTPayload, *storage.KeyPair, error) {
 	p := new(JWTPayload)
 	tk := []byte(token)
 
-	kp, err := o.store.Get(storage.Token(token))
+	kp, err := o.store.Get(storage.Token(token).Hash())
+	if xerrors.Is(err, storage.ErrNotFound) {
+		return nil, nil, ErrorNonRegisteredToken
+	}
+	if err != nil {
+		return nil, nil, xerrors.Errorf("get token: %w", err)
+	}
+	alg, err := o.verifier(kp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := jwt.Verify(tk, alg, p, jwt.ValidateHeader); err != nil {
+		return nil, nil, ErrorVerificationFailed
+	}
+	if err := checkValidity(kp, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	if o.requireUser {
+		user, err := o.tokenUser(kp.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = checkUser(user, kp.UserID); err != nil {
+			return nil, nil, err
+		}
+	}
+	return p, kp, nil
+}
+
+// tokenUser returns the user the tokens of the name are issued to, nil if there is none
+func (o *jwtOAuth) tokenUser(name string) (*storage.User, error) {
+	has, err := o.store.HasUser(name)
+	if err != nil || !has {
+		return nil, err
+	}
+	return o.store.GetUser(name)
+}
+
+// checkUser makes sure the user is enabled, a token issued to a user record which
+// has been removed is rejected even if another user of the same name is created.
+func checkUser(user *storage.User, userID string) error {
+	if user == nil || (len(userID) > 0 && user.Id != userID) {
+		return ErrorUserNotFound
+	}
+	if user.IsDeleted || user.State != core.UserStateEnabled {
+		return ErrorUserDisabled
+	}
+	return nil
+}
+
+// Introspect describes the token as RFC 7662 does, a token failing the verification is reported inactive
+func (o *jwtOAuth) Introspect(ctx context.Context, token string) (*IntrospectResponse, error) {
+	p, kp, err := o.verify(token)
 	if err != nil {
-		return nil, xerrors.Errorf("get token: %v", err)
+		log.Debugf("introspect token %s: %s", storage.Token(token).Prefix(), err)
+		return &IntrospectResponse{Active: false}, nil
+	}
+	return &IntrospectResponse{
+		Active:    true,
+		Scope:     strings.Join(core.AdaptOldStrategy(p.Perm), " "),
+		ClientID:  p.Name,
+		Username:  p.Name,
+		Sub:       p.Name,
+		TokenType: "Bearer",
+		Exp:       kp.ExpireAt,
+		Iat:       kp.CreateTime.Unix(),
+		Nbf:       kp.NotBefore,
+		Kid:       kp.Kid,
+		Perm:      p.Perm,
+		Extra:     p.Extra,
+	}, nil
+}
+
+// verifier returns the algorithm checking the signature of a stored token
+func (o *jwtOAuth) verifier(kp *storage.KeyPair) (jwt.Algorithm, error) {
+	if len(kp.Kid) > 0 {
+		key := o.keys.get(kp.Kid)
+		if key == nil || key.retired {
+			return nil, ErrorVerificationFailed
+		}
+		return key.verifier, nil
 	}
 	secret, err := hex.DecodeString(kp.Secret)
 	if err != nil {
 		return nil, xerrors.Errorf("decode secret %v", err)
 	}
-	if _, err := jwt.Verify(tk, jwt.NewHS256(secret), p); err != nil {
-		return nil, ErrorVerificationFailed
+	return jwt.NewHS256(secret), nil
+}
+
+// checkValidity enforces the validity window recorded for the token,
+// the stored record is authoritative over the claims in the token.
+func checkValidity(kp *storage.KeyPair, now time.Time) error {
+	if kp.NotBefore > 0 && now.Unix() < kp.NotBefore {
+		return ErrorTokenNotValidYet
+	}
+	if kp.ExpireAt > 0 && now.Unix() >= kp.ExpireAt {
+		return ErrorTokenExpired
 	}
-	return p, nil
+	return nil
 }
 
 type TokenInfo struct {
-	Token      string    `json:"token"`
+	// the token itself is not kept, it's identified by its hash
+	Hash       string    `json:"hash"`
+	Prefix     string    `json:"prefix"`
 	Name       string    `json:"name"`
 	Perm       string    `json:"perm"`
 	Custom     string    `json:"custom"`
 	CreateTime time.Time `json:"createTime"`
+	// unix seconds, zero means no limit
+	ExpireAt  int64 `json:"expireAt"`
+	NotBefore int64 `json:"notBefore"`
 }
 
-func (o *jwtOAuth) Tokens(ctx context.Context, skip, limit int64) ([]*TokenInfo, error) {
-	pairs, err := o.store.List(skip, limit)
+func (o *jwtOAuth) Tokens(ctx context.Context, name string, skip, limit int64) ([]*TokenInfo, error) {
+	var pairs []*storage.KeyPair
+	var err error
+	if len(name) > 0 {
+		pairs, err = o.store.ListByName(name, skip, limit)
+	} else {
+		pairs, err = o.store.List(skip, limit)
+	}
 	if err != nil {
 		return nil, err
 	}
 	tks := make([]*TokenInfo, 0, limit)
 	for _, v := range pairs {
-		jwtPayload, err := util.JWTPayloadMap(string(v.Token))
-		if err != nil {
-			return nil, err
-		}
 		tks = append(tks, &TokenInfo{
-			Token:      v.Token.String(),
+			Hash:       v.Hash.String(),
+			Prefix:     v.Prefix,
 			CreateTime: v.CreateTime,
-			Name:       jwtPayload["name"].(string),
-			Perm:       jwtPayload["perm"].(string),
+			ExpireAt:   v.ExpireAt,
+			NotBefore:  v.NotBefore,
+			Name:       v.Name,
+			Perm:       v.Perm,
+			Custom:     v.Extra,
 		})
 	}
 	return tks, nil
 }
 
+// RemoveToken accepts either the token or its hash
 func (o *jwtOAuth) RemoveToken(ctx context.Context, token string) error {
-	tk := []byte(token)
-	err := o.store.Delete(storage.Token(tk))
+	hash := storage.ParseTokenHash(token)
+	err := o.store.Delete(hash)
 	if err != nil {
-		return ErrorRemoveFailed
+		return xerrors.Errorf("%s: %w", ErrorRemoveFailed, err)
 	}
+	o.revoked.add(&RevocationEvent{Hash: hash.String()})
 	return nil
 }
 
+func (o *jwtOAuth) Revocations(ctx context.Context, epoch string, seq uint64) (*RevocationsResponse, error) {
+	return o.revoked.since(epoch, seq), nil
+}
+
+// revokeUser tells the caching clients the tokens of the user are rejected since it's disabled or deleted
+func (o *jwtOAuth) revokeUser(name string) {
+	if o.requireUser {
+		o.revoked.add(&RevocationEvent{User: name})
+	}
+}
+
 func (o *jwtOAuth) CreateUser(ctx context.Context, req *CreateUserRequest) (*CreateUserResponse, error) {
 	exist, err := o.store.HasUser(req.Name)
 	if err != nil {
 		return nil, err
 	}
 	if exist {
-		return nil, errors.New("user already exists")
+		return nil, errcode.New(errcode.ErrAlreadyExists, "user already exists")
 	}
 	uid, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
 	}
-	mAddr, err := address.NewFromString(req.Miner) // convert address type to local
-	if err != nil {
-		return nil, err
+	var mAddr address.Address
+	if len(req.Miner) > 0 {
+		mAddr, err = address.NewFromString(req.Miner) // convert address type to local
+		if err != nil {
+			return nil, errcode.Wrap(errcode.ErrInvalidArgument, err)
+		}
 	}
 	userNew := &storage.User{
 		Id:         uid.String(),
 		Name:       req.Name,
-		Miner:      mAddr.String(),
 		Comment:    req.Comment,
 		SourceType: req.SourceType,
 		State:      req.State,
@@ -219,6 +410,16 @@ func (o *jwtOAuth) CreateUser(ctx context.Context, req *CreateUserRequest) (*Cre
 	if err != nil {
 		return nil, err
 	}
+	if mAddr != address.Undef {
+		// the miner may belong to another user, a deleted one as well, then the user is not created
+		if err = o.store.AddMiner(userNew.Name, mAddr); err != nil {
+			if delErr := o.store.DelUser(userNew.Name); delErr != nil {
+				return nil, xerrors.Errorf("add miner: %v, remove the user: %w", err, delErr)
+			}
+			return nil, err
+		}
+		userNew.Miners = []string{mAddr.String()}
+	}
 	return o.mp.ToOutPutUser(userNew), nil
 }
 
@@ -229,11 +430,26 @@ func (o *jwtOAuth) UpdateUser(ctx context.Context, req *UpdateUserRequest) error
 	}
 	user.UpdateTime = time.Now().Local()
 	if req.KeySum&1 == 1 {
+		// the miner replaces all the miners of the user, as it did when a user had one miner
 		mAddr, err := address.NewFromString(req.Miner)
 		if err != nil {
+			return errcode.Wrap(errcode.ErrInvalidArgument, err)
+		}
+		if err = o.store.AddMiner(user.Name, mAddr); err != nil {
 			return err
 		}
-		user.Miner = mAddr.String()
+		for _, m := range user.Miners {
+			if m == mAddr.String() {
+				continue
+			}
+			old, err := address.NewFromString(m)
+			if err != nil {
+				return err
+			}
+			if err = o.store.DelMiner(user.Name, old); err != nil {
+				return err
+			}
+		}
 	}
 	if req.KeySum&2 == 2 {
 		user.Comment = req.Comment
@@ -244,7 +460,65 @@ func (o *jwtOAuth) UpdateUser(ctx context.Context, req *UpdateUserRequest) error
 	if req.KeySum&8 == 8 {
 		user.SourceType = req.SourceType
 	}
-	return o.store.UpdateUser(user)
+	if err = o.store.UpdateUser(user); err != nil {
+		return err
+	}
+	if user.State != core.UserStateEnabled {
+		o.revokeUser(user.Name)
+	}
+	return nil
+}
+
+func (o *jwtOAuth) DeleteUser(ctx context.Context, req *DeleteUserRequest) (*DeleteUserResponse, error) {
+	user, err := o.store.GetUser(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Hard {
+		err = o.store.DelUser(user.Name)
+	} else {
+		user.State = core.UserStateDisabled
+		user.IsDeleted = true
+		user.UpdateTime = time.Now().Local()
+		err = o.store.UpdateUser(user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.revokeUser(user.Name)
+	res := &DeleteUserResponse{Name: user.Name}
+	if req.RevokeTokens {
+		if res.RevokedTokens, err = o.revokeTokens(user.Name); err != nil {
+			return res, xerrors.Errorf("user %s is deleted, but revoke tokens: %w", user.Name, err)
+		}
+	}
+	return res, nil
+}
+
+// revokeTokens removes the tokens issued under the name
+func (o *jwtOAuth) revokeTokens(name string) (int, error) {
+	var hashes []storage.TokenHash
+	skip, limit := int64(0), int64(100)
+	for {
+		kps, err := o.store.ListByName(name, skip, limit)
+		if err != nil {
+			return 0, xerrors.Errorf("list token %w", err)
+		}
+		for _, kp := range kps {
+			hashes = append(hashes, kp.Hash)
+		}
+		if int64(len(kps)) < limit {
+			break
+		}
+		skip += limit
+	}
+	for i, hash := range hashes {
+		if err := o.store.Delete(hash); err != nil {
+			return i, xerrors.Errorf("remove token %s: %w", hash, err)
+		}
+		o.revoked.add(&RevocationEvent{Hash: hash.String()})
+	}
+	return len(hashes), nil
 }
 
 func (o *jwtOAuth) ListUsers(ctx context.Context, req *ListUsersRequest) (ListUsersResponse, error) {
@@ -259,19 +533,44 @@ func (o *jwtOAuth) ListUsers(ctx context.Context, req *ListUsersRequest) (ListUs
 func (o *jwtOAuth) GetMiner(ctx context.Context, req *GetMinerRequest) (*OutputUser, error) {
 	mAddr, err := address.NewFromString(req.Miner)
 	if err != nil {
-		return nil, err
+		return nil, errcode.Wrap(errcode.ErrInvalidArgument, err)
 	}
 	user, err := o.store.GetMiner(mAddr)
 	if err != nil {
 		return nil, err
 	}
-	return o.mp.ToOutPutUser(user), nil
+	out := o.mp.ToOutPutUser(user)
+	out.Miner = mAddr
+	return out, nil
+}
+
+func (o *jwtOAuth) AddMiner(ctx context.Context, req *UserMinerRequest) error {
+	mAddr, err := address.NewFromString(req.Miner)
+	if err != nil {
+		return errcode.Wrap(errcode.ErrInvalidArgument, err)
+	}
+	user, err := o.store.GetUser(req.Name)
+	if err != nil {
+		return err
+	}
+	if user.IsDeleted {
+		return errcode.Wrap(errcode.ErrNotFound, xerrors.Errorf("user %s is deleted", req.Name))
+	}
+	return o.store.AddMiner(user.Name, mAddr)
+}
+
+func (o *jwtOAuth) RemoveMiner(ctx context.Context, req *UserMinerRequest) error {
+	mAddr, err := address.NewFromString(req.Miner)
+	if err != nil {
+		return errcode.Wrap(errcode.ErrInvalidArgument, err)
+	}
+	return o.store.DelMiner(req.Name, mAddr)
 }
 
 func (o *jwtOAuth) HasMiner(ctx context.Context, req *HasMinerRequest) (bool, error) {
 	mAddr, err := address.NewFromString(req.Miner)
 	if err != nil {
-		return false, err
+		return false, errcode.Wrap(errcode.ErrInvalidArgument, err)
 	}
 	has, err := o.store.HasMiner(mAddr)
 	if err != nil {
@@ -292,14 +591,129 @@ func (o jwtOAuth) GetUserRateLimits(ctx context.Context, req *GetUserRateLimitsR
 	return o.store.GetRateLimits(req.Name, req.Id)
 }
 
+// AddUserRateLimit fails with ErrorRateLimitExists if the id is taken, an id is generated if it's empty
+func (o *jwtOAuth) AddUserRateLimit(ctx context.Context, req *AddUserRateLimitReq) (string, error) {
+	limit := (*storage.UserRateLimit)(req)
+	limits, err := o.userRateLimits(limit)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range limits {
+		if l.Id == limit.Id {
+			return "", xerrors.Errorf("%s: %w", limit.Id, ErrorRateLimitExists)
+		}
+	}
+	if err = checkRateLimit(limit, limits); err != nil {
+		return "", err
+	}
+	// the store rejects an id taken meanwhile, or taken by another user
+	return o.store.AddRateLimit(limit)
+}
+
+// UpdateUserRateLimit replaces the limit of the id, which must be one of the user
+func (o *jwtOAuth) UpdateUserRateLimit(ctx context.Context, req *UpdateUserRateLimitReq) error {
+	limit := (*storage.UserRateLimit)(req)
+	if len(limit.Id) == 0 {
+		return errcode.New(errcode.ErrInvalidArgument, "rate limit id is required")
+	}
+	limits, err := o.userRateLimits(limit)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, l := range limits {
+		found = found || l.Id == limit.Id
+	}
+	if !found {
+		return xerrors.Errorf("%s of user %s: %w", limit.Id, limit.Name, ErrorRateLimitNotFound)
+	}
+	if err = checkRateLimit(limit, limits); err != nil {
+		return err
+	}
+	_, err = o.store.PutRateLimit(limit)
+	return err
+}
+
+// UpsertUserRateLimit adds the limit, or replaces the one of the same id
 func (o *jwtOAuth) UpsertUserRateLimit(ctx context.Context, req *UpsertUserRateLimitReq) (string, error) {
-	return o.store.PutRateLimit((*storage.UserRateLimit)(req))
+	limit := (*storage.UserRateLimit)(req)
+	limits, err := o.userRateLimits(limit)
+	if err != nil {
+		return "", err
+	}
+	if err = checkRateLimit(limit, limits); err != nil {
+		return "", err
+	}
+	return o.store.PutRateLimit(limit)
+}
+
+// userRateLimits returns the limits of the user the limit is set for, who must exist
+func (o *jwtOAuth) userRateLimits(limit *storage.UserRateLimit) ([]*storage.UserRateLimit, error) {
+	if len(limit.Name) == 0 {
+		return nil, errcode.New(errcode.ErrInvalidArgument, "user is required for rate limit")
+	}
+	user, err := o.tokenUser(limit.Name)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.IsDeleted {
+		return nil, xerrors.Errorf("%s: %w", limit.Name, ErrorUserNotFound)
+	}
+	return o.store.GetRateLimits(limit.Name, "")
 }
 
 func (o jwtOAuth) DelUserRateLimit(ctx context.Context, req *DelUserRateLimitReq) error {
 	return o.store.DelRateLimit(req.Name, req.Id)
 }
 
+func (o *jwtOAuth) JWKS(ctx context.Context) (*JWKSet, error) {
+	return o.keys.jwks(), nil
+}
+
+func (o *jwtOAuth) ListKeys(ctx context.Context) ([]*KeyInfo, error) {
+	return o.keys.list(), nil
+}
+
+func (o *jwtOAuth) RotateKey(ctx context.Context, req *RotateKeyRequest) (*KeyInfo, error) {
+	alg := req.Alg
+	if len(alg) == 0 {
+		alg = o.keys.alg
+	}
+	if alg != o.keys.alg {
+		return nil, errcode.Wrap(errcode.ErrInvalidArgument, xerrors.Errorf("new tokens are signed by %s, can't rotate to %s", o.keys.alg, alg))
+	}
+	key, err := newSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	if err = o.keys.add(key); err != nil {
+		return nil, err
+	}
+	if len(req.Retire) > 0 {
+		if err = o.RetireKey(ctx, req.Retire); err != nil {
+			return nil, err
+		}
+	}
+	return o.keys.get(key.Kid).info(true), nil
+}
+
+// RetireKey stops accepting the tokens signed by the key, the key signing new tokens can't be retired
+func (o *jwtOAuth) RetireKey(ctx context.Context, kid string) error {
+	if err := o.keys.retire(kid); err != nil {
+		return err
+	}
+	o.revoked.add(&RevocationEvent{Kid: kid})
+	return nil
+}
+
+func (o *jwtOAuth) Backup(ctx context.Context, w io.Writer) (*storage.BackupSummary, error) {
+	return storage.Backup(o.store, w)
+}
+
+func (o *jwtOAuth) Close() error {
+	return o.store.Close()
+}
+
 func DecodeToBytes(enc []byte) ([]byte, error) {
 	encoding := base64.RawURLEncoding
 	dec := make([]byte, encoding.DecodedLen(len(enc)))
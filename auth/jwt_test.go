@@ -2,8 +2,14 @@ package auth
 
 import (
 	"encoding/json"
-	"github.com/magiconair/properties/assert"
 	"testing"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/magiconair/properties/assert"
+
+	"github.com/filecoin-project/venus-auth/config"
+	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/storage"
 )
 
 func TestTokenDecode(t *testing.T) {
@@ -19,3 +25,82 @@ func TestTokenDecode(t *testing.T) {
 	}
 	assert.Equal(t, a["name"], "John Doe")
 }
+
+func TestServerKeySignVerify(t *testing.T) {
+	for _, alg := range []config.SignAlg{config.SignEd25519, config.SignES256} {
+		k, err := newSigningKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sk, err := newServerKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tk, err := jwt.Sign(&JWTPayload{Name: "signer", Perm: core.PermRead}, sk.signer, jwt.KeyID(sk.kid))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// verify with the key published through jwks, as other services do
+		buf, err := json.Marshal(sk.jwk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwk := new(JWK)
+		if err = json.Unmarshal(buf, jwk); err != nil {
+			t.Fatal(err)
+		}
+		verifier, err := jwk.Verifier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl := new(JWTPayload)
+		hd, err := jwt.Verify(tk, verifier, pl, jwt.ValidateHeader)
+		if err != nil {
+			t.Fatalf("%s: %s", alg, err)
+		}
+		assert.Equal(t, hd.KeyID, k.Kid)
+		assert.Equal(t, pl.Name, "signer")
+
+		tk[len(tk)-2] ^= 1
+		_, err = jwt.Verify(tk, verifier, pl, jwt.ValidateHeader)
+		assert.Equal(t, err != nil, true, "tampered token should be rejected")
+	}
+}
+
+func TestKeyringMasterSecret(t *testing.T) {
+	store, err := storage.NewStore(&config.DBConfig{Type: config.Badger}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close() // nolint
+	secret, err := config.RandSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := symmetricKey(secret).Kid
+
+	kr, err := loadKeyring(store, config.SignHS256, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, kr.get(master) != nil, true, "master secret should verify the legacy tokens")
+	assert.Equal(t, kr.activeKey().kid != master, true, "master secret should not sign new tokens")
+
+	stored, err := store.ListSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(stored), 1)
+	assert.Equal(t, stored[0].Kid, kr.activeKey().kid)
+
+	key, err := newSigningKey(config.SignHS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kr.add(key); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, kr.activeKey().kid, key.Kid)
+	assert.Equal(t, kr.retire(master) != nil, true, "master secret can't be retired")
+}
@@ -21,16 +21,26 @@ func (o *mapper) ToOutPutUser(m *storage.User) *OutputUser {
 	if m == nil {
 		return nil
 	}
-	addr, _ := address.NewFromString(m.Miner)
+	miners := make([]address.Address, 0, len(m.Miners))
+	for _, v := range m.Miners {
+		addr, _ := address.NewFromString(v)
+		miners = append(miners, addr)
+	}
+	var addr address.Address
+	if len(miners) > 0 {
+		addr = miners[0]
+	}
 	return &OutputUser{
 		Id:         m.Id,
 		Name:       m.Name,
 		Miner:      addr,
+		Miners:     miners,
 		Comment:    m.Comment,
 		State:      m.State,
 		SourceType: m.SourceType,
 		CreateTime: m.CreateTime.Unix(),
-		UpdateTime: m.UpdateTime.Unix()}
+		UpdateTime: m.UpdateTime.Unix(),
+		Deleted:    m.IsDeleted}
 }
 
 func (o *mapper) ToOutPutUsers(arr []*storage.User) []*OutputUser {
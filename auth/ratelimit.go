@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"math"
+	"path"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/errcode"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+// MatchedLimit returns the limit applying to a call of the api of the service, nil if there is none.
+// Service and API of a limit are names, glob patterns such as `MpoolPush*`, or empty (or `*`) for any,
+// the most specific limit wins:
+//  1. both service and api are given
+//  2. api only, the limit applies to the api of any service
+//  3. service only, the limit applies to every api of the service
+//  4. neither, the global limit of the user
+//
+// Among the limits of the same rank, a name wins over a pattern, then the longer pattern wins.
+func (ls GetUserRateLimitResponse) MatchedLimit(service, api string) *storage.UserRateLimit {
+	var matched *storage.UserRateLimit
+	var best limitScore
+	for _, l := range ls {
+		score, ok := scoreLimit(l, service, api)
+		if !ok {
+			continue
+		}
+		if matched == nil || best.less(score) {
+			matched, best = l, score
+		}
+	}
+	return matched
+}
+
+const (
+	matchAny = iota
+	matchPattern
+	matchName
+)
+
+type limitScore struct {
+	rank       int
+	api        int
+	service    int
+	patternLen int
+}
+
+func (s limitScore) less(o limitScore) bool {
+	if s.rank != o.rank {
+		return s.rank < o.rank
+	}
+	if s.api != o.api {
+		return s.api < o.api
+	}
+	if s.service != o.service {
+		return s.service < o.service
+	}
+	return s.patternLen < o.patternLen
+}
+
+func scoreLimit(l *storage.UserRateLimit, service, api string) (limitScore, bool) {
+	svc, ok := matchField(l.Service, service)
+	if !ok {
+		return limitScore{}, false
+	}
+	method, ok := matchField(l.API, api)
+	if !ok {
+		return limitScore{}, false
+	}
+	score := limitScore{api: method, service: svc, patternLen: len(l.API) + len(l.Service)}
+	switch {
+	case svc != matchAny && method != matchAny:
+		score.rank = 3
+	case method != matchAny:
+		score.rank = 2
+	case svc != matchAny:
+		score.rank = 1
+	}
+	return score, true
+}
+
+// matchField tells how the pattern of a limit matches the name, a malformed pattern matches nothing
+func matchField(pattern, name string) (int, bool) {
+	switch {
+	case pattern == "" || pattern == "*":
+		return matchAny, true
+	case pattern == name:
+		return matchName, true
+	}
+	ok, err := path.Match(pattern, name)
+	return matchPattern, ok && err == nil
+}
+
+// checkRateLimit validates the limit against the other limits of the user,
+// which can't have two limits of the same service and api.
+func checkRateLimit(limit *storage.UserRateLimit, limits []*storage.UserRateLimit) error {
+	if limit.ReqLimit.Cap <= 0 || limit.ReqLimit.ResetDur <= 0 {
+		return errcode.Wrap(errcode.ErrInvalidArgument, xerrors.Errorf("cap %d and reset duration %s of rate limit must be positive",
+			limit.ReqLimit.Cap, limit.ReqLimit.ResetDur))
+	}
+	for _, pattern := range []string{limit.Service, limit.API} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errcode.Wrap(errcode.ErrInvalidArgument, xerrors.Errorf("malformed pattern %q: %w", pattern, err))
+		}
+	}
+	for _, l := range limits {
+		if l.Id != limit.Id && anyField(l.Service) == anyField(limit.Service) && anyField(l.API) == anyField(limit.API) {
+			return xerrors.Errorf("rate limit %s of service %q and api %q: %w", l.Id, limit.Service, limit.API, ErrorRateLimitExists)
+		}
+	}
+	return nil
+}
+
+// anyField makes the empty field and `*` the same
+func anyField(pattern string) string {
+	if pattern == "*" {
+		return ""
+	}
+	return pattern
+}
+
+// TakeRateLimit counts the calls of the user in a token bucket per limit, held by the store,
+// so that the services sharing the limits of a user share the counts as well.
+func (o *jwtOAuth) TakeRateLimit(ctx context.Context, req *TakeRateLimitRequest) (*TakeRateLimitResponse, error) {
+	cost := req.Cost
+	if cost == 0 {
+		cost = 1
+	}
+	if cost < 0 {
+		return nil, errcode.Wrap(errcode.ErrInvalidArgument, xerrors.Errorf("cost %d must be positive", cost))
+	}
+	limits, err := o.store.GetRateLimits(req.User, "")
+	if err != nil {
+		return nil, err
+	}
+	limit := GetUserRateLimitResponse(limits).MatchedLimit(req.Service, req.API)
+	if limit == nil || limit.ReqLimit.Cap <= 0 || limit.ReqLimit.ResetDur <= 0 {
+		return &TakeRateLimitResponse{Allowed: true}, nil
+	}
+	if cost > limit.ReqLimit.Cap {
+		return nil, errcode.Wrap(errcode.ErrInvalidArgument,
+			xerrors.Errorf("cost %d exceeds the cap %d of limit %s", cost, limit.ReqLimit.Cap, limit.Id))
+	}
+	var res *TakeRateLimitResponse
+	err = o.store.UpdateRateBucket(storage.RateBucketKey(req.User, limit.Id), func(b *storage.RateBucket) error {
+		res = takeBucket(b, limit, cost, time.Now())
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("take rate limit %s: %w", limit.Id, err)
+	}
+	return res, nil
+}
+
+// takeBucket refills the bucket up to now, at the rate of cap per reset duration,
+// then takes cost from it if it holds enough.
+func takeBucket(b *storage.RateBucket, limit *storage.UserRateLimit, cost int64, now time.Time) *TakeRateLimitResponse {
+	capacity := float64(limit.ReqLimit.Cap)
+	perNano := capacity / float64(limit.ReqLimit.ResetDur)
+	if b.RefillTime == 0 {
+		b.Tokens = capacity
+	} else if elapsed := now.UnixNano() - b.RefillTime; elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+float64(elapsed)*perNano)
+	}
+	// the bucket may be fuller than a lowered cap
+	b.Tokens = math.Min(capacity, b.Tokens)
+	b.RefillTime = now.UnixNano()
+
+	res := &TakeRateLimitResponse{LimitID: limit.Id, Cap: limit.ReqLimit.Cap}
+	if b.Tokens >= float64(cost) {
+		b.Tokens -= float64(cost)
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration(math.Ceil((float64(cost) - b.Tokens) / perNano))
+	}
+	res.Remaining = int64(math.Floor(b.Tokens))
+	res.ResetAfter = time.Duration(math.Ceil((capacity - b.Tokens) / perNano))
+	return res
+}
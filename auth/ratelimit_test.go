@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+func TestMatchedLimit(t *testing.T) {
+	limits := func(ls ...[2]string) GetUserRateLimitResponse {
+		res := make(GetUserRateLimitResponse, 0, len(ls))
+		for _, l := range ls {
+			res = append(res, &storage.UserRateLimit{Id: l[0] + "/" + l[1], Service: l[0], API: l[1]})
+		}
+		return res
+	}
+	global := [2]string{"", ""}
+	venus := [2]string{"venus", ""}
+	push := [2]string{"", "MpoolPush"}
+	venusPush := [2]string{"venus", "MpoolPush"}
+
+	cases := []struct {
+		name    string
+		limits  GetUserRateLimitResponse
+		service string
+		api     string
+		want    string // id of the matched limit, empty for none
+	}{
+		{"no limit", limits(), "venus", "MpoolPush", ""},
+		{"global", limits(global), "venus", "MpoolPush", "/"},
+		{"star is global", limits([2]string{"*", "*"}), "venus", "MpoolPush", "*/*"},
+		{"other service", limits([2]string{"messager", ""}), "venus", "MpoolPush", ""},
+		{"service over global", limits(global, venus), "venus", "ChainHead", "venus/"},
+		{"api over service", limits(global, venus, push), "venus", "MpoolPush", "/MpoolPush"},
+		{"exact over all", limits(venusPush, global, venus, push), "venus", "MpoolPush", "venus/MpoolPush"},
+		{"order doesn't matter", limits(push, venus, global, venusPush), "venus", "MpoolPush", "venus/MpoolPush"},
+		{"exact of other api", limits(global, venusPush), "venus", "MpoolPushMessage", "/"},
+		{"api glob", limits(global, [2]string{"", "MpoolPush*"}), "venus", "MpoolPushMessage", "/MpoolPush*"},
+		{"api glob over service", limits(venus, [2]string{"", "Mpool*"}), "venus", "MpoolPush", "/Mpool*"},
+		{"api name over glob", limits([2]string{"", "Mpool*"}, push), "venus", "MpoolPush", "/MpoolPush"},
+		{"longer glob", limits([2]string{"", "Mpool*"}, [2]string{"", "MpoolPush*"}), "venus", "MpoolPushMessage", "/MpoolPush*"},
+		{"service glob", limits(global, [2]string{"venus-*", ""}), "venus-messager", "Push", "venus-*/"},
+		{"service name over glob", limits([2]string{"venus*", "Push"}, [2]string{"venus", "Push"}), "venus", "Push", "venus/Push"},
+		{"api name over service name", limits([2]string{"venus", "Mpool*"}, [2]string{"venus*", "MpoolPush"}), "venus", "MpoolPush", "venus*/MpoolPush"},
+		{"malformed glob", limits(global, [2]string{"", "Mpool["}), "venus", "MpoolPush", "/"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.limits.MatchedLimit(c.service, c.api)
+			id := ""
+			if got != nil {
+				id = got.Id
+			}
+			assert.Equal(t, id, c.want)
+		})
+	}
+}
+
+func TestTakeBucket(t *testing.T) {
+	// 10 calls per 10s, a call is refilled every second
+	limit := &storage.UserRateLimit{Id: "l1", ReqLimit: storage.ReqLimit{Cap: 10, ResetDur: 10 * time.Second}}
+	b := &storage.RateBucket{Key: "user/l1"}
+	t0 := time.Unix(1600000000, 0)
+
+	steps := []struct {
+		at         time.Duration
+		cost       int64
+		allowed    bool
+		remaining  int64
+		resetAfter time.Duration
+		retryAfter time.Duration
+	}{
+		{0, 1, true, 9, time.Second, 0}, // a new bucket is full
+		{0, 9, true, 0, 10 * time.Second, 0},
+		{0, 1, false, 0, 10 * time.Second, time.Second},
+		{1500 * time.Millisecond, 2, false, 1, 8500 * time.Millisecond, 500 * time.Millisecond},
+		{2 * time.Second, 2, true, 0, 10 * time.Second, 0},
+		{time.Hour, 1, true, 9, time.Second, 0}, // never fuller than the cap
+	}
+	for i, s := range steps {
+		step := fmt.Sprintf("step %d", i)
+		res := takeBucket(b, limit, s.cost, t0.Add(s.at))
+		assert.Equal(t, res.Allowed, s.allowed, step)
+		assert.Equal(t, res.Remaining, s.remaining, step)
+		assert.Equal(t, res.ResetAfter, s.resetAfter, step)
+		assert.Equal(t, res.RetryAfter, s.retryAfter, step)
+		assert.Equal(t, res.LimitID, "l1")
+	}
+
+	// the cap is lowered
+	limit.ReqLimit.Cap = 5
+	res := takeBucket(b, limit, 1, t0.Add(time.Hour))
+	assert.Equal(t, res.Remaining, int64(4))
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// maxRevocations is the number of revocations kept for the clients polling them,
+// a client falling further behind is asked to drop everything it cached.
+const maxRevocations = 1024
+
+// RevocationEvent tells the clients caching verify results which tokens are no longer valid,
+// only one of the fields is set.
+type RevocationEvent struct {
+	Seq uint64 `json:"seq"`
+	// Hash is the hash of a removed token
+	Hash string `json:"hash,omitempty"`
+	// User is set when the tokens issued to the user are rejected, see config.Config.RequireUser
+	User string `json:"user,omitempty"`
+	// Kid is set when the tokens signed by the key are rejected
+	Kid string `json:"kid,omitempty"`
+}
+
+// revocationLog keeps the latest revocations in memory, it's reset when the server restarts,
+// which is told to the clients by a new epoch.
+type revocationLog struct {
+	lk     sync.Mutex
+	epoch  string
+	seq    uint64
+	events []*RevocationEvent
+}
+
+func newRevocationLog() *revocationLog {
+	return &revocationLog{epoch: uuid.New().String()}
+}
+
+func (l *revocationLog) add(evs ...*RevocationEvent) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	for _, ev := range evs {
+		l.seq++
+		ev.Seq = l.seq
+		l.events = append(l.events, ev)
+	}
+	if len(l.events) > maxRevocations {
+		l.events = append(l.events[:0:0], l.events[len(l.events)-maxRevocations:]...)
+	}
+}
+
+// since returns the revocations after seq, Reset is set when they are unknown
+func (l *revocationLog) since(epoch string, seq uint64) *RevocationsResponse {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	res := &RevocationsResponse{Epoch: l.epoch, Seq: l.seq, Events: []*RevocationEvent{}}
+	oldest := l.seq + 1
+	if len(l.events) > 0 {
+		oldest = l.events[0].Seq
+	}
+	if epoch != l.epoch || seq > l.seq || seq+1 < oldest {
+		res.Reset = true
+		return res
+	}
+	for _, ev := range l.events {
+		if ev.Seq > seq {
+			res.Events = append(res.Events, ev)
+		}
+	}
+	return res
+}
@@ -2,8 +2,10 @@ package auth
 
 import (
 	"bytes"
+	"crypto/x509"
 	"github.com/filecoin-project/venus-auth/core"
 	"github.com/filecoin-project/venus-auth/log"
+	"github.com/filecoin-project/venus-auth/storage"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"time"
@@ -11,51 +13,76 @@ import (
 
 func InitRouter(app OAuthApp) http.Handler {
 	router := gin.New()
-	router.Use(CorsMiddleWare())
-	router.POST("/verify", verifyInterceptor(), app.Verify)
-	router.POST("/genToken", app.GenerateToken)
-	router.DELETE("/token", app.RemoveToken)
-	router.GET("/tokens", app.Tokens)
+	router.Use(CorsMiddleWare(), clientIdentity())
+	router.POST("/verify", verifyInterceptor("verify"), app.Verify)
+	// open like /verify, the caller has to hold the token
+	router.POST("/introspect", verifyInterceptor("introspect"), app.Introspect)
+	router.GET("/.well-known/jwks.json", app.JWKS)
+	// polled by the clients caching verify results, with an admin token as it names the users
+	router.GET("/revocations", app.RequireAdmin, app.Revocations)
+	router.POST("/genToken", app.RequireAdmin, app.GenerateToken)
+	router.DELETE("/token", app.RequireAdmin, app.RemoveToken)
+	router.GET("/tokens", app.RequireAdmin, app.Tokens)
 
+	keyGroup := router.Group("/key", app.RequireAdmin)
+	keyGroup.GET("/list", app.ListKeys)
+	keyGroup.POST("/rotate", app.RotateKey)
+	keyGroup.POST("/retire", app.RetireKey)
+
+	// the archive of tokens, users, rate limits and signing keys, restored by the cli
+	router.GET("/backup", app.RequireAdmin, app.Backup)
+
+	// the services query the users through jwtclient with an admin token
 	userGroup := router.Group("/user")
-	userGroup.PUT("/new", app.CreateUser)
-	userGroup.POST("/update", app.UpdateUser)
-	userGroup.GET("/list", app.ListUsers)
-	userGroup.GET("", app.GetUser)
+	userGroup.PUT("/new", app.RequireAdmin, app.CreateUser)
+	userGroup.POST("/update", app.RequireAdmin, app.UpdateUser)
+	userGroup.DELETE("", app.RequireAdmin, app.DeleteUser)
+	userGroup.POST("/add-miner", app.RequireAdmin, app.AddMiner)
+	userGroup.POST("/remove-miner", app.RequireAdmin, app.RemoveMiner)
+	userGroup.GET("/list", app.RequireAdmin, app.ListUsers)
+	userGroup.GET("", app.RequireAdmin, app.GetUser)
 
 	rateLimitGroup := userGroup.Group("/ratelimit")
-	rateLimitGroup.POST("/upsert", app.UpsertUserRateLimit)
-	rateLimitGroup.POST("/del", app.DelUserRateLimit)
-	rateLimitGroup.GET("", app.GetUserRateLimit)
+	rateLimitGroup.POST("/add", app.RequireAdmin, app.AddUserRateLimit)
+	rateLimitGroup.POST("/update", app.RequireAdmin, app.UpdateUserRateLimit)
+	rateLimitGroup.POST("/upsert", app.RequireAdmin, app.UpsertUserRateLimit)
+	rateLimitGroup.POST("/del", app.RequireAdmin, app.DelUserRateLimit)
+	rateLimitGroup.GET("", app.RequireAdmin, app.GetUserRateLimit)
+
+	// called by the services limiting the calls of users, with an admin token as it drains the buckets of any user
+	router.POST("/ratelimit/take", app.RequireAdmin, app.TakeRateLimit)
 
-	minerGroup := router.Group("/miner")
+	minerGroup := router.Group("/miner", app.RequireAdmin)
 	minerGroup.GET("/has-miner", app.HasMiner)
 	minerGroup.GET("", app.GetMiner)
 
 	return router
 }
 
-func verifyInterceptor() gin.HandlerFunc {
+// verifyInterceptor logs the calls checking a token, method is the measurement of the log hook
+func verifyInterceptor(method string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		blw := &bodyLogWriter{body: bytes.NewBufferString(""), ResponseWriter: c.Writer}
 		defer func(begin time.Time) {
-			verifyLog(begin, c, blw.body)
+			verifyLog(method, begin, c, blw.body)
 		}(time.Now())
 		c.Writer = blw
 		c.Next()
 	}
 }
 
-func verifyLog(begin time.Time, c *gin.Context, writer *bytes.Buffer) {
+// verifyLog only logs the prefix of the token, the token itself is a credential
+func verifyLog(method string, begin time.Time, c *gin.Context, writer *bytes.Buffer) {
 	fields := log.Fields{
 		core.FieldIP:      c.ClientIP(),
 		core.FieldSpanId:  c.Request.Header["spanId"],  // nolint
 		core.FieldPreHost: c.Request.Header["preHost"], // nolint
 		core.FieldElapsed: time.Since(begin).Milliseconds(),
-		core.FieldToken:   c.Request.Form.Get("token"),
+		core.FieldToken:   storage.Token(c.Request.Form.Get("token")).Prefix(),
 		core.FieldSvcName: c.Request.Header["svcName"], // nolint
+		core.FieldClient:  c.Keys[core.FieldClient],
 	}
-	fields[core.MTMethod] = "verify"
+	fields[core.MTMethod] = method
 	errs := c.Errors
 	if len(errs) > 0 {
 		log.WithFields(fields).Errorln(errs.String())
@@ -65,6 +92,26 @@ func verifyLog(begin time.Time, c *gin.Context, writer *bytes.Buffer) {
 	log.WithFields(fields).Traceln(writer.String())
 }
 
+// clientIdentity keeps the name of the verified client certificate of a TLS connection for the logs,
+// the permissions still come from the tokens
+func clientIdentity() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if tlsState := c.Request.TLS; tlsState != nil && len(tlsState.VerifiedChains) > 0 {
+			c.Set(core.FieldClient, ClientIdentity(tlsState.VerifiedChains[0][0]))
+		}
+		c.Next()
+	}
+}
+
+// ClientIdentity maps a client certificate to the identity of the client,
+// the common name of the subject, or the first DNS name when it has none
+func ClientIdentity(cert *x509.Certificate) string {
+	if len(cert.Subject.CommonName) > 0 || len(cert.DNSNames) == 0 {
+		return cert.Subject.CommonName
+	}
+	return cert.DNSNames[0]
+}
+
 type bodyLogWriter struct {
 	gin.ResponseWriter
 	body *bytes.Buffer
@@ -0,0 +1,361 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/config"
+	"github.com/filecoin-project/venus-auth/errcode"
+	"github.com/filecoin-project/venus-auth/log"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+// JWK is the public part of a server key, see RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// Verifier returns the algorithm checking signatures made by the key
+func (k *JWK) Verifier() (jwt.Algorithm, error) {
+	enc := base64.RawURLEncoding
+	x, err := enc.DecodeString(k.X)
+	if err != nil {
+		return nil, xerrors.Errorf("decode x of key %s: %w", k.Kid, err)
+	}
+	switch {
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return nil, xerrors.Errorf("invalid Ed25519 public key %s", k.Kid)
+		}
+		return jwt.NewEd25519(jwt.Ed25519PublicKey(x)), nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		y, err := enc.DecodeString(k.Y)
+		if err != nil {
+			return nil, xerrors.Errorf("decode y of key %s: %w", k.Kid, err)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, xerrors.Errorf("invalid P-256 public key %s", k.Kid)
+		}
+		return jwt.NewES256(jwt.ECDSAPublicKey(pub)), nil
+	}
+	return nil, xerrors.Errorf("unsupported key %s: kty %s, crv %s", k.Kid, k.Kty, k.Crv)
+}
+
+// serverKey is a signing key ready to use
+type serverKey struct {
+	kid        string
+	alg        config.SignAlg
+	createTime time.Time
+	retired    bool
+	signer     jwt.Algorithm
+	verifier   jwt.Algorithm
+	// nil for symmetric keys, which are never published
+	jwk *JWK
+}
+
+func newServerKey(k *storage.SigningKey) (*serverKey, error) {
+	raw, err := hex.DecodeString(k.PrivateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("decode key %s: %w", k.Kid, err)
+	}
+	sk := &serverKey{kid: k.Kid, alg: k.Alg, createTime: k.CreateTime, retired: k.Retired}
+	if k.Alg == config.SignHS256 {
+		sk.signer = jwt.NewHS256(raw)
+		sk.verifier = sk.signer
+		return sk, nil
+	}
+
+	priv, err := x509.ParsePKCS8PrivateKey(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("parse key %s: %w", k.Kid, err)
+	}
+	enc := base64.RawURLEncoding
+	switch key := priv.(type) {
+	case ed25519.PrivateKey:
+		sk.signer = jwt.NewEd25519(jwt.Ed25519PrivateKey(key))
+		sk.jwk = &JWK{Kty: "OKP", Crv: "Ed25519", Alg: "EdDSA",
+			X: enc.EncodeToString(key.Public().(ed25519.PublicKey))}
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, xerrors.Errorf("key %s is not on P-256", k.Kid)
+		}
+		sk.signer = jwt.NewES256(jwt.ECDSAPrivateKey(key))
+		sk.jwk = &JWK{Kty: "EC", Crv: "P-256", Alg: config.SignES256,
+			X: enc.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y: enc.EncodeToString(key.Y.FillBytes(make([]byte, 32)))}
+	default:
+		return nil, xerrors.Errorf("unsupported key %s: %T", k.Kid, priv)
+	}
+	sk.jwk.Kid = k.Kid
+	sk.jwk.Use = "sig"
+	if sk.verifier, err = sk.jwk.Verifier(); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+func (sk *serverKey) info(active bool) *KeyInfo {
+	return &KeyInfo{Kid: sk.kid, Alg: sk.alg, CreateTime: sk.createTime, Retired: sk.retired, Active: active}
+}
+
+// newSigningKey generates a key, the kid is derived from the public key, or the secret for HS256
+func newSigningKey(alg config.SignAlg) (*storage.SigningKey, error) {
+	var priv interface{}
+	var pub []byte
+	switch alg {
+	case config.SignHS256:
+		secret, err := config.RandSecret()
+		if err != nil {
+			return nil, err
+		}
+		return symmetricKey(secret), nil
+	case config.SignEd25519:
+		pk, sk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		priv, pub = sk, pk
+	case config.SignES256:
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		priv, pub = sk, elliptic.Marshal(sk.Curve, sk.X, sk.Y)
+	default:
+		return nil, xerrors.Errorf("unsupported sign algorithm %s", alg)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(pub)
+	return &storage.SigningKey{
+		Kid:        hex.EncodeToString(sum[:8]),
+		Alg:        alg,
+		PrivateKey: hex.EncodeToString(der),
+		CreateTime: time.Now(),
+	}, nil
+}
+
+func symmetricKey(secret []byte) *storage.SigningKey {
+	// the kid must not reveal the secret
+	sum := sha256.Sum256(append([]byte("venus-auth kid:"), secret...))
+	return &storage.SigningKey{
+		Kid:        hex.EncodeToString(sum[:8]),
+		Alg:        config.SignHS256,
+		PrivateKey: hex.EncodeToString(secret),
+		CreateTime: time.Now(),
+	}
+}
+
+// keyringReload is how often the keys are loaded again from the store,
+// so that keys added or retired through another instance take effect.
+const keyringReload = time.Minute
+
+// keyring holds the server keys, the newest key of the configured algorithm which is not retired
+// signs new tokens, tokens signed by any key which is not retired are accepted.
+type keyring struct {
+	store storage.Store
+	alg   config.SignAlg
+	// master is the key of the master secret of the config, it's held in memory only,
+	// it verifies the tokens signed before the keyring and never signs new ones.
+	master *serverKey
+
+	lk       sync.RWMutex
+	keys     map[string]*serverKey
+	active   *serverKey
+	loadTime time.Time
+}
+
+// loadKeyring adds the master secret to the keys loaded from the store,
+// it signed the tokens created before the keyring.
+func loadKeyring(store storage.Store, alg config.SignAlg, secret []byte) (*keyring, error) {
+	if len(alg) == 0 {
+		alg = config.SignHS256
+	}
+	switch alg {
+	case config.SignHS256, config.SignEd25519, config.SignES256:
+	default:
+		return nil, xerrors.Errorf("unsupported sign algorithm %s", alg)
+	}
+	kr := &keyring{store: store, alg: alg}
+	if len(secret) > 0 {
+		key := symmetricKey(secret)
+		// older than any key of the store
+		key.CreateTime = time.Time{}
+		master, err := newServerKey(key)
+		if err != nil {
+			return nil, err
+		}
+		kr.master = master
+	}
+	if err := kr.load(); err != nil {
+		return nil, err
+	}
+	if kr.activeKey() == nil {
+		key, err := newSigningKey(alg)
+		if err != nil {
+			return nil, err
+		}
+		if err = kr.add(key); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+func (kr *keyring) load() error {
+	keys, err := kr.store.ListSigningKeys()
+	if err != nil {
+		return xerrors.Errorf("list signing keys: %w", err)
+	}
+	loaded := make(map[string]*serverKey, len(keys))
+	var active *serverKey
+	for _, k := range keys {
+		sk, err := newServerKey(k)
+		if err != nil {
+			return err
+		}
+		loaded[k.Kid] = sk
+		// the master secret may be stored by an older version
+		isMaster := kr.master != nil && k.Kid == kr.master.kid
+		if !isMaster && !sk.retired && sk.alg == kr.alg && (active == nil || sk.createTime.After(active.createTime)) {
+			active = sk
+		}
+	}
+	if kr.master != nil {
+		if _, ok := loaded[kr.master.kid]; !ok {
+			loaded[kr.master.kid] = kr.master
+		}
+	}
+	kr.lk.Lock()
+	defer kr.lk.Unlock()
+	kr.keys, kr.active, kr.loadTime = loaded, active, time.Now()
+	return nil
+}
+
+func (kr *keyring) reloadIfStale() {
+	kr.lk.RLock()
+	stale := time.Since(kr.loadTime) > keyringReload
+	kr.lk.RUnlock()
+	if stale {
+		if err := kr.load(); err != nil {
+			log.Errorf("reload keyring: %s", err)
+		}
+	}
+}
+
+func (kr *keyring) add(key *storage.SigningKey) error {
+	if err := kr.store.PutSigningKey(key); err != nil {
+		return xerrors.Errorf("store signing key: %w", err)
+	}
+	return kr.load()
+}
+
+func (kr *keyring) retire(kid string) error {
+	if err := kr.load(); err != nil {
+		return err
+	}
+	key := kr.get(kid)
+	if key == nil {
+		return errcode.Wrap(errcode.ErrNotFound, xerrors.Errorf("key %s not exists", kid))
+	}
+	if key == kr.activeKey() {
+		return errcode.Wrap(errcode.ErrInvalidArgument,
+			xerrors.Errorf("key %s is signing new tokens, rotate to a new key before retiring it", kid))
+	}
+	if key == kr.master {
+		return errcode.Wrap(errcode.ErrInvalidArgument,
+			xerrors.Errorf("key %s is the master secret of the config, it can't be retired", kid))
+	}
+	keys, err := kr.store.ListSigningKeys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.Kid == kid {
+			k.Retired = true
+			if err = kr.store.PutSigningKey(k); err != nil {
+				return xerrors.Errorf("store signing key: %w", err)
+			}
+		}
+	}
+	return kr.load()
+}
+
+// activeKey returns the key signing new tokens
+func (kr *keyring) activeKey() *serverKey {
+	kr.reloadIfStale()
+	kr.lk.RLock()
+	defer kr.lk.RUnlock()
+	return kr.active
+}
+
+// get returns the key, retired keys included
+func (kr *keyring) get(kid string) *serverKey {
+	kr.reloadIfStale()
+	kr.lk.RLock()
+	key := kr.keys[kid]
+	kr.lk.RUnlock()
+	if key == nil {
+		// the key may be just added by another instance
+		if err := kr.load(); err != nil {
+			log.Errorf("reload keyring: %s", err)
+			return nil
+		}
+		kr.lk.RLock()
+		key = kr.keys[kid]
+		kr.lk.RUnlock()
+	}
+	return key
+}
+
+func (kr *keyring) list() []*KeyInfo {
+	kr.reloadIfStale()
+	kr.lk.RLock()
+	defer kr.lk.RUnlock()
+	infos := make([]*KeyInfo, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		infos = append(infos, k.info(k == kr.active))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreateTime.Before(infos[j].CreateTime) })
+	return infos
+}
+
+// jwks returns the public keys which are not retired
+func (kr *keyring) jwks() *JWKSet {
+	kr.reloadIfStale()
+	kr.lk.RLock()
+	defer kr.lk.RUnlock()
+	set := &JWKSet{Keys: make([]*JWK, 0, len(kr.keys))}
+	for _, k := range kr.keys {
+		if k.jwk != nil && !k.retired {
+			set.Keys = append(set.Keys, k.jwk)
+		}
+	}
+	return set
+}
@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"time"
+
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/venus-auth/core"
 	"github.com/filecoin-project/venus-auth/storage"
+	"golang.org/x/xerrors"
 )
 
 type VerifyRequest struct {
@@ -11,10 +14,79 @@ type VerifyRequest struct {
 }
 type VerifyResponse = JWTPayload
 
+// IntrospectRequest follows RFC 7662, token_type_hint is accepted but ignored,
+// there is only one type of token.
+type IntrospectRequest struct {
+	Token         string `form:"token" binding:"required"`
+	TokenTypeHint string `form:"token_type_hint"`
+}
+
+// IntrospectResponse follows RFC 7662, only active is set for an invalid token
+type IntrospectResponse struct {
+	Active bool `json:"active"`
+	// the permissions granted, space separated
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	// unix seconds
+	Exp int64 `json:"exp,omitempty"`
+	Iat int64 `json:"iat,omitempty"`
+	Nbf int64 `json:"nbf,omitempty"`
+	// extensions
+	Kid   string          `json:"kid,omitempty"`
+	Perm  core.Permission `json:"perm,omitempty"`
+	Extra string          `json:"ext,omitempty"`
+}
+
+type RevocationsRequest struct {
+	Epoch string `form:"epoch"`
+	Seq   uint64 `form:"seq"`
+}
+
+// RevocationsResponse lists the revocations after the requested seq,
+// Reset is set when they are unknown, the client must drop all the verify results it cached.
+type RevocationsResponse struct {
+	Epoch  string             `json:"epoch"`
+	Seq    uint64             `json:"seq"`
+	Reset  bool               `json:"reset"`
+	Events []*RevocationEvent `json:"events"`
+}
+
 type GenTokenRequest struct {
 	Name  string `form:"name" json:"name" binding:"required"`
 	Perm  string `form:"perm" json:"perm"`
 	Extra string `form:"extra" json:"extra"`
+	// TTL and ExpireAt are mutually exclusive, ExpireAt and NotBefore are unix seconds
+	TTL       time.Duration `form:"ttl" json:"ttl"`
+	ExpireAt  int64         `form:"expireAt" json:"expireAt"`
+	NotBefore int64         `form:"notBefore" json:"notBefore"`
+}
+
+// Validity resolves the requested validity window into unix seconds
+func (req *GenTokenRequest) Validity(now time.Time) (expireAt, notBefore int64, err error) {
+	if req.TTL < 0 || req.ExpireAt < 0 || req.NotBefore < 0 {
+		return 0, 0, xerrors.New("ttl, expireAt and notBefore must not be negative")
+	}
+	if req.TTL > 0 && req.ExpireAt > 0 {
+		return 0, 0, xerrors.New("ttl and expireAt are mutually exclusive")
+	}
+	expireAt, notBefore = req.ExpireAt, req.NotBefore
+	if req.TTL > 0 {
+		start := now
+		if notBefore > now.Unix() {
+			start = time.Unix(notBefore, 0)
+		}
+		expireAt = start.Add(req.TTL).Unix()
+	}
+	if expireAt > 0 && expireAt <= now.Unix() {
+		return 0, 0, xerrors.New("expireAt must be in the future")
+	}
+	if expireAt > 0 && notBefore >= expireAt {
+		return 0, 0, xerrors.New("notBefore must be earlier than expireAt")
+	}
+	return expireAt, notBefore, nil
 }
 
 type GenTokenResponse struct {
@@ -22,11 +94,14 @@ type GenTokenResponse struct {
 }
 
 type RemoveTokenRequest struct {
+	// the token or its hash
 	Token string `form:"token" json:"token" binding:"required"`
 }
 
 type GetTokensRequest struct {
 	*core.Page
+	// User filters the tokens issued under the name
+	User string `form:"user"`
 }
 
 // @sourceType: keyCode 1
@@ -66,8 +141,34 @@ type DelUserRateLimitReq struct {
 }
 
 type GetUserRateLimitResponse []*storage.UserRateLimit
+
+// TakeRateLimitRequest takes cost from the bucket of the limit matching the call of the api of the service
+type TakeRateLimitRequest struct {
+	User    string `form:"user" json:"user" binding:"required"`
+	Service string `form:"service" json:"service"`
+	API     string `form:"api" json:"api"`
+	// Cost is 1 when not set
+	Cost int64 `form:"cost" json:"cost"`
+}
+
+type TakeRateLimitResponse struct {
+	Allowed bool `json:"allowed"`
+	// LimitID is the id of the matched limit, empty when the call is not limited
+	LimitID   string `json:"limitId,omitempty"`
+	Cap       int64  `json:"cap"`
+	Remaining int64  `json:"remaining"`
+	// ResetAfter is the time until the bucket is full again
+	ResetAfter time.Duration `json:"resetAfter"`
+	// RetryAfter is the time until the cost can be taken, set when the call is denied
+	RetryAfter time.Duration `json:"retryAfter,omitempty"`
+}
 type UpsertUserRateLimitReq storage.UserRateLimit
 
+type AddUserRateLimitReq storage.UserRateLimit
+
+// UpdateUserRateLimitReq replaces the limit of the Id
+type UpdateUserRateLimitReq storage.UserRateLimit
+
 type CreateUserRequest struct {
 	Name       string          `form:"name" binding:"required"`
 	Miner      string          `form:"miner"` // miner address f01234
@@ -88,14 +189,35 @@ type UpdateUserRequest struct {
 }
 
 type OutputUser struct {
-	Id         string          `json:"id"`
-	Name       string          `json:"name"`
-	Miner      address.Address `json:"miner"` // miner address f01234
-	SourceType core.SourceType `json:"sourceType"`
-	Comment    string          `json:"comment"`
-	State      int             `json:"state"`
-	CreateTime int64           `json:"createTime"`
-	UpdateTime int64           `json:"updateTime"`
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// the first miner of the user, or the miner queried by GetMiner
+	Miner      address.Address   `json:"miner"` // miner address f01234
+	Miners     []address.Address `json:"miners"`
+	SourceType core.SourceType   `json:"sourceType"`
+	Comment    string            `json:"comment"`
+	State      int               `json:"state"`
+	CreateTime int64             `json:"createTime"`
+	UpdateTime int64             `json:"updateTime"`
+	Deleted    bool              `json:"deleted,omitempty"`
+}
+
+type UserMinerRequest struct {
+	Name  string `form:"name" json:"name" binding:"required"`
+	Miner string `form:"miner" json:"miner" binding:"required"` // miner address f01234
+}
+
+type DeleteUserRequest struct {
+	Name string `form:"name" json:"name" binding:"required"`
+	// a soft delete disables the user and keeps a tombstone, a hard delete removes it with its rate limits
+	Hard bool `form:"hard" json:"hard"`
+	// remove every token issued under the name
+	RevokeTokens bool `form:"revokeTokens" json:"revokeTokens"`
+}
+
+type DeleteUserResponse struct {
+	Name          string `json:"name"`
+	RevokedTokens int    `json:"revokedTokens"`
 }
 
 type GetUserRequest struct {
@@ -112,13 +234,24 @@ type GetMinerRequest struct {
 	Miner string `form:"miner"`
 }
 
-func (ls GetUserRateLimitResponse) MatchedLimit(service, api string) *storage.UserRateLimit {
-	// just returns root matched limit currently
-	// todo: returns most matched limit
-	for _, l := range ls {
-		if l.Service == "" && l.API == "" {
-			return l
-		}
-	}
-	return nil
+type KeyInfo struct {
+	Kid        string    `json:"kid"`
+	Alg        string    `json:"alg"`
+	CreateTime time.Time `json:"createTime"`
+	Retired    bool      `json:"retired"`
+	// the key signs new tokens
+	Active bool `json:"active"`
+}
+
+type ListKeysResponse = []*KeyInfo
+
+type RotateKeyRequest struct {
+	// defaults to the configured SignAlg
+	Alg string `form:"alg" json:"alg"`
+	// the kid of a key to retire once the new key is active
+	Retire string `form:"retire" json:"retire"`
+}
+
+type RetireKeyRequest struct {
+	Kid string `form:"kid" json:"kid" binding:"required"`
 }
@@ -1,21 +1,33 @@
 package cli
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+
 	"github.com/filecoin-project/venus-auth/auth"
 	"github.com/filecoin-project/venus-auth/config"
 	"github.com/filecoin-project/venus-auth/core"
 	"github.com/filecoin-project/venus-auth/errcode"
+	"github.com/filecoin-project/venus-auth/util"
 	"github.com/go-resty/resty/v2"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 type LocalClient interface {
 	GenerateToken(name, perm, extra string) (string, error)
+	GenerateTokenReq(req *auth.GenTokenRequest) (string, error)
 	Tokens(pageIndex, pageSize int64) (auth.GetTokensResponse, error)
 	RemoveToken(token string) error
 	DelUserRateLimit(req *auth.DelUserRateLimitReq) (string, error)
@@ -41,22 +53,92 @@ func GetCli(ctx *cli.Context) (*localClient, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("failed to decode config err: %w", err)
 	}
-	return newClient(cnf.Port)
+	token, err := ioutil.ReadFile(path.Join(p, AdminTokenFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("failed to read admin token: %w", err)
+	}
+	// the socket is preferred, it's served over plain http
+	if cnf.Socket.Enabled() {
+		return newClientURL(util.UnixURLPrefix+cnf.Socket.Path, strings.TrimSpace(string(token)))
+	}
+	client, err := newClient(cnf.Port, strings.TrimSpace(string(token)))
+	if err != nil {
+		return nil, err
+	}
+	if cnf.TLS.Enabled() {
+		if err = client.withTLS(cnf.TLS); err != nil {
+			return nil, xerrors.Errorf("tls: %w", err)
+		}
+	}
+	return client, nil
 }
 
-func newClient(port string) (*localClient, error) {
+// newClient creates a client for the local daemon, the admin token is required by the management API
+func newClient(port, token string) (*localClient, error) {
+	return newClientURL("http://localhost:"+port, token)
+}
+
+// newClientURL creates a client for the daemon at url, unix:///path/of/socket dials the socket of the daemon
+func newClientURL(url, token string) (*localClient, error) {
 	client := resty.New().
-		SetHostURL("http://localhost:"+port).
 		SetHeader("Accept", "application/json")
+	if socket, ok := util.UnixSocket(url); ok {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		util.DialUnix(transport, socket)
+		client.SetTransport(transport)
+		url = util.UnixHostURL
+	}
+	client.SetHostURL(url)
+	if len(token) > 0 {
+		client.SetAuthToken(token)
+	}
 	return &localClient{cli: client}, nil
 }
 
+// withTLS talks to the daemon over TLS, the certificate of the daemon is pinned to the one of the config,
+// so that a self-signed one needs no CA. The local certificate is presented when it's configured.
+func (lc *localClient) withTLS(cnf *config.TLSConfig) error {
+	buf, err := ioutil.ReadFile(cnf.CertFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return xerrors.Errorf("no certificate is found in %s", cnf.CertFile)
+	}
+	tlsCnf := &tls.Config{
+		// the certificate is checked by VerifyPeerCertificate instead
+		InsecureSkipVerify: true, // nolint
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], block.Bytes) {
+				return xerrors.New("the certificate of the daemon is not the configured one")
+			}
+			return nil
+		},
+	}
+	if len(cnf.LocalCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cnf.LocalCertFile, cnf.LocalKeyFile)
+		if err != nil {
+			return xerrors.Errorf("load local certificate: %w", err)
+		}
+		tlsCnf.Certificates = []tls.Certificate{cert}
+	}
+	lc.cli.SetTLSClientConfig(tlsCnf).
+		SetHostURL(strings.Replace(lc.cli.HostURL, "http://", "https://", 1))
+	return nil
+}
+
 func (lc *localClient) GenerateToken(name, perm, extra string) (string, error) {
-	resp, err := lc.cli.R().SetBody(auth.GenTokenRequest{
+	return lc.GenerateTokenReq(&auth.GenTokenRequest{
 		Name:  name,
 		Perm:  perm,
 		Extra: extra,
-	}).SetResult(&auth.GenTokenResponse{}).SetError(&errcode.ErrMsg{}).Post("/genToken")
+	})
+}
+
+func (lc *localClient) GenerateTokenReq(req *auth.GenTokenRequest) (string, error) {
+	resp, err := lc.cli.R().SetBody(req).
+		SetResult(&auth.GenTokenResponse{}).SetError(&errcode.ErrMsg{}).Post("/genToken")
 	if err != nil {
 		return core.EmptyString, err
 	}
@@ -68,9 +150,15 @@ func (lc *localClient) GenerateToken(name, perm, extra string) (string, error) {
 }
 
 func (lc *localClient) Tokens(skip, limit int64) (auth.GetTokensResponse, error) {
+	return lc.UserTokens("", skip, limit)
+}
+
+// UserTokens lists the tokens issued under the name, all of them if the name is empty
+func (lc *localClient) UserTokens(name string, skip, limit int64) (auth.GetTokensResponse, error) {
 	resp, err := lc.cli.R().SetQueryParams(map[string]string{
 		"skip":  strconv.FormatInt(skip, 10),
 		"limit": strconv.FormatInt(limit, 10),
+		"user":  name,
 	}).SetResult(&auth.GetTokensResponse{}).SetError(&errcode.ErrMsg{}).Get("/tokens")
 	if err != nil {
 		return nil, err
@@ -94,6 +182,41 @@ func (lc *localClient) RemoveToken(token string) error {
 	return resp.Error().(*errcode.ErrMsg).Err()
 }
 
+func (lc *localClient) ListKeys() (auth.ListKeysResponse, error) {
+	resp, err := lc.cli.R().SetResult(&auth.ListKeysResponse{}).SetError(&errcode.ErrMsg{}).Get("/key/list")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return *(resp.Result().(*auth.ListKeysResponse)), nil
+	}
+	return nil, resp.Error().(*errcode.ErrMsg).Err()
+}
+
+func (lc *localClient) RotateKey(req *auth.RotateKeyRequest) (*auth.KeyInfo, error) {
+	resp, err := lc.cli.R().SetBody(req).
+		SetResult(&auth.KeyInfo{}).SetError(&errcode.ErrMsg{}).Post("/key/rotate")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return resp.Result().(*auth.KeyInfo), nil
+	}
+	return nil, resp.Error().(*errcode.ErrMsg).Err()
+}
+
+func (lc *localClient) RetireKey(kid string) error {
+	resp, err := lc.cli.R().SetBody(&auth.RetireKeyRequest{Kid: kid}).
+		SetError(&errcode.ErrMsg{}).Post("/key/retire")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return nil
+	}
+	return resp.Error().(*errcode.ErrMsg).Err()
+}
+
 func (lc *localClient) CreateUser(req *auth.CreateUserRequest) (*auth.CreateUserResponse, error) {
 	resp, err := lc.cli.R().
 		SetHeader("Content-Type", "application/json").
@@ -110,6 +233,44 @@ func (lc *localClient) CreateUser(req *auth.CreateUserRequest) (*auth.CreateUser
 	return nil, resp.Error().(*errcode.ErrMsg).Err()
 }
 
+func (lc *localClient) DeleteUser(req *auth.DeleteUserRequest) (*auth.DeleteUserResponse, error) {
+	resp, err := lc.cli.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(req).
+		SetResult(&auth.DeleteUserResponse{}).
+		SetError(&errcode.ErrMsg{}).
+		Delete("/user")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return resp.Result().(*auth.DeleteUserResponse), nil
+	}
+	return nil, resp.Error().(*errcode.ErrMsg).Err()
+}
+
+func (lc *localClient) AddMiner(req *auth.UserMinerRequest) error {
+	resp, err := lc.cli.R().SetBody(req).SetError(&errcode.ErrMsg{}).Post("/user/add-miner")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return nil
+	}
+	return resp.Error().(*errcode.ErrMsg).Err()
+}
+
+func (lc *localClient) RemoveMiner(req *auth.UserMinerRequest) error {
+	resp, err := lc.cli.R().SetBody(req).SetError(&errcode.ErrMsg{}).Post("/user/remove-miner")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return nil
+	}
+	return resp.Error().(*errcode.ErrMsg).Err()
+}
+
 // UpdateUser
 func (lc *localClient) UpdateUser(req *auth.UpdateUserRequest) error {
 	resp, err := lc.cli.R().
@@ -198,6 +359,29 @@ func (lc *localClient) GetUserRateLimit(name, id string) (auth.GetUserRateLimitR
 	return nil, resp.Error().(*errcode.ErrMsg).Err()
 }
 
+func (lc *localClient) AddUserRateLimit(req *auth.AddUserRateLimitReq) (string, error) {
+	var res string
+	resp, err := lc.cli.R().SetBody(req).SetResult(&res).SetError(&errcode.ErrMsg{}).Post("/user/ratelimit/add")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return *(resp.Result().(*string)), nil
+	}
+	return "", resp.Error().(*errcode.ErrMsg).Err()
+}
+
+func (lc *localClient) UpdateUserRateLimit(req *auth.UpdateUserRateLimitReq) error {
+	resp, err := lc.cli.R().SetBody(req).SetError(&errcode.ErrMsg{}).Post("/user/ratelimit/update")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return nil
+	}
+	return resp.Error().(*errcode.ErrMsg).Err()
+}
+
 func (lc *localClient) UpsertUserRateLimit(req *auth.UpsertUserRateLimitReq) (string, error) {
 	var res string
 	resp, err := lc.cli.R().SetBody(req).SetResult(&res).SetError(&errcode.ErrMsg{}).Post("/user/ratelimit/upsert")
@@ -221,3 +405,22 @@ func (lc *localClient) DelUserRateLimit(req *auth.DelUserRateLimitReq) (string,
 	}
 	return "", resp.Error().(*errcode.ErrMsg).Err()
 }
+
+// Backup writes the archive taken by the daemon to w
+func (lc *localClient) Backup(w io.Writer) error {
+	resp, err := lc.cli.R().SetDoNotParseResponse(true).Get("/backup")
+	if err != nil {
+		return err
+	}
+	body := resp.RawBody()
+	defer body.Close() // nolint
+	if resp.StatusCode() != http.StatusOK {
+		msg := new(errcode.ErrMsg)
+		if err = json.NewDecoder(body).Decode(msg); err != nil {
+			return xerrors.Errorf("backup: response code is %d", resp.StatusCode())
+		}
+		return msg.Err()
+	}
+	_, err = io.Copy(w, body)
+	return err
+}
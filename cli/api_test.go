@@ -1,27 +1,49 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"path"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/xerrors"
 	"gotest.tools/assert"
 
 	"github.com/filecoin-project/go-address"
 
 	"github.com/filecoin-project/venus-auth/auth"
+	"github.com/filecoin-project/venus-auth/cmd/jwtclient"
 	"github.com/filecoin-project/venus-auth/config"
 	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/errcode"
+	"github.com/filecoin-project/venus-auth/storage"
 	"github.com/filecoin-project/venus-auth/util"
 )
 
 var mockCnf *config.Config
+var mockAdminToken string
 
-//nolint
+// nolint
 func TestMain(m *testing.M) {
 	address.CurrentNetwork = address.Mainnet
 	gin.SetMode(gin.TestMode)
@@ -40,11 +62,20 @@ func TestMain(m *testing.M) {
 		log.Fatalf("failed to create temp dir err:%s", err)
 	}
 	defer os.RemoveAll(tmpPath)
-	app, err := auth.NewOAuthApp(cnf.Secret, tmpPath, cnf.DB)
+	srv, err := auth.NewOAuthService(tmpPath, cnf)
 	if err != nil {
 		log.Fatalf("Failed to init oauthApp : %s", err)
 	}
-	router := auth.InitRouter(app)
+	tokenPath := path.Join(tmpPath, AdminTokenFile)
+	if err = ensureAdminToken(context.Background(), srv, tokenPath); err != nil {
+		log.Fatalf("Failed to prepare admin token : %s", err)
+	}
+	token, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		log.Fatalf("Failed to read admin token : %s", err)
+	}
+	mockAdminToken = string(token)
+	router := auth.InitRouter(auth.NewOAuthApp(srv))
 	server := &http.Server{
 		Addr:         ":" + cnf.Port,
 		Handler:      router,
@@ -52,8 +83,12 @@ func TestMain(m *testing.M) {
 		WriteTimeout: cnf.WriteTimeout,
 		IdleTimeout:  cnf.IdleTimeout,
 	}
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("failed to listen on %s err:%s", server.Addr, err)
+	}
 	log.Printf("server start and listen on %s", cnf.Port)
-	go server.ListenAndServe() //nolint
+	go server.Serve(ln) //nolint
 	defer func() {
 		server.Close()
 		log.Println("server closed")
@@ -62,13 +97,28 @@ func TestMain(m *testing.M) {
 }
 
 func mockClient(t *testing.T) *localClient {
-	cli, err := newClient(mockCnf.Port)
+	cli, err := newClient(mockCnf.Port, mockAdminToken)
 	if err != nil {
 		t.Fatal(err)
 	}
 	return cli
 }
 
+// userTokens lists tokens except the bootstrap admin token
+func userTokens(t *testing.T, cli *localClient) auth.GetTokensResponse {
+	tks, err := cli.Tokens(0, 10)
+	if err != nil {
+		t.Fatalf("get tokens err:%s", err)
+	}
+	res := make(auth.GetTokensResponse, 0, len(tks))
+	for _, tk := range tks {
+		if tk.Name != AdminTokenName {
+			res = append(res, tk)
+		}
+	}
+	return res
+}
+
 func TestTokenBusiness(t *testing.T) {
 	cli := mockClient(t)
 	tk1, err := cli.GenerateToken("Rennbon1", core.PermAdmin, "custom params")
@@ -81,24 +131,44 @@ func TestTokenBusiness(t *testing.T) {
 		t.Fatalf("gen token err:%s", err)
 	}
 
-	tks, err := cli.Tokens(0, 10)
-	if err != nil {
-		t.Fatalf("get tokens err:%s", err)
-	}
+	// tokens are listed in the order of their hashes
+	tks := userTokens(t, cli)
+	assert.Equal(t, len(tks), 2)
+	sort.Slice(tks, func(i, j int) bool { return tks[i].Name < tks[j].Name })
+	assert.DeepEqual(t, storage.Token(tk1).Hash().String(), tks[0].Hash)
+	assert.DeepEqual(t, storage.Token(tk1).Prefix(), tks[0].Prefix)
+	assert.DeepEqual(t, storage.Token(tk2).Hash().String(), tks[1].Hash)
 
-	assert.DeepEqual(t, tk1, tks[0].Token)
-	assert.DeepEqual(t, tk2, tks[1].Token)
-
-	err = cli.RemoveToken(tk1)
+	err = cli.RemoveToken(tks[0].Hash)
 	if err != nil {
 		t.Fatalf("remove token err:%s", err)
 	}
-	tks2, err := cli.Tokens(0, 10)
-	if err != nil {
-		t.Fatalf("get tokens err:%s", err)
-	}
+	tks2 := userTokens(t, cli)
 	assert.Equal(t, len(tks2), 1)
-	assert.DeepEqual(t, tks2[0].Token, tk2)
+	assert.DeepEqual(t, tks2[0].Hash, storage.Token(tk2).Hash().String())
+}
+
+func TestTokenUnique(t *testing.T) {
+	cli := mockClient(t)
+	verifier := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port)
+	tk1, err := cli.GenerateToken("unique", core.PermRead, "same")
+	assert.NilError(t, err)
+	tk2, err := cli.GenerateToken("unique", core.PermRead, "same")
+	assert.NilError(t, err)
+	assert.Assert(t, tk1 != tk2, "every token issued is a credential of its own")
+
+	assert.NilError(t, cli.RemoveToken(storage.Token(tk1).Hash().String()))
+	_, err = verifier.Verify(context.Background(), tk1)
+	assert.Assert(t, err != nil, "the removed token is rejected")
+	res, err := verifier.Verify(context.Background(), tk2)
+	assert.NilError(t, err)
+	assert.Equal(t, res.Name, "unique")
+	tk3, err := cli.GenerateToken("unique", core.PermRead, "same")
+	assert.NilError(t, err)
+	_, err = verifier.Verify(context.Background(), tk3)
+	assert.NilError(t, err, "a token issued again after a removal is valid")
+	assert.NilError(t, cli.RemoveToken(tk2))
+	assert.NilError(t, cli.RemoveToken(tk3))
 }
 
 func TestUserBusiness(t *testing.T) {
@@ -193,3 +263,731 @@ func TestUserBusiness(t *testing.T) {
 	assert.DeepEqual(t, users[1].Name, user.Name)
 	assert.DeepEqual(t, users[1].Miner.String(), user.Miner.String())
 }
+
+func TestTokenValidity(t *testing.T) {
+	cli := mockClient(t)
+	verifier := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port)
+
+	_, err := cli.GenerateTokenReq(&auth.GenTokenRequest{
+		Name:     "validity",
+		Perm:     core.PermRead,
+		TTL:      time.Hour,
+		ExpireAt: time.Now().Add(time.Hour).Unix(),
+	})
+	assert.Assert(t, err != nil, "ttl and expireAt should be mutually exclusive")
+
+	tk, err := cli.GenerateTokenReq(&auth.GenTokenRequest{
+		Name:      "validity",
+		Perm:      core.PermRead,
+		NotBefore: time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("gen token err:%s", err)
+	}
+	_, err = verifier.Verify(context.Background(), tk)
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), auth.ErrorTokenNotValidYet.Error()))
+
+	tk, err = cli.GenerateTokenReq(&auth.GenTokenRequest{
+		Name: "validity",
+		Perm: core.PermRead,
+		TTL:  2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("gen token err:%s", err)
+	}
+	res, err := verifier.Verify(context.Background(), tk)
+	if err != nil {
+		t.Fatalf("verify token err:%s", err)
+	}
+	assert.Assert(t, res.ExpireAt > 0)
+
+	time.Sleep(2100 * time.Millisecond)
+	_, err = verifier.Verify(context.Background(), tk)
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), auth.ErrorTokenExpired.Error()))
+
+	tks, err := cli.Tokens(0, 100)
+	if err != nil {
+		t.Fatalf("get tokens err:%s", err)
+	}
+	for _, v := range tks {
+		if v.Hash == storage.Token(tk).Hash().String() {
+			assert.Equal(t, v.ExpireAt, res.ExpireAt)
+		}
+	}
+}
+
+func TestManagementAuth(t *testing.T) {
+	anonymous, err := newClient(mockCnf.Port, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = anonymous.GenerateToken("anonymous", core.PermAdmin, "")
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), auth.ErrorMissingAuthToken.Error()))
+
+	tk, err := mockClient(t).GenerateToken("reader", core.PermRead, "")
+	if err != nil {
+		t.Fatalf("gen token err:%s", err)
+	}
+	reader, err := newClient(mockCnf.Port, tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.Tokens(0, 10)
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), auth.ErrorPermissionDenied.Error()))
+
+	// the miners and the revocations name the users, they are queried with an admin token too
+	_, err = anonymous.HasMiner(&auth.HasMinerRequest{Miner: "f01234"})
+	assert.ErrorContains(t, err, auth.ErrorMissingAuthToken.Error())
+	_, err = reader.HasMiner(&auth.HasMinerRequest{Miner: "f01234"})
+	assert.ErrorContains(t, err, auth.ErrorPermissionDenied.Error())
+	verifier := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port)
+	_, err = verifier.Revocations(context.Background(), "", 0)
+	assert.ErrorContains(t, err, auth.ErrorMissingAuthToken.Error())
+	_, err = verifier.SetToken(mockAdminToken).Revocations(context.Background(), "", 0)
+	assert.NilError(t, err)
+	_, err = mockClient(t).HasMiner(&auth.HasMinerRequest{Miner: "f01234"})
+	assert.NilError(t, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	cli := mockClient(t)
+	verifier := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port)
+
+	keys, err := cli.ListKeys()
+	if err != nil {
+		t.Fatalf("list keys err:%s", err)
+	}
+	var oldKid string
+	for _, k := range keys {
+		if k.Active {
+			oldKid = k.Kid
+		}
+	}
+	assert.Assert(t, len(oldKid) > 0, "there must be an active key")
+	err = cli.RetireKey(oldKid)
+	assert.Assert(t, err != nil, "the active key can't be retired")
+
+	oldTk, err := cli.GenerateToken("rotation", core.PermRead, "")
+	if err != nil {
+		t.Fatalf("gen token err:%s", err)
+	}
+	key, err := cli.RotateKey(&auth.RotateKeyRequest{})
+	if err != nil {
+		t.Fatalf("rotate key err:%s", err)
+	}
+	assert.Assert(t, key.Active && key.Kid != oldKid)
+	newTk, err := cli.GenerateToken("rotation", core.PermRead, "")
+	if err != nil {
+		t.Fatalf("gen token err:%s", err)
+	}
+	// the new admin token is needed once the key of the bootstrap one is retired
+	adminTk, err := cli.GenerateToken(AdminTokenName, core.PermAdmin, "")
+	if err != nil {
+		t.Fatalf("gen token err:%s", err)
+	}
+
+	// both keys are accepted during the overlap window
+	for _, tk := range []string{oldTk, newTk} {
+		_, err = verifier.Verify(context.Background(), tk)
+		assert.NilError(t, err)
+	}
+
+	assert.NilError(t, cli.RetireKey(oldKid))
+	mockAdminToken = adminTk
+	_, err = verifier.Verify(context.Background(), oldTk)
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), auth.ErrorVerificationFailed.Error()))
+	_, err = verifier.Verify(context.Background(), newTk)
+	assert.NilError(t, err)
+
+	cli = mockClient(t)
+	assert.NilError(t, cli.RemoveToken(oldTk))
+	assert.NilError(t, cli.RemoveToken(newTk))
+}
+
+func TestIntrospect(t *testing.T) {
+	cli := mockClient(t)
+	introspector := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port)
+
+	expireAt := time.Now().Add(time.Hour).Unix()
+	tk, err := cli.GenerateTokenReq(&auth.GenTokenRequest{
+		Name:     "introspect",
+		Perm:     core.PermWrite,
+		Extra:    "custom",
+		ExpireAt: expireAt,
+	})
+	if err != nil {
+		t.Fatalf("gen token err:%s", err)
+	}
+	res, err := introspector.Introspect(context.Background(), tk)
+	assert.NilError(t, err)
+	assert.Assert(t, res.Active)
+	assert.Equal(t, res.Sub, "introspect")
+	assert.Equal(t, res.ClientID, "introspect")
+	assert.Equal(t, res.Scope, "write read")
+	assert.Equal(t, res.Exp, expireAt)
+	assert.Assert(t, res.Iat > 0 && res.Iat <= time.Now().Unix())
+	assert.Equal(t, res.Extra, "custom")
+
+	assert.NilError(t, cli.RemoveToken(tk))
+	res, err = introspector.Introspect(context.Background(), tk)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, &auth.IntrospectResponse{Active: false})
+}
+
+func TestDeleteUser(t *testing.T) {
+	cli := mockClient(t)
+	verifier := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port)
+	name := "deleted-user"
+
+	_, err := cli.CreateUser(&auth.CreateUserRequest{
+		Name:  name,
+		Miner: "f03456",
+		State: core.UserStateEnabled,
+	})
+	if err != nil {
+		t.Fatalf("create user err:%s", err)
+	}
+	_, err = cli.UpsertUserRateLimit(&auth.UpsertUserRateLimitReq{
+		Name:     name,
+		ReqLimit: storage.ReqLimit{Cap: 10, ResetDur: time.Minute},
+	})
+	if err != nil {
+		t.Fatalf("upsert rate limit err:%s", err)
+	}
+	tk, err := cli.GenerateToken(name, core.PermRead, "")
+	if err != nil {
+		t.Fatalf("gen token err:%s", err)
+	}
+
+	// soft delete keeps a disabled tombstone, hidden from the miner queries
+	res, err := cli.DeleteUser(&auth.DeleteUserRequest{Name: name})
+	assert.NilError(t, err)
+	assert.Equal(t, res.RevokedTokens, 0)
+	user, err := cli.GetUser(&auth.GetUserRequest{Name: name})
+	assert.NilError(t, err)
+	assert.Assert(t, user.Deleted)
+	assert.Equal(t, user.State, core.UserStateDisabled)
+	has, err := cli.HasMiner(&auth.HasMinerRequest{Miner: "f03456"})
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+	_, err = cli.CreateUser(&auth.CreateUserRequest{Name: name})
+	assert.Assert(t, err != nil, "the name of a soft deleted user stays taken")
+
+	res, err = cli.DeleteUser(&auth.DeleteUserRequest{Name: name, Hard: true, RevokeTokens: true})
+	assert.NilError(t, err)
+	assert.Equal(t, res.RevokedTokens, 1)
+	_, err = cli.GetUser(&auth.GetUserRequest{Name: name})
+	assert.Assert(t, err != nil)
+	limits, err := cli.GetUserRateLimit(name, "")
+	assert.Assert(t, err != nil || len(limits) == 0, "rate limits should be removed with the user")
+	_, err = verifier.Verify(context.Background(), tk)
+	assert.Assert(t, err != nil)
+
+	_, err = cli.DeleteUser(&auth.DeleteUserRequest{Name: name, Hard: true})
+	assert.Assert(t, err != nil)
+}
+
+func TestUserMiners(t *testing.T) {
+	cli := mockClient(t)
+	for _, name := range []string{"miners-user", "miners-other"} {
+		if _, err := cli.CreateUser(&auth.CreateUserRequest{Name: name, State: core.UserStateEnabled}); err != nil {
+			t.Fatalf("create user err:%s", err)
+		}
+	}
+	assert.NilError(t, cli.AddMiner(&auth.UserMinerRequest{Name: "miners-user", Miner: "f05001"}))
+	assert.NilError(t, cli.AddMiner(&auth.UserMinerRequest{Name: "miners-user", Miner: "f05002"}))
+	err := cli.AddMiner(&auth.UserMinerRequest{Name: "miners-other", Miner: "f05002"})
+	assert.Assert(t, err != nil, "a miner belongs to one user")
+
+	user, err := cli.GetMiner(&auth.GetMinerRequest{Miner: "f05002"})
+	assert.NilError(t, err)
+	assert.Equal(t, user.Name, "miners-user")
+	assert.Equal(t, user.Miner.String(), "f05002")
+	assert.Equal(t, len(user.Miners), 2)
+
+	assert.NilError(t, cli.RemoveMiner(&auth.UserMinerRequest{Name: "miners-user", Miner: "f05002"}))
+	has, err := cli.HasMiner(&auth.HasMinerRequest{Miner: "f05002"})
+	assert.NilError(t, err)
+	assert.Assert(t, !has)
+	has, err = cli.HasMiner(&auth.HasMinerRequest{Miner: "f05001"})
+	assert.NilError(t, err)
+	assert.Assert(t, has)
+	err = cli.RemoveMiner(&auth.UserMinerRequest{Name: "miners-other", Miner: "f05001"})
+	assert.Assert(t, err != nil, "the miner belongs to another user")
+}
+
+func TestRequireUser(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth-require-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpPath)
+	cnf := *mockCnf
+	cnf.RequireUser = true
+	srv, err := auth.NewOAuthService(tmpPath, &cnf)
+	if err != nil {
+		t.Fatalf("Failed to init oauthApp : %s", err)
+	}
+	ctx := context.Background()
+	// the owner of the admin token is created on demand
+	tokenPath := path.Join(tmpPath, AdminTokenFile)
+	assert.NilError(t, ensureAdminToken(ctx, srv, tokenPath))
+	admin, err := ioutil.ReadFile(tokenPath)
+	assert.NilError(t, err)
+	_, err = srv.Verify(ctx, string(admin))
+	assert.NilError(t, err)
+
+	name := "bound-user"
+	_, err = srv.GenerateToken(ctx, &auth.JWTPayload{Name: name, Perm: core.PermRead})
+	assert.ErrorType(t, err, auth.ErrorUserNotFound)
+	_, err = srv.CreateUser(ctx, &auth.CreateUserRequest{Name: name, State: core.UserStateEnabled})
+	assert.NilError(t, err)
+	tk, err := srv.GenerateToken(ctx, &auth.JWTPayload{Name: name, Perm: core.PermRead})
+	assert.NilError(t, err)
+	_, err = srv.Verify(ctx, tk)
+	assert.NilError(t, err)
+	tks, err := srv.Tokens(ctx, name, 0, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tks), 1)
+
+	assert.NilError(t, srv.UpdateUser(ctx, &auth.UpdateUserRequest{Name: name, KeySum: 4, State: core.UserStateDisabled}))
+	_, err = srv.Verify(ctx, tk)
+	assert.ErrorType(t, err, auth.ErrorUserDisabled)
+	res, err := srv.Introspect(ctx, tk)
+	assert.NilError(t, err)
+	assert.Assert(t, !res.Active)
+
+	// a user created again under the name doesn't own the tokens of the removed one
+	_, err = srv.DeleteUser(ctx, &auth.DeleteUserRequest{Name: name, Hard: true})
+	assert.NilError(t, err)
+	_, err = srv.CreateUser(ctx, &auth.CreateUserRequest{Name: name, State: core.UserStateEnabled})
+	assert.NilError(t, err)
+	_, err = srv.Verify(ctx, tk)
+	assert.ErrorType(t, err, auth.ErrorUserNotFound)
+	// the token issued to it is bound to it, not to the removed one
+	tk2, err := srv.GenerateToken(ctx, &auth.JWTPayload{Name: name, Perm: core.PermRead})
+	assert.NilError(t, err)
+	assert.Assert(t, tk2 != tk)
+	_, err = srv.Verify(ctx, tk2)
+	assert.NilError(t, err)
+}
+
+func TestUserTokens(t *testing.T) {
+	cli := mockClient(t)
+	for i, name := range []string{"tokens-user", "tokens-user", "tokens-other"} {
+		if _, err := cli.GenerateToken(name, core.PermRead, strconv.Itoa(i)); err != nil {
+			t.Fatalf("gen token err:%s", err)
+		}
+	}
+	tks, err := cli.UserTokens("tokens-user", 0, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tks), 2)
+	for _, tk := range tks {
+		assert.Equal(t, tk.Name, "tokens-user")
+	}
+	tks, err = cli.UserTokens("tokens-user", 1, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tks), 1)
+}
+
+func TestCachedVerifyRevocation(t *testing.T) {
+	cli := mockClient(t)
+	verifier := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cached := jwtclient.NewCachedAuthClient(ctx, jwtclient.WarpIJwtAuthClient(verifier), verifier, &jwtclient.CacheConfig{
+		MaxSize:      100,
+		TTL:          time.Hour,
+		NegativeTTL:  time.Hour,
+		PollInterval: 20 * time.Millisecond,
+	}, nil)
+
+	tk, err := cli.GenerateToken("cached-user", core.PermRead, "")
+	assert.NilError(t, err)
+	// the first poll drops everything cached before it
+	time.Sleep(100 * time.Millisecond)
+	_, err = cached.Verify(ctx, tk)
+	assert.NilError(t, err)
+	assert.NilError(t, cli.RemoveToken(tk))
+	// the cached result lives for an hour, it's evicted by the revocation
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err = cached.Verify(ctx, tk); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the removed token is still accepted")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+type limitedAPI struct {
+	Internal struct {
+		MpoolPush func(ctx context.Context) (string, error)
+		ChainHead func(ctx context.Context) (string, error)
+	}
+}
+
+func TestTakeRateLimit(t *testing.T) {
+	cli := mockClient(t)
+	ctx := context.Background()
+	name := "limited-user"
+	_, err := jwtclient.NewJWTClient("http://localhost:"+mockCnf.Port).TakeRateLimit(ctx, &auth.TakeRateLimitRequest{User: name})
+	assert.ErrorContains(t, err, auth.ErrorMissingAuthToken.Error(), "the buckets are drained by the services holding an admin token")
+	verifier := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port).SetToken(mockAdminToken)
+	_, err = cli.CreateUser(&auth.CreateUserRequest{Name: name, State: core.UserStateEnabled})
+	assert.NilError(t, err)
+	for _, l := range []*auth.UpsertUserRateLimitReq{
+		{Name: name, ReqLimit: storage.ReqLimit{Cap: 3, ResetDur: time.Hour}},
+		{Name: name, Service: "venus", API: "MpoolPush*", ReqLimit: storage.ReqLimit{Cap: 1, ResetDur: time.Hour}},
+	} {
+		_, err := cli.UpsertUserRateLimit(l)
+		assert.NilError(t, err)
+	}
+
+	res, err := verifier.TakeRateLimit(ctx, &auth.TakeRateLimitRequest{User: "unlimited-user", Service: "venus", API: "MpoolPush"})
+	assert.NilError(t, err)
+	assert.Assert(t, res.Allowed)
+	assert.Equal(t, res.LimitID, "")
+
+	res, err = verifier.TakeRateLimit(ctx, &auth.TakeRateLimitRequest{User: name, Service: "venus", API: "ChainHead", Cost: 2})
+	assert.NilError(t, err)
+	assert.Assert(t, res.Allowed)
+	assert.Equal(t, res.Remaining, int64(1))
+	_, err = verifier.TakeRateLimit(ctx, &auth.TakeRateLimitRequest{User: name, Service: "venus", API: "ChainHead", Cost: 4})
+	assert.Assert(t, err != nil, "the cost exceeds the cap")
+
+	// the limiter of the service counts on venus-auth
+	var in, out limitedAPI
+	in.Internal.MpoolPush = func(ctx context.Context) (string, error) { return "pushed", nil }
+	in.Internal.ChainHead = func(ctx context.Context) (string, error) { return "head", nil }
+	jwtclient.NewRemoteLimiter(verifier, "venus", &jwtclient.ValueFromCtx{}, nil).WarperLimiter(in.Internal, &out.Internal)
+	userCtx := jwtclient.CtxWithName(ctx, name)
+	res1, err := out.Internal.MpoolPush(userCtx)
+	assert.NilError(t, err)
+	assert.Equal(t, res1, "pushed")
+	_, err = out.Internal.MpoolPush(userCtx)
+	assert.ErrorContains(t, err, "is limited")
+	_, err = out.Internal.ChainHead(userCtx)
+	assert.NilError(t, err)
+	_, err = out.Internal.ChainHead(userCtx)
+	assert.ErrorContains(t, err, "is limited")
+	_, err = out.Internal.ChainHead(ctx)
+	assert.NilError(t, err, "a call without user is not limited")
+}
+
+func TestAddUpdateRateLimit(t *testing.T) {
+	cli := mockClient(t)
+	name, other := "rate-limit-user", "rate-limit-other"
+	for _, n := range []string{name, other} {
+		_, err := cli.CreateUser(&auth.CreateUserRequest{Name: n, State: core.UserStateEnabled})
+		assert.NilError(t, err)
+	}
+	limit := storage.ReqLimit{Cap: 10, ResetDur: time.Minute}
+
+	_, err := cli.AddUserRateLimit(&auth.AddUserRateLimitReq{Name: "rate-limit-nobody", ReqLimit: limit})
+	assert.ErrorContains(t, err, auth.ErrorUserNotFound.Error())
+	_, err = cli.AddUserRateLimit(&auth.AddUserRateLimitReq{Name: name})
+	assert.ErrorContains(t, err, "must be positive")
+
+	id, err := cli.AddUserRateLimit(&auth.AddUserRateLimitReq{Name: name, API: "ChainHead", ReqLimit: limit})
+	assert.NilError(t, err)
+	assert.Assert(t, len(id) > 0)
+	_, err = cli.AddUserRateLimit(&auth.AddUserRateLimitReq{Id: id, Name: name, API: "MpoolPush", ReqLimit: limit})
+	assert.ErrorContains(t, err, auth.ErrorRateLimitExists.Error())
+	_, err = cli.AddUserRateLimit(&auth.AddUserRateLimitReq{Name: name, Service: "*", API: "ChainHead", ReqLimit: limit})
+	assert.ErrorContains(t, err, auth.ErrorRateLimitExists.Error(), "the same service and api")
+	_, err = cli.AddUserRateLimit(&auth.AddUserRateLimitReq{Id: id, Name: other, ReqLimit: limit})
+	assert.ErrorContains(t, err, "belongs to user "+name)
+
+	err = cli.UpdateUserRateLimit(&auth.UpdateUserRateLimitReq{Id: "missing", Name: name, ReqLimit: limit})
+	assert.ErrorContains(t, err, auth.ErrorRateLimitNotFound.Error())
+	err = cli.UpdateUserRateLimit(&auth.UpdateUserRateLimitReq{Id: id, Name: other, ReqLimit: limit})
+	assert.ErrorContains(t, err, auth.ErrorRateLimitNotFound.Error())
+	err = cli.UpdateUserRateLimit(&auth.UpdateUserRateLimitReq{Id: id, Name: name, API: "ChainHead", ReqLimit: storage.ReqLimit{Cap: 5, ResetDur: time.Minute}})
+	assert.NilError(t, err)
+	limits, err := cli.GetUserRateLimit(name, id)
+	assert.NilError(t, err)
+	assert.Equal(t, len(limits), 1)
+	assert.Equal(t, limits[0].ReqLimit.Cap, int64(5))
+}
+
+func TestCreateUserMinerTaken(t *testing.T) {
+	cli := mockClient(t)
+	_, err := cli.CreateUser(&auth.CreateUserRequest{Name: "taken-owner", Miner: "f03456", State: core.UserStateEnabled})
+	assert.NilError(t, err)
+	_, err = cli.DeleteUser(&auth.DeleteUserRequest{Name: "taken-owner"})
+	assert.NilError(t, err)
+
+	// the miner of the deleted user is still its own, the user is not created
+	_, err = cli.CreateUser(&auth.CreateUserRequest{Name: "taken-user", Miner: "f03456", State: core.UserStateEnabled})
+	assert.Assert(t, xerrors.Is(err, errcode.ErrAlreadyExists), err)
+	_, err = cli.GetUser(&auth.GetUserRequest{Name: "taken-user"})
+	assert.Assert(t, xerrors.Is(err, errcode.ErrNotFound), err)
+	_, err = cli.CreateUser(&auth.CreateUserRequest{Name: "taken-user", State: core.UserStateEnabled})
+	assert.NilError(t, err)
+}
+
+func TestErrorCodes(t *testing.T) {
+	cli := mockClient(t)
+	_, err := cli.GetUser(&auth.GetUserRequest{Name: "codes-nobody"})
+	assert.Assert(t, xerrors.Is(err, errcode.ErrNotFound), err)
+	_, err = cli.CreateUser(&auth.CreateUserRequest{Name: "codes-user", State: core.UserStateEnabled})
+	assert.NilError(t, err)
+	_, err = cli.CreateUser(&auth.CreateUserRequest{Name: "codes-user", State: core.UserStateEnabled})
+	assert.Assert(t, xerrors.Is(err, errcode.ErrAlreadyExists), err)
+	err = cli.AddMiner(&auth.UserMinerRequest{Name: "codes-user", Miner: "not-an-address"})
+	assert.Assert(t, xerrors.Is(err, errcode.ErrInvalidArgument), err)
+
+	// the status and the code of the body
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+mockCnf.Port+"/user?name=codes-nobody", nil)
+	assert.NilError(t, err)
+	req.Header.Set(core.ServiceToken, "Bearer "+mockAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	defer resp.Body.Close() // nolint
+	var msg errcode.ErrMsg
+	assert.NilError(t, json.NewDecoder(resp.Body).Decode(&msg))
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	assert.Equal(t, msg.Code, errcode.CodeNotFound)
+
+	// jwtclient turns them back into typed errors
+	verifier := jwtclient.NewJWTClient("http://localhost:" + mockCnf.Port)
+	_, err = verifier.GetUser(&auth.GetUserRequest{Name: "codes-nobody"})
+	assert.ErrorContains(t, err, auth.ErrorMissingAuthToken.Error(), "the users are queried with an admin token")
+	verifier.SetToken(mockAdminToken)
+	_, err = verifier.GetUser(&auth.GetUserRequest{Name: "codes-nobody"})
+	assert.Assert(t, xerrors.Is(err, errcode.ErrNotFound), err)
+	_, err = verifier.Verify(context.Background(), "codes-unknown-token")
+	var se *jwtclient.StatusError
+	assert.Assert(t, xerrors.As(err, &se), err)
+	assert.Equal(t, se.Code, http.StatusUnauthorized, "an unknown token is rejected")
+}
+
+func TestBackup(t *testing.T) {
+	cli := mockClient(t)
+	_, err := cli.CreateUser(&auth.CreateUserRequest{Name: "backup-user", Miner: "f05101", State: core.UserStateEnabled})
+	assert.NilError(t, err)
+	_, err = cli.GenerateToken("backup-user", core.PermRead, "")
+	assert.NilError(t, err)
+
+	var buf bytes.Buffer
+	assert.NilError(t, cli.Backup(&buf))
+	sum, err := storage.CheckBackup(bytes.NewReader(buf.Bytes()))
+	assert.NilError(t, err)
+	assert.Assert(t, sum.Tokens >= 2, "the admin token and the token of the user")
+	assert.Assert(t, sum.Miners >= 1)
+
+	tmpPath, err := ioutil.TempDir("", "auth-restore")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpPath) // nolint
+	store, err := storage.NewStore(&config.DBConfig{Type: config.Badger}, tmpPath)
+	assert.NilError(t, err)
+	restored, err := storage.Restore(store, &buf)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, sum, restored)
+	user, err := store.GetUser("backup-user")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, user.Miners, []string{"f05101"})
+
+	noAdmin, err := newClient(mockCnf.Port, "")
+	assert.NilError(t, err)
+	assert.Assert(t, noAdmin.Backup(&buf) != nil, "admin only")
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go server.Serve(l) // nolint
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close() // nolint
+		status <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	assert.NilError(t, shutdown(server, time.Second))
+	assert.Equal(t, <-status, http.StatusOK, "the request in flight is drained")
+	_, err = http.Get("http://" + l.Addr().String())
+	assert.Assert(t, err != nil, "no connection is accepted after shutdown")
+}
+
+// writeTestCerts writes a CA, a certificate of the server for 127.0.0.1, and a client certificate of the CA
+func writeTestCerts(t *testing.T, dir string) (caFile, certFile, keyFile, clientCertFile, clientKeyFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "venus-auth test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	assert.NilError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.NilError(t, err)
+
+	write := func(name, typ string, der []byte) string {
+		file := path.Join(dir, name)
+		assert.NilError(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+		return file
+	}
+	issue := func(name string, tmpl *x509.Certificate) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NilError(t, err)
+		tmpl.NotBefore, tmpl.NotAfter = ca.NotBefore, ca.NotAfter
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		assert.NilError(t, err)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		assert.NilError(t, err)
+		return write(name+".pem", "CERTIFICATE", der), write(name+".key", "EC PRIVATE KEY", keyDER)
+	}
+	caFile = write("ca.pem", "CERTIFICATE", caDER)
+	certFile, keyFile = issue("server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "venus-auth"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	clientCertFile, clientKeyFile = issue("client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "venus-node"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return
+}
+
+func TestTLS(t *testing.T) {
+	tmpPath, err := ioutil.TempDir("", "auth-tls")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpPath) // nolint
+	caFile, certFile, keyFile, clientCertFile, clientKeyFile := writeTestCerts(t, tmpPath)
+
+	cnf, err := config.DefaultConfig()
+	assert.NilError(t, err)
+	cnf.TLS = &config.TLSConfig{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      caFile,
+		RequireClientCert: true,
+		LocalCertFile:     clientCertFile,
+		LocalKeyFile:      clientKeyFile,
+	}
+	srv, err := auth.NewOAuthService(tmpPath, cnf)
+	assert.NilError(t, err)
+	defer srv.Close() // nolint
+	tlsCnf, err := cnf.TLS.ServerConfig()
+	assert.NilError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	server := &http.Server{Handler: auth.InitRouter(auth.NewOAuthApp(srv)), TLSConfig: tlsCnf}
+	go server.ServeTLS(l, "", "") // nolint
+	defer server.Close()          // nolint
+	url := "https://" + l.Addr().String()
+
+	token, err := srv.GenerateToken(context.Background(), &auth.JWTPayload{Name: "tls-user", Perm: core.PermRead})
+	assert.NilError(t, err)
+	pool, err := util.LoadCertPool(caFile)
+	assert.NilError(t, err)
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	assert.NilError(t, err)
+
+	_, err = jwtclient.NewJWTClient(url).Verify(context.Background(), token)
+	assert.Assert(t, err != nil, "the CA of the server is unknown")
+	_, err = jwtclient.NewJWTClient(url, jwtclient.WithCA(pool)).Verify(context.Background(), token)
+	assert.Assert(t, err != nil, "a client certificate is required")
+	res, err := jwtclient.NewJWTClient(url, jwtclient.WithCA(pool), jwtclient.WithClientCert(clientCert)).Verify(context.Background(), token)
+	assert.NilError(t, err)
+	assert.Equal(t, res.Name, "tls-user")
+
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	assert.NilError(t, err)
+	assert.Equal(t, auth.ClientIdentity(leaf), "venus-node")
+
+	// the local cli pins the certificate of the server
+	adminToken, err := srv.GenerateToken(context.Background(), &auth.JWTPayload{Name: "tls-admin", Perm: core.PermAdmin})
+	assert.NilError(t, err)
+	lc, err := newClient(strconv.Itoa(l.Addr().(*net.TCPAddr).Port), adminToken)
+	assert.NilError(t, err)
+	assert.NilError(t, lc.withTLS(cnf.TLS))
+	lc.cli.SetHostURL(url)
+	tokens, err := lc.Tokens(0, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tokens), 2)
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are tested on unix")
+	}
+	tmpPath, err := ioutil.TempDir("", "auth-socket")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tmpPath) // nolint
+	cnf, err := config.DefaultConfig()
+	assert.NilError(t, err)
+	cnf.Port = ""
+	cnf.Socket = &config.SocketConfig{
+		Path:  path.Join(tmpPath, "auth.sock"),
+		Mode:  "0660",
+		Owner: strconv.Itoa(os.Getuid()),
+		Group: strconv.Itoa(os.Getgid()),
+	}
+
+	listeners, err := listen(cnf)
+	assert.NilError(t, err)
+	assert.Equal(t, len(listeners), 1, "the port is disabled")
+	fi, err := os.Stat(cnf.Socket.Path)
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode()&os.ModeSocket, os.ModeSocket)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0660))
+	_, err = listenUnix(cnf.Socket)
+	assert.Assert(t, err != nil, "the socket is in use")
+
+	// without a mode, the socket is only reachable by the user of the daemon
+	private := &config.SocketConfig{Path: path.Join(tmpPath, "private.sock")}
+	l, err := listenUnix(private)
+	assert.NilError(t, err)
+	fi, err = os.Stat(private.Path)
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0600))
+	assert.NilError(t, l.Close())
+
+	srv, err := auth.NewOAuthService(tmpPath, cnf)
+	assert.NilError(t, err)
+	defer srv.Close() // nolint
+	server := &http.Server{Handler: auth.InitRouter(auth.NewOAuthApp(srv))}
+	go serve(server, listeners[0]) // nolint
+
+	token, err := srv.GenerateToken(context.Background(), &auth.JWTPayload{Name: "socket-user", Perm: core.PermRead})
+	assert.NilError(t, err)
+	res, err := jwtclient.NewJWTClient(util.UnixURLPrefix+cnf.Socket.Path).Verify(context.Background(), token)
+	assert.NilError(t, err)
+	assert.Equal(t, res.Name, "socket-user")
+
+	adminToken, err := srv.GenerateToken(context.Background(), &auth.JWTPayload{Name: "socket-admin", Perm: core.PermAdmin})
+	assert.NilError(t, err)
+	lc, err := newClientURL(util.UnixURLPrefix+cnf.Socket.Path, adminToken)
+	assert.NilError(t, err)
+	tokens, err := lc.Tokens(0, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(tokens), 2)
+
+	assert.NilError(t, server.Close())
+	_, err = os.Stat(cnf.Socket.Path)
+	assert.Assert(t, os.IsNotExist(err), "the socket file is removed on close")
+}
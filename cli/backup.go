@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/auth"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+var backupCmd = &cli.Command{
+	Name:      "backup",
+	Usage:     "write the tokens, users, rate limits and signing keys of the running daemon to a file",
+	ArgsUsage: "<file>",
+	Description: "The archive is read from one snapshot of the db, whatever its type, and can be restored into any type of db.\n" +
+		"The secrets are kept as they are stored, the encrypted ones need the same key-encryption key after restore.",
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return xerrors.New("usage: backup <file>")
+		}
+		file := ctx.Args().First()
+		client, err := GetCli(ctx)
+		if err != nil {
+			return err
+		}
+		// the archive is checked before it takes the place of the file
+		tmp := file + ".tmp"
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp) // nolint
+		err = client.Backup(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		sum, err := checkBackupFile(tmp)
+		if err != nil {
+			return err
+		}
+		if err = os.Rename(tmp, file); err != nil {
+			return err
+		}
+		fmt.Printf("backup success: %d tokens, %d users, %d miners, %d rate limits, %d signing keys\n",
+			sum.Tokens, sum.Users, sum.Miners, sum.RateLimits, sum.SigningKeys)
+		return nil
+	},
+}
+
+var restoreCmd = &cli.Command{
+	Name:      "restore",
+	Usage:     "write the records of a backup to the configured db, which must be empty, the daemon must be stopped for badger",
+	ArgsUsage: "<file>",
+	Description: "The whole archive is checked before anything is written.\n" +
+		"The key-encryption key of the backed up daemon has to be configured when its secrets were encrypted.",
+	Action: func(cliCtx *cli.Context) error {
+		if cliCtx.NArg() != 1 {
+			return xerrors.New("usage: restore <file>")
+		}
+		_, dataPath, cnf := loadRepo(cliCtx)
+		f, err := os.Open(cliCtx.Args().First())
+		if err != nil {
+			return err
+		}
+		defer f.Close() // nolint
+		store, err := auth.OpenStore(dataPath, cnf)
+		if err != nil {
+			return err
+		}
+		defer store.Close() // nolint
+		sum, err := storage.Restore(store, f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restore success: %d tokens, %d users, %d miners, %d rate limits, %d signing keys\n",
+			sum.Tokens, sum.Users, sum.Miners, sum.RateLimits, sum.SigningKeys)
+		return nil
+	},
+}
+
+func checkBackupFile(file string) (*storage.BackupSummary, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint
+	sum, err := storage.CheckBackup(f)
+	if err != nil {
+		return nil, xerrors.Errorf("check backup %s: %w", file, err)
+	}
+	return sum, nil
+}
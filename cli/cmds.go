@@ -7,5 +7,11 @@ import (
 var Commands = []*cli.Command{
 	runCmd,
 	tokenSubCommand,
+	keySubCommand,
+	reEncryptCmd,
+	backupCmd,
+	restoreCmd,
+	migrateCmd,
+	dbSubCommand,
 	userSubCommand,
 }
@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/filecoin-project/venus-auth/auth"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+var dbSubCommand = &cli.Command{
+	Name:  "db",
+	Usage: "schema of the configured db, the daemon must be stopped for badger",
+	Subcommands: []*cli.Command{
+		dbStatusCmd,
+		dbMigrateCmd,
+	},
+}
+
+var dbStatusCmd = &cli.Command{
+	Name:  "status",
+	Usage: "list the migrations of the schema, and whether they are applied",
+	Action: func(cliCtx *cli.Context) error {
+		_, dataPath, cnf := loadRepo(cliCtx)
+		store, err := storage.NewStore(cnf.DB, dataPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close() // nolint
+		status, err := storage.SchemaStatus(store)
+		if err != nil {
+			return err
+		}
+		fmt.Println("version\tappliedAt\t\tname")
+		pending := 0
+		for _, st := range status {
+			applied := "pending\t\t"
+			if st.Applied() {
+				applied = st.AppliedAt.Format(timeLayout)
+			} else {
+				pending++
+			}
+			name := st.Name
+			if st.Unknown {
+				name += " (unknown, applied by a newer build)"
+			}
+			fmt.Printf("%d\t%s\t%s\n", st.Version, applied, name)
+		}
+		fmt.Printf("schema version of this build: %d, pending migrations: %d\n", storage.SchemaVersion, pending)
+		return nil
+	},
+}
+
+var dbMigrateCmd = &cli.Command{
+	Name:  "migrate",
+	Usage: "apply the pending migrations of the schema, the daemon applies them on start as well",
+	Action: func(cliCtx *cli.Context) error {
+		_, dataPath, cnf := loadRepo(cliCtx)
+		// the store is opened without migrating, to report the applied ones
+		store, err := storage.NewStore(cnf.DB, dataPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close() // nolint
+		opts, err := auth.MigrateOptions(cnf)
+		if err != nil {
+			return err
+		}
+		done, err := storage.Migrate(store, opts)
+		if err != nil {
+			return err
+		}
+		for _, st := range done {
+			fmt.Printf("applied migration %d: %s\n", st.Version, st.Name)
+		}
+		fmt.Printf("schema is at version %d\n", storage.SchemaVersion)
+		return nil
+	},
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/venus-auth/auth"
+	"github.com/urfave/cli/v2"
+)
+
+var keySubCommand = &cli.Command{
+	Name:  "key",
+	Usage: "signing key command",
+	Subcommands: []*cli.Command{
+		listKeysCmd,
+		rotateKeyCmd,
+		retireKeyCmd,
+	},
+}
+
+var listKeysCmd = &cli.Command{
+	Name:  "list",
+	Usage: "list signing keys",
+	Action: func(ctx *cli.Context) error {
+		client, err := GetCli(ctx)
+		if err != nil {
+			return err
+		}
+		keys, err := client.ListKeys()
+		if err != nil {
+			return err
+		}
+		fmt.Println("kid\t\t\talg\tcreateTime\t\tstate")
+		for _, k := range keys {
+			state := "valid"
+			if k.Active {
+				state = "active"
+			} else if k.Retired {
+				state = "retired"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", k.Kid, k.Alg, k.CreateTime.Format(timeLayout), state)
+		}
+		return nil
+	},
+}
+
+var rotateKeyCmd = &cli.Command{
+	Name:  "rotate",
+	Usage: "add a new key to sign new tokens, the tokens signed by the old keys are still accepted",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "alg",
+			Usage: "algorithm of the new key, must match the configured SignAlg (default: SignAlg)",
+		},
+		&cli.StringFlag{
+			Name:  "retire",
+			Usage: "kid of an old key to retire after the rotation, tokens signed by it are rejected",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		client, err := GetCli(ctx)
+		if err != nil {
+			return err
+		}
+		key, err := client.RotateKey(&auth.RotateKeyRequest{
+			Alg:    ctx.String("alg"),
+			Retire: ctx.String("retire"),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rotate key success, new key: %s\n", key.Kid)
+		return nil
+	},
+}
+
+var retireKeyCmd = &cli.Command{
+	Name:      "retire",
+	Usage:     "retire a key, tokens signed by it are rejected",
+	ArgsUsage: "[kid]",
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return errors.New("usage: retire [kid]")
+		}
+		client, err := GetCli(ctx)
+		if err != nil {
+			return err
+		}
+		kid := ctx.Args().First()
+		if err = client.RetireKey(kid); err != nil {
+			return err
+		}
+		fmt.Printf("retire key success: %s\n", kid)
+		return nil
+	},
+}
@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/config"
+	"github.com/filecoin-project/venus-auth/log"
+)
+
+// listen opens the tcp port and the unix socket of the config, at least one of them is required
+func listen(cnf *config.Config) ([]net.Listener, error) {
+	var listeners []net.Listener
+	if len(cnf.Port) > 0 {
+		l, err := net.Listen("tcp", ":"+cnf.Port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if cnf.Socket.Enabled() {
+		l, err := listenUnix(cnf.Socket)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, xerrors.Errorf("listen on socket %s: %w", cnf.Socket.Path, err)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, xerrors.New("neither port nor socket.path is configured")
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on the socket, a socket file left by a stopped daemon is replaced.
+// The socket file is created with mode 0600, then given the configured mode and owner.
+// The socket file is removed when the listener is closed.
+func listenUnix(cnf *config.SocketConfig) (net.Listener, error) {
+	if conn, err := net.Dial("unix", cnf.Path); err == nil {
+		_ = conn.Close()
+		return nil, xerrors.New("the socket is in use")
+	}
+	if err := os.Remove(cnf.Path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := listenSocket(cnf.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = chmodSocket(cnf); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func chmodSocket(cnf *config.SocketConfig) error {
+	if len(cnf.Mode) > 0 {
+		mode, err := strconv.ParseUint(cnf.Mode, 8, 32)
+		if err != nil {
+			return xerrors.Errorf("parse mode %s: %w", cnf.Mode, err)
+		}
+		if err = os.Chmod(cnf.Path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	if len(cnf.Owner) == 0 && len(cnf.Group) == 0 {
+		return nil
+	}
+	uid, gid := -1, -1
+	var err error
+	if len(cnf.Owner) > 0 {
+		if uid, err = lookupID(cnf.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return xerrors.Errorf("owner %s: %w", cnf.Owner, err)
+		}
+	}
+	if len(cnf.Group) > 0 {
+		if gid, err = lookupID(cnf.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return xerrors.Errorf("group %s: %w", cnf.Group, err)
+		}
+	}
+	return os.Chown(cnf.Path, uid, gid)
+}
+
+// lookupID takes a numeric id as it is, and looks up a name
+func lookupID(s string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// serve serves on the listener until the server is closed, the tcp port is served over TLS when it's configured
+func serve(server *http.Server, l net.Listener) error {
+	if _, unix := l.(*net.UnixListener); unix || server.TLSConfig == nil {
+		log.Infof("server start and listen on %s", l.Addr())
+		return server.Serve(l)
+	}
+	log.Infof("server start and listen on %s over tls, client certificates: %s", l.Addr(), server.TLSConfig.ClientAuth)
+	return server.ServeTLS(l, "", "")
+}
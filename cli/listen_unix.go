@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package cli
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenSocket creates the socket file without any permission for the group and others,
+// it's not reachable by them until chmodSocket applies the configured mode.
+// The umask is of the process, the socket is created at start before the other files.
+func listenSocket(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
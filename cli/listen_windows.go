@@ -0,0 +1,8 @@
+package cli
+
+import "net"
+
+// listenSocket creates the socket file, its permission is left to the directory on windows
+func listenSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/config"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+var migrateCmd = &cli.Command{
+	Name:  "migrate",
+	Usage: "copy the tokens, users, rate limits and signing keys from a db to another, the daemon must be stopped for badger",
+	Description: "A db is given as <type>:<location>, the location is the data dir of badger, the file of sqlite, or the DSN of mysql and postgres, e.g.\n" +
+		"  venus-auth migrate --from badger:~/.venus-auth/data --to 'mysql:user:password@(127.0.0.1:3306)/auth_server?parseTime=true&loc=Local'\n" +
+		"The records missing in the destination are copied, the existing ones are never changed, so it can be run again.\n" +
+		"The secrets are copied as they are stored, configure the same key-encryption key for the destination.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "from",
+			Usage:    "db to read, <type>:<location>",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "to",
+			Usage:    "db to write, <type>:<location>",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only count the records to copy",
+		},
+	},
+	Action: func(cliCtx *cli.Context) error {
+		src, err := openStoreSpec(cliCtx.String("from"))
+		if err != nil {
+			return xerrors.Errorf("open source: %w", err)
+		}
+		defer src.Close() // nolint
+		dst, err := openStoreSpec(cliCtx.String("to"))
+		if err != nil {
+			return xerrors.Errorf("open destination: %w", err)
+		}
+		defer dst.Close() // nolint
+		dryRun := cliCtx.Bool("dry-run")
+		sum, err := storage.Copy(src, dst, dryRun)
+		if err != nil {
+			return err
+		}
+		copied := "copied"
+		if dryRun {
+			copied = "to copy"
+		}
+		for _, c := range []struct {
+			name            string
+			copied, existed int
+		}{
+			{"tokens", sum.Copied.Tokens, sum.Existing.Tokens},
+			{"users", sum.Copied.Users, sum.Existing.Users},
+			{"miners", sum.Copied.Miners, sum.Existing.Miners},
+			{"rate limits", sum.Copied.RateLimits, sum.Existing.RateLimits},
+			{"signing keys", sum.Copied.SigningKeys, sum.Existing.SigningKeys},
+		} {
+			fmt.Printf("%s: %d %s, %d existing\n", c.name, c.copied, copied, c.existed)
+		}
+		fmt.Printf("conflicts: %d\n", len(sum.Conflicts))
+		for _, c := range sum.Conflicts {
+			fmt.Printf("\t%s\n", c)
+		}
+		return nil
+	},
+}
+
+// openStoreSpec opens the db given as <type>:<location>
+func openStoreSpec(spec string) (storage.Store, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil, xerrors.Errorf("%q is not <type>:<location>", spec)
+	}
+	cnf := &config.DBConfig{Type: strings.ToLower(parts[0])}
+	var dataPath string
+	var err error
+	switch cnf.Type {
+	case config.Badger:
+		dataPath, err = homedir.Expand(parts[1])
+	case config.SQLite:
+		cnf.DSN, err = homedir.Expand(parts[1])
+	default:
+		cnf.DSN = parts[1]
+	}
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.NewStore(cnf, dataPath)
+	if err != nil {
+		return nil, err
+	}
+	// the legacy tokens signed by the master secret fail the migration, run db migrate with the config of their daemon first
+	if _, err = storage.Migrate(store, nil); err != nil {
+		_ = store.Close()
+		return nil, xerrors.Errorf("migrate: %w", err)
+	}
+	return store, nil
+}
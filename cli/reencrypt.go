@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/auth"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+var reEncryptCmd = &cli.Command{
+	Name:  "reencrypt",
+	Usage: "encrypt the token secrets and signing keys with the configured key-encryption key, the daemon must be stopped for badger",
+	Description: "The key-encryption key is read from the VENUS_AUTH_KEK env var, or encryption.keyFile, or encryption.key of the config.\n" +
+		"To rotate it, configure the new key and pass the old one with --old-key or --old-key-file.\n" +
+		"Plain values written before encryption was enabled are encrypted as well.",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "old-key",
+			Usage: "hex encoded old key-encryption key",
+		},
+		&cli.StringSliceFlag{
+			Name:  "old-key-file",
+			Usage: "file holding a hex encoded old key-encryption key",
+		},
+	},
+	Action: func(cliCtx *cli.Context) error {
+		_, dataPath, cnf := loadRepo(cliCtx)
+		olds := cliCtx.StringSlice("old-key")
+		for _, file := range cliCtx.StringSlice("old-key-file") {
+			buf, err := ioutil.ReadFile(file)
+			if err != nil {
+				return xerrors.Errorf("read old key file: %w", err)
+			}
+			olds = append(olds, string(buf))
+		}
+
+		store, err := auth.OpenStore(dataPath, cnf)
+		if err != nil {
+			return err
+		}
+		defer store.Close() // nolint
+		if store, err = storage.WithEncryption(store, cnf.Encryption, olds...); err != nil {
+			return err
+		}
+		tokens, keys, err := storage.ReEncrypt(store)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("re-encrypt success: %d token secrets, %d signing keys\n", tokens, keys)
+		return nil
+	},
+}
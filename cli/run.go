@@ -1,16 +1,34 @@
 package cli
 
 import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"strings"
+
 	"github.com/filecoin-project/venus-auth/auth"
 	"github.com/filecoin-project/venus-auth/config"
+	"github.com/filecoin-project/venus-auth/core"
 	"github.com/filecoin-project/venus-auth/log"
 	"github.com/gin-gonic/gin"
 	"github.com/ipfs-force-community/metrics"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli/v2"
 	"go.opencensus.io/plugin/ochttp"
+	"golang.org/x/xerrors"
+	"net"
 	"net/http"
+	"os/signal"
 	"path"
+	"syscall"
+	"time"
+)
+
+const (
+	// AdminTokenFile is the file in the repo holding the bootstrap admin token
+	AdminTokenFile = "token"
+	AdminTokenName = "venus-auth-admin"
 )
 
 var runCmd = &cli.Command{
@@ -56,11 +74,10 @@ func configScan(path string) *config.Config {
 	return cnf
 }
 
-func run(cliCtx *cli.Context) error {
-	gin.SetMode(gin.ReleaseMode)
+// loadRepo prepares the repo dirs, and loads the config or writes the default one
+func loadRepo(cliCtx *cli.Context) (repo, dataPath string, cnf *config.Config) {
 	cnfPath := cliCtx.String("config")
-	repo := cliCtx.String("repo")
-	repo, err := homedir.Expand(repo)
+	repo, err := homedir.Expand(cliCtx.String("repo"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -68,15 +85,64 @@ func run(cliCtx *cli.Context) error {
 		cnfPath = path.Join(repo, "config.toml")
 	}
 	MakeDir(repo)
-	dataPath := path.Join(repo, "data")
+	dataPath = path.Join(repo, "data")
 	MakeDir(dataPath)
-	cnf := configScan(cnfPath)
+	return repo, dataPath, configScan(cnfPath)
+}
+
+// ensureAdminToken makes sure the repo holds a valid admin token,
+// the local cli presents it to the daemon for the management API
+func ensureAdminToken(ctx context.Context, srv auth.OAuthService, tokenPath string) error {
+	data, err := ioutil.ReadFile(tokenPath)
+	if err == nil {
+		res, err := srv.Verify(ctx, strings.TrimSpace(string(data)))
+		if err == nil && res.Perm == core.PermAdmin {
+			return nil
+		}
+		log.Warnf("admin token in %s is invalid, regenerate it", tokenPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	pl := &auth.JWTPayload{Name: AdminTokenName, Perm: core.PermAdmin}
+	tk, err := srv.GenerateToken(ctx, pl)
+	if xerrors.Is(err, auth.ErrorUserNotFound) {
+		// tokens are only issued to existing users, see config.Config.RequireUser
+		_, err = srv.CreateUser(ctx, &auth.CreateUserRequest{
+			Name:    AdminTokenName,
+			Comment: "owner of the admin token of the local cli",
+			State:   core.UserStateEnabled,
+		})
+		if err != nil {
+			return xerrors.Errorf("create admin user: %w", err)
+		}
+		tk, err = srv.GenerateToken(ctx, pl)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("admin token is written to %s", tokenPath)
+	return ioutil.WriteFile(tokenPath, []byte(tk), 0600)
+}
+
+func run(cliCtx *cli.Context) error {
+	gin.SetMode(gin.ReleaseMode)
+	repo, dataPath, cnf := loadRepo(cliCtx)
 	log.InitLog(cnf.Log)
-	app, err := auth.NewOAuthApp(cnf.Secret, dataPath, cnf.DB)
+	var tlsCnf *tls.Config
+	if cnf.TLS.Enabled() {
+		var err error
+		if tlsCnf, err = cnf.TLS.ServerConfig(); err != nil {
+			log.Fatalf("Failed to load tls config: %s", err)
+		}
+	}
+	srv, err := auth.NewOAuthService(dataPath, cnf)
 	if err != nil {
 		log.Fatalf("Failed to init venus-auth: %s", err)
 	}
-	router := auth.InitRouter(app)
+	if err = ensureAdminToken(cliCtx.Context, srv, path.Join(repo, AdminTokenFile)); err != nil {
+		log.Fatalf("Failed to prepare admin token: %s", err)
+	}
+	router := auth.InitRouter(auth.NewOAuthApp(srv))
 
 	if cnf.Trace != nil && cnf.Trace.JaegerTracingEnabled {
 		log.Infof("register jaeger-tracing exporter to %s, with node-name:%s",
@@ -91,13 +157,51 @@ func run(cliCtx *cli.Context) error {
 		}
 	}
 
+	listeners, err := listen(cnf)
+	if err != nil {
+		_ = srv.Close()
+		return err
+	}
 	server := &http.Server{
-		Addr:         ":" + cnf.Port,
 		Handler:      router,
 		ReadTimeout:  cnf.ReadTimeout,
 		WriteTimeout: cnf.WriteTimeout,
 		IdleTimeout:  cnf.IdleTimeout,
+		TLSConfig:    tlsCnf,
+	}
+	ctx, stop := signal.NotifyContext(cliCtx.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			served <- serve(server, l)
+		}(l)
+	}
+	select {
+	case err = <-served:
+		// the other listeners are closed as well
+		_ = server.Close()
+	case <-ctx.Done():
+		err = shutdown(server, cnf.ShutdownTimeout)
+	}
+	if cerr := srv.Close(); cerr != nil {
+		log.Errorf("close db: %s", cerr)
+	}
+	log.Close()
+	return err
+}
+
+// shutdown stops accepting connections, and waits for the requests in flight until the timeout
+func shutdown(server *http.Server, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = config.DefaultShutdownTimeout
+	}
+	log.Infof("shutting down, wait %s for the requests in flight", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warnf("requests in flight are cut off: %s", err)
+		return server.Close()
 	}
-	log.Infof("server start and listen on %s", cnf.Port)
-	return server.ListenAndServe()
+	return nil
 }
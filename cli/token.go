@@ -3,10 +3,16 @@ package cli
 import (
 	"errors"
 	"fmt"
+	"time"
+
+	"github.com/filecoin-project/venus-auth/auth"
 	"github.com/filecoin-project/venus-auth/core"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
 )
 
+const timeLayout = "2006-01-02 15:04:05"
+
 var tokenSubCommand = &cli.Command{
 	Name:  "token",
 	Usage: "token command",
@@ -32,6 +38,18 @@ var genTokenCmd = &cli.Command{
 			Usage: "custom string in JWT payload",
 			Value: "",
 		},
+		&cli.DurationFlag{
+			Name:  "ttl",
+			Usage: "time to live of the token, e.g. 720h (default: never expires)",
+		},
+		&cli.StringFlag{
+			Name:  "expire-at",
+			Usage: "absolute expiration time in local time, e.g. \"2022-01-02 15:04:05\", conflicts with --ttl",
+		},
+		&cli.StringFlag{
+			Name:  "not-before",
+			Usage: "the token is rejected before this local time, e.g. \"2022-01-02 15:04:05\"",
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		client, err := GetCli(ctx)
@@ -47,8 +65,27 @@ var genTokenCmd = &cli.Command{
 			return err
 		}
 
-		extra := ctx.String("extra")
-		tk, err := client.GenerateToken(name, perm, extra)
+		req := &auth.GenTokenRequest{
+			Name:  name,
+			Perm:  perm,
+			Extra: ctx.String("extra"),
+			TTL:   ctx.Duration("ttl"),
+		}
+		if ctx.IsSet("expire-at") {
+			t, err := time.ParseInLocation(timeLayout, ctx.String("expire-at"), time.Local)
+			if err != nil {
+				return xerrors.Errorf("parse expire-at: %w", err)
+			}
+			req.ExpireAt = t.Unix()
+		}
+		if ctx.IsSet("not-before") {
+			t, err := time.ParseInLocation(timeLayout, ctx.String("not-before"), time.Local)
+			if err != nil {
+				return xerrors.Errorf("parse not-before: %w", err)
+			}
+			req.NotBefore = t.Unix()
+		}
+		tk, err := client.GenerateTokenReq(req)
 		if err != nil {
 			return err
 		}
@@ -70,6 +107,10 @@ var listTokensCmd = &cli.Command{
 			Value: 20,
 			Usage: "max value:100 (default: 20)",
 		},
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "only list the tokens issued to the user",
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		client, err := GetCli(ctx)
@@ -78,20 +119,24 @@ var listTokensCmd = &cli.Command{
 		}
 		skip := int64(ctx.Uint("skip"))
 		limit := int64(ctx.Uint("limit"))
-		tks, err := client.Tokens(skip, limit)
+		tks, err := client.UserTokens(ctx.String("user"), skip, limit)
 		if err != nil {
 			return err
 		}
 		//	Token     string    `json:"token"`
 		//	Name      string    `json:"name"`
 		//	CreatTime time.Time `json:"createTime"`
-		fmt.Println("num\tname\t\tperm\t\tcreateTime\t\ttoken")
+		fmt.Println("num\tname\t\tperm\t\tcreateTime\t\texpireTime\t\tprefix\t\thash")
 		for k, v := range tks {
 			name := v.Name
 			if len(name) < 8 {
 				name = name + "\t"
 			}
-			fmt.Printf("%d\t%s\t%s\t%s\t%s\n", k+1, name, v.Perm, v.CreateTime.Format("2006-01-02 15:04:05"), v.Token)
+			expire := "never\t\t"
+			if v.ExpireAt > 0 {
+				expire = time.Unix(v.ExpireAt, 0).Format(timeLayout)
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\t%s\n", k+1, name, v.Perm, v.CreateTime.Format(timeLayout), expire, v.Prefix, v.Hash)
 		}
 		return nil
 	},
@@ -100,10 +145,10 @@ var listTokensCmd = &cli.Command{
 var removeTokenCmd = &cli.Command{
 	Name:      "rm",
 	Usage:     "remove token",
-	ArgsUsage: "[token]",
+	ArgsUsage: "[token|hash]",
 	Action: func(ctx *cli.Context) error {
 		if ctx.NArg() < 1 {
-			return errors.New("usage: rmToken [token]")
+			return errors.New("usage: rmToken [token|hash]")
 		}
 		client, err := GetCli(ctx)
 		if err != nil {
@@ -18,6 +18,9 @@ var userSubCommand = &cli.Command{
 	Subcommands: []*cli.Command{
 		addUserCmd,
 		updateUserCmd,
+		removeUserCmd,
+		addMinerCmd,
+		removeMinerCmd,
 		listUsersCmd,
 		activeUserCmd,
 		getUserCmd,
@@ -134,6 +137,91 @@ var updateUserCmd = &cli.Command{
 	},
 }
 
+var removeUserCmd = &cli.Command{
+	Name:      "rm",
+	Usage:     "remove user, by default it's disabled and kept as a tombstone",
+	ArgsUsage: "name",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "hard",
+			Usage: "remove the user and its rate limits from the db",
+		},
+		&cli.BoolFlag{
+			Name:  "revoke-tokens",
+			Usage: "remove every token issued under the name",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		client, err := GetCli(ctx)
+		if err != nil {
+			return err
+		}
+		if ctx.NArg() != 1 {
+			return xerrors.New("expect name")
+		}
+		res, err := client.DeleteUser(&auth.DeleteUserRequest{
+			Name:         ctx.Args().Get(0),
+			Hard:         ctx.Bool("hard"),
+			RevokeTokens: ctx.Bool("revoke-tokens"),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("remove user success: %s, %d tokens revoked\n", res.Name, res.RevokedTokens)
+		return nil
+	},
+}
+
+var addMinerCmd = &cli.Command{
+	Name:      "add-miner",
+	Usage:     "add a miner to the user, a miner belongs to one user",
+	ArgsUsage: "<name> <miner>",
+	Action: func(ctx *cli.Context) error {
+		client, err := GetCli(ctx)
+		if err != nil {
+			return err
+		}
+		if ctx.NArg() != 2 {
+			return xerrors.New("expect name and miner")
+		}
+		mAddr, err := address.NewFromString(ctx.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		err = client.AddMiner(&auth.UserMinerRequest{Name: ctx.Args().Get(0), Miner: mAddr.String()})
+		if err != nil {
+			return err
+		}
+		fmt.Println("add miner success")
+		return nil
+	},
+}
+
+var removeMinerCmd = &cli.Command{
+	Name:      "remove-miner",
+	Usage:     "remove a miner from the user",
+	ArgsUsage: "<name> <miner>",
+	Action: func(ctx *cli.Context) error {
+		client, err := GetCli(ctx)
+		if err != nil {
+			return err
+		}
+		if ctx.NArg() != 2 {
+			return xerrors.New("expect name and miner")
+		}
+		mAddr, err := address.NewFromString(ctx.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		err = client.RemoveMiner(&auth.UserMinerRequest{Name: ctx.Args().Get(0), Miner: mAddr.String()})
+		if err != nil {
+			return err
+		}
+		fmt.Println("remove miner success")
+		return nil
+	},
+}
+
 var activeUserCmd = &cli.Command{
 	Name:      "active",
 	Usage:     "update user",
@@ -213,7 +301,7 @@ var listUsersCmd = &cli.Command{
 		for k, v := range users {
 			fmt.Println("number:", k+1)
 			fmt.Println("name:", v.Name)
-			fmt.Println("miner:", v.Miner)
+			fmt.Println("miners:", v.Miners)
 			fmt.Println("sourceType:", v.SourceType, "\t// miner:1")
 			fmt.Println("state", v.State, "\t// 0: disable, 1: enable")
 			fmt.Println("comment:", v.Comment)
@@ -244,7 +332,7 @@ var getUserCmd = &cli.Command{
 		}
 
 		fmt.Println("name:", user.Name)
-		fmt.Println("miner:", user.Miner)
+		fmt.Println("miners:", user.Miners)
 		fmt.Println("sourceType:", user.SourceType, "\t// miner:1")
 		fmt.Println("state", user.State, "\t// 0: disable, 1: enable")
 		fmt.Println("comment:", user.Comment)
@@ -317,8 +405,8 @@ var rateLimitGet = &cli.Command{
 			fmt.Printf("user have no request rate limit\n")
 		} else {
 			for _, l := range limits {
-				fmt.Printf("user:%s, limit id:%s, request limit amount:%d, duration:%.2f(h)\n",
-					l.Name, l.Id, l.ReqLimit.Cap, l.ReqLimit.ResetDur.Hours())
+				fmt.Printf("user:%s, limit id:%s, service:%s, api:%s, request limit amount:%d, duration:%.2f(h)\n",
+					l.Name, l.Id, orAny(l.Service), orAny(l.API), l.ReqLimit.Cap, l.ReqLimit.ResetDur.Hours())
 			}
 		}
 		return nil
@@ -328,8 +416,12 @@ var rateLimitGet = &cli.Command{
 var rateLimitAdd = &cli.Command{
 	Name:  "add",
 	Usage: "add user request rate limit",
+	Description: "The limit applies to the calls of the api of the service, both are any when not set, and can be glob patterns such as MpoolPush*.\n" +
+		"A call is limited by the most specific limit: the one of both service and api, then api only, then service only, then the global one.",
 	Flags: []cli.Flag{
-		&cli.StringFlag{Name: "id", Usage: "rate limit id to update"},
+		&cli.StringFlag{Name: "id", Usage: "id of the new rate limit (default: generated)"},
+		&cli.StringFlag{Name: "service", Usage: "service name or pattern the limit applies to, e.g. venus (default: any)"},
+		&cli.StringFlag{Name: "api", Usage: "api name or pattern the limit applies to, e.g. MpoolPush* (default: any)"},
 	},
 	ArgsUsage: "user rate-limit add <name> <limitAmount> <duration(2h, 1h:20m, 2m10s)>",
 	Action: func(ctx *cli.Context) error {
@@ -343,10 +435,7 @@ var rateLimitAdd = &cli.Command{
 		}
 
 		name := ctx.Args().Get(0)
-
-		if res, _ := client.GetUserRateLimit(name, ""); len(res) > 0 {
-			return fmt.Errorf("user rate limit:%s exists", res[0].Id)
-		}
+		service, api := ctx.String("service"), ctx.String("api")
 
 		var limitAmount uint64
 		var resetDuration time.Duration
@@ -360,29 +449,31 @@ var rateLimitAdd = &cli.Command{
 			return fmt.Errorf("reset duratoin must be positive")
 		}
 
-		userLimit := &auth.UpsertUserRateLimitReq{
+		userLimit := &auth.AddUserRateLimitReq{
+			Id:       ctx.String("id"),
 			Name:     name,
+			Service:  service,
+			API:      api,
 			ReqLimit: storage.ReqLimit{Cap: int64(limitAmount), ResetDur: resetDuration},
 		}
 
-		if ctx.IsSet("id") {
-			userLimit.Id = ctx.String("id")
-		}
-
-		if userLimit.Id, err = client.UpsertUserRateLimit(userLimit); err != nil {
+		if userLimit.Id, err = client.AddUserRateLimit(userLimit); err != nil {
 			return err
 		}
 
-		fmt.Printf("upsert user rate limit success:\t%s\n", userLimit.Id)
+		fmt.Printf("add user rate limit success:\t%s\n", userLimit.Id)
 
 		return nil
 	},
 }
 
 var rateLimitUpdate = &cli.Command{
-	Name:      "update",
-	Usage:     "update user request rate limit",
-	Flags:     []cli.Flag{},
+	Name:  "update",
+	Usage: "update user request rate limit",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "service", Usage: "service name or pattern the limit applies to, empty for any (default: unchanged)"},
+		&cli.StringFlag{Name: "api", Usage: "api name or pattern the limit applies to, empty for any (default: unchanged)"},
+	},
 	ArgsUsage: "<name> <rate-limit-id> <limitAmount> <duration(2h, 1h:20m, 2m10s)>",
 	Action: func(ctx *cli.Context) error {
 		client, err := GetCli(ctx)
@@ -397,7 +488,8 @@ var rateLimitUpdate = &cli.Command{
 		name := ctx.Args().Get(0)
 		id := ctx.Args().Get(1)
 
-		if res, err := client.GetUserRateLimit(name, id); err != nil {
+		res, err := client.GetUserRateLimit(name, id)
+		if err != nil {
 			return err
 		} else if len(res) == 0 {
 			return fmt.Errorf("user rate limit:%s NOT exists", id)
@@ -415,16 +507,22 @@ var rateLimitUpdate = &cli.Command{
 			return fmt.Errorf("reset duratoin must be positive")
 		}
 
-		userLimit := &auth.UpsertUserRateLimitReq{
-			Id: id, Name: name,
+		userLimit := &auth.UpdateUserRateLimitReq{
+			Id: id, Name: name, Service: res[0].Service, API: res[0].API,
 			ReqLimit: storage.ReqLimit{Cap: int64(limitAmount), ResetDur: resetDuration},
 		}
+		if ctx.IsSet("service") {
+			userLimit.Service = ctx.String("service")
+		}
+		if ctx.IsSet("api") {
+			userLimit.API = ctx.String("api")
+		}
 
-		if userLimit.Id, err = client.UpsertUserRateLimit(userLimit); err != nil {
+		if err = client.UpdateUserRateLimit(userLimit); err != nil {
 			return err
 		}
 
-		fmt.Printf("upsert user rate limit success:\t%s\n", userLimit.Id)
+		fmt.Printf("update user rate limit success:\t%s\n", userLimit.Id)
 
 		return nil
 	},
@@ -464,3 +562,10 @@ var rateLimitDel = &cli.Command{
 		return nil
 	},
 }
+
+func orAny(pattern string) string {
+	if len(pattern) == 0 {
+		return "*"
+	}
+	return pattern
+}
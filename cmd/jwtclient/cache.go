@@ -0,0 +1,315 @@
+package jwtclient
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/gbrlsnchs/jwt/v3"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"golang.org/x/xerrors"
+
+	auth2 "github.com/filecoin-project/venus-auth/auth"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+// CacheConfig of the verify results cached by NewCachedAuthClient
+type CacheConfig struct {
+	// MaxSize is the max number of cached tokens, the least recently used one is evicted first
+	MaxSize int
+	// TTL of a token passing the verification, it's capped by the expiration of the token
+	TTL time.Duration
+	// NegativeTTL of a rejected token, zero disables caching rejections
+	NegativeTTL time.Duration
+	// PollInterval of the revocations reported by venus-auth, zero disables polling,
+	// a revoked token is accepted until its cached result expires then.
+	// Nothing is cached before the first poll, nor while the polls fail for feedLostPolls intervals.
+	PollInterval time.Duration
+}
+
+func DefaultCacheConfig() *CacheConfig {
+	return &CacheConfig{
+		MaxSize:      10000,
+		TTL:          time.Minute,
+		NegativeTTL:  10 * time.Second,
+		PollInterval: 5 * time.Second,
+	}
+}
+
+var (
+	cacheResultKey = tag.MustNewKey("result")
+	cacheReasonKey = tag.MustNewKey("reason")
+
+	CacheRequests  = stats.Int64("jwtclient/verify_cache_requests", "verify requests by cache result: hit, negative_hit, miss, bypass", stats.UnitDimensionless)
+	CacheEvictions = stats.Int64("jwtclient/verify_cache_evictions", "cached verify results evicted by reason: size, revoked, reset", stats.UnitDimensionless)
+	CacheSize      = stats.Int64("jwtclient/verify_cache_size", "number of cached verify results", stats.UnitDimensionless)
+
+	// CacheViews are registered by the service exporting the metrics
+	CacheViews = []*view.View{
+		{Measure: CacheRequests, Aggregation: view.Count(), TagKeys: []tag.Key{cacheResultKey}},
+		{Measure: CacheEvictions, Aggregation: view.Sum(), TagKeys: []tag.Key{cacheReasonKey}},
+		{Measure: CacheSize, Aggregation: view.LastValue()},
+	}
+)
+
+type cacheEntry struct {
+	hash   string
+	name   string
+	kid    string
+	perms  []auth.Permission
+	err    error
+	expire time.Time
+}
+
+// cachedAuthClient caches the verify results of another client, to save a request to venus-auth
+// for every request it serves. The revocations are polled from venus-auth to evict the tokens at once.
+type cachedAuthClient struct {
+	next   IJwtAuthClient
+	feed   *revocationFeed
+	cnf    CacheConfig
+	logger Logger
+
+	lk      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// gen changes on every eviction by revocation, a result verified across it is not cached
+	gen uint64
+	// polled is the time of the last poll of the revocations
+	polled time.Time
+}
+
+// feedLostPolls is the number of poll intervals without a poll after which the revocations may be missed,
+// the cache is bypassed until the next poll, which evicts the tokens revoked meanwhile.
+const feedLostPolls = 3
+
+var _ IJwtAuthClient = &cachedAuthClient{}
+
+// NewCachedAuthClient returns a verifier caching the results of next, the revocations are polled
+// from feed until ctx is done, feed must hold an admin token, see JWTClient.SetToken. feed and logger are optional.
+func NewCachedAuthClient(ctx context.Context, next IJwtAuthClient, feed *JWTClient, cnf *CacheConfig, logger Logger) IJwtAuthClient {
+	c := &cachedAuthClient{
+		next:    next,
+		cnf:     *cnf,
+		logger:  logger,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	if feed != nil && cnf.PollInterval > 0 {
+		c.feed = &revocationFeed{cli: feed}
+		go c.feed.pollLoop(ctx, cnf.PollInterval, logger, c.apply)
+	}
+	return c
+}
+
+func (c *cachedAuthClient) Verify(ctx context.Context, token string) ([]auth.Permission, error) {
+	hash := storage.Token(token).Hash().String()
+	now := time.Now()
+	c.lk.Lock()
+	if c.stale(now) {
+		c.lk.Unlock()
+		record(ctx, CacheRequests, cacheResultKey, "bypass", 1)
+		return c.next.Verify(ctx, token)
+	}
+	if elem, ok := c.entries[hash]; ok {
+		ent := elem.Value.(*cacheEntry)
+		if now.Before(ent.expire) {
+			c.lru.MoveToFront(elem)
+			c.lk.Unlock()
+			if ent.err != nil {
+				record(ctx, CacheRequests, cacheResultKey, "negative_hit", 1)
+				return nil, ent.err
+			}
+			record(ctx, CacheRequests, cacheResultKey, "hit", 1)
+			return append([]auth.Permission(nil), ent.perms...), nil
+		}
+		c.remove(elem)
+	}
+	gen := c.gen
+	c.lk.Unlock()
+	record(ctx, CacheRequests, cacheResultKey, "miss", 1)
+
+	perms, err := c.next.Verify(ctx, token)
+	if err != nil && !isRejected(err) {
+		return nil, err
+	}
+	ent := &cacheEntry{hash: hash, perms: perms, err: err}
+	if err != nil {
+		ent.expire = now.Add(c.cnf.NegativeTTL)
+	} else {
+		ent.expire = now.Add(c.cnf.TTL)
+		if hd, pl, err := tokenClaims(token); err == nil {
+			ent.name, ent.kid = pl.Name, hd.KeyID
+			if pl.ExpireAt > 0 && time.Unix(pl.ExpireAt, 0).Before(ent.expire) {
+				ent.expire = time.Unix(pl.ExpireAt, 0)
+			}
+		}
+	}
+	if ent.expire.After(now) {
+		c.add(ctx, ent, gen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]auth.Permission(nil), perms...), nil
+}
+
+func (c *cachedAuthClient) add(ctx context.Context, ent *cacheEntry, gen uint64) {
+	c.lk.Lock()
+	if (ent.err == nil && gen != c.gen) || c.stale(time.Now()) {
+		// the token may be revoked after it's verified
+		c.lk.Unlock()
+		return
+	}
+	if elem, ok := c.entries[ent.hash]; ok {
+		c.remove(elem)
+	}
+	c.entries[ent.hash] = c.lru.PushFront(ent)
+	evicted := 0
+	for c.cnf.MaxSize > 0 && c.lru.Len() > c.cnf.MaxSize {
+		c.remove(c.lru.Back())
+		evicted++
+	}
+	size := c.lru.Len()
+	c.lk.Unlock()
+	if evicted > 0 {
+		record(ctx, CacheEvictions, cacheReasonKey, "size", int64(evicted))
+	}
+	_ = stats.RecordWithTags(ctx, nil, CacheSize.M(int64(size)))
+}
+
+// stale must be called with the lock held, it tells whether the revocations may be missed
+func (c *cachedAuthClient) stale(now time.Time) bool {
+	return c.feed != nil && now.Sub(c.polled) > feedLostPolls*c.cnf.PollInterval
+}
+
+// remove must be called with the lock held
+func (c *cachedAuthClient) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).hash)
+}
+
+// apply evicts the revoked tokens, everything is evicted when the revocations are unknown
+func (c *cachedAuthClient) apply(ctx context.Context, res *auth2.RevocationsResponse) {
+	c.lk.Lock()
+	reason, evicted := "revoked", 0
+	if res.Reset {
+		reason, evicted = "reset", c.lru.Len()
+		c.lru.Init()
+		c.entries = make(map[string]*list.Element)
+	} else {
+		for _, ev := range res.Events {
+			evicted += c.evict(ev)
+		}
+	}
+	if res.Reset || len(res.Events) > 0 {
+		c.gen++
+	}
+	c.polled = time.Now()
+	size := c.lru.Len()
+	c.lk.Unlock()
+	if evicted > 0 {
+		record(ctx, CacheEvictions, cacheReasonKey, reason, int64(evicted))
+	}
+	_ = stats.RecordWithTags(ctx, nil, CacheSize.M(int64(size)))
+}
+
+// evict must be called with the lock held, the results of rejected tokens are kept
+func (c *cachedAuthClient) evict(ev *auth2.RevocationEvent) int {
+	if len(ev.Hash) > 0 {
+		if elem, ok := c.entries[ev.Hash]; ok {
+			c.remove(elem)
+			return 1
+		}
+		return 0
+	}
+	evicted := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		ent := elem.Value.(*cacheEntry)
+		if ent.err == nil && ((len(ev.User) > 0 && ent.name == ev.User) || (len(ev.Kid) > 0 && ent.kid == ev.Kid)) {
+			c.remove(elem)
+			evicted++
+		}
+		elem = next
+	}
+	return evicted
+}
+
+// revocationFeed follows the revocations reported by venus-auth
+type revocationFeed struct {
+	cli   *JWTClient
+	epoch string
+	seq   uint64
+}
+
+// next returns the revocations since the last call, Reset is set when they are unknown
+func (f *revocationFeed) next(ctx context.Context) (*auth2.RevocationsResponse, error) {
+	res, err := f.cli.Revocations(ctx, f.epoch, f.seq)
+	if err != nil {
+		return nil, err
+	}
+	f.epoch, f.seq = res.Epoch, res.Seq
+	return res, nil
+}
+
+// pollLoop passes the revocations to apply every interval until ctx is done
+func (f *revocationFeed) pollLoop(ctx context.Context, interval time.Duration, logger Logger,
+	apply func(context.Context, *auth2.RevocationsResponse)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := f.next(ctx)
+			if err != nil {
+				if logger != nil {
+					logger.Warnf("poll revocations: %s", err)
+				}
+				continue
+			}
+			apply(ctx, res)
+		}
+	}
+}
+
+// isRejected tells a token rejected by the verification from a failure of reaching venus-auth,
+// venus-auth answers 401 for an unknown token, and 503 when its db is unavailable.
+func isRejected(err error) bool {
+	var se *StatusError
+	if xerrors.As(err, &se) {
+		return se.Code >= http.StatusBadRequest && se.Code < http.StatusInternalServerError
+	}
+	return xerrors.Is(err, auth2.ErrorVerificationFailed) || xerrors.Is(err, auth2.ErrorTokenExpired) ||
+		xerrors.Is(err, auth2.ErrorTokenNotValidYet) || xerrors.Is(err, errUnknownKey) ||
+		xerrors.Is(err, auth2.ErrorNonRegisteredToken) || xerrors.Is(err, auth2.ErrorUserDisabled)
+}
+
+// tokenClaims decodes the token without verifying it
+func tokenClaims(token string) (*jwt.Header, *auth2.JWTPayload, error) {
+	hd, err := tokenHeader(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec, err := auth2.DecodeToBytes([]byte(strings.Split(token, ".")[1]))
+	if err != nil {
+		return nil, nil, err
+	}
+	pl := new(auth2.JWTPayload)
+	if err = json.Unmarshal(dec, pl); err != nil {
+		return nil, nil, err
+	}
+	return hd, pl, nil
+}
+
+func record(ctx context.Context, m *stats.Int64Measure, key tag.Key, val string, n int64) {
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(key, val)}, m.M(n))
+}
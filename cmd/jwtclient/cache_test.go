@@ -0,0 +1,127 @@
+package jwtclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/stretchr/testify/assert"
+
+	auth2 "github.com/filecoin-project/venus-auth/auth"
+	"github.com/filecoin-project/venus-auth/core"
+)
+
+type countingVerifier struct {
+	calls  map[string]int
+	reject map[string]error
+}
+
+func (v *countingVerifier) Verify(ctx context.Context, token string) ([]auth.Permission, error) {
+	v.calls[token]++
+	if err, ok := v.reject[token]; ok {
+		return nil, err
+	}
+	return []auth.Permission{core.PermRead}, nil
+}
+
+// mockToken is only decoded by the cache, the signature is not checked
+func mockToken(t *testing.T, kid string, pl *auth2.JWTPayload) string {
+	hd, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": kid})
+	assert.NoError(t, err)
+	body, err := json.Marshal(pl)
+	assert.NoError(t, err)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(hd) + "." + enc.EncodeToString(body) + ".sig"
+}
+
+func TestCachedAuthClient(t *testing.T) {
+	ctx := context.Background()
+	next := &countingVerifier{calls: map[string]int{}, reject: map[string]error{}}
+	cnf := &CacheConfig{MaxSize: 2, TTL: time.Minute, NegativeTTL: time.Minute}
+	c := NewCachedAuthClient(ctx, next, nil, cnf, nil).(*cachedAuthClient)
+
+	tk1 := mockToken(t, "k1", &auth2.JWTPayload{Name: "user1"})
+	tk2 := mockToken(t, "k2", &auth2.JWTPayload{Name: "user2"})
+	rejected := mockToken(t, "k1", &auth2.JWTPayload{Name: "user3"})
+	down := mockToken(t, "k1", &auth2.JWTPayload{Name: "user4"})
+	next.reject[rejected] = &StatusError{Code: 401, Msg: "Verification Failed"}
+	next.reject[down] = fmt.Errorf("connection refused")
+
+	for i := 0; i < 3; i++ {
+		perms, err := c.Verify(ctx, tk1)
+		assert.NoError(t, err)
+		assert.Equal(t, []auth.Permission{core.PermRead}, perms)
+		_, err = c.Verify(ctx, rejected)
+		assert.Error(t, err)
+		_, err = c.Verify(ctx, down)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, next.calls[tk1])
+	assert.Equal(t, 1, next.calls[rejected])
+	assert.Equal(t, 3, next.calls[down], "a failure of reaching venus-auth is not cached")
+
+	// the least recently used token is evicted
+	_, err := c.Verify(ctx, tk1)
+	assert.NoError(t, err)
+	_, err = c.Verify(ctx, tk2)
+	assert.NoError(t, err)
+	_, err = c.Verify(ctx, tk1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, next.calls[tk1])
+	_, err = c.Verify(ctx, rejected)
+	assert.Error(t, err)
+	assert.Equal(t, 2, next.calls[rejected])
+	assert.Equal(t, 2, c.lru.Len())
+
+	// revocations by user and by key
+	c.lk.Lock()
+	assert.Equal(t, 1, c.evict(&auth2.RevocationEvent{User: "user1"}))
+	assert.Equal(t, 0, c.evict(&auth2.RevocationEvent{Kid: "k2"}), "tk2 is evicted by size")
+	c.lk.Unlock()
+	_, err = c.Verify(ctx, tk1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, next.calls[tk1])
+
+	// the result doesn't outlive the token
+	exp := time.Now().Add(time.Second).Unix()
+	short := mockToken(t, "k1", &auth2.JWTPayload{Name: "user5", ExpireAt: exp})
+	_, err = c.Verify(ctx, short)
+	assert.NoError(t, err)
+	c.lk.Lock()
+	ent := c.entries[c.lru.Front().Value.(*cacheEntry).hash].Value.(*cacheEntry)
+	c.lk.Unlock()
+	assert.Equal(t, time.Unix(exp, 0), ent.expire)
+}
+
+func TestCachedAuthClientFeedLost(t *testing.T) {
+	ctx := context.Background()
+	next := &countingVerifier{calls: map[string]int{}, reject: map[string]error{}}
+	c := NewCachedAuthClient(ctx, next, nil, &CacheConfig{MaxSize: 10, TTL: time.Minute, PollInterval: time.Second}, nil).(*cachedAuthClient)
+	// polled by hand
+	c.feed = &revocationFeed{}
+	tk := mockToken(t, "k1", &auth2.JWTPayload{Name: "user1"})
+
+	for i := 0; i < 2; i++ {
+		_, err := c.Verify(ctx, tk)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, next.calls[tk], "nothing is cached before the first poll")
+
+	c.apply(ctx, &auth2.RevocationsResponse{Reset: true})
+	for i := 0; i < 2; i++ {
+		_, err := c.Verify(ctx, tk)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, next.calls[tk])
+
+	c.lk.Lock()
+	c.polled = time.Now().Add(-feedLostPolls * 2 * time.Second)
+	c.lk.Unlock()
+	_, err := c.Verify(ctx, tk)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, next.calls[tk], "the cache is bypassed once the polls fail")
+}
@@ -2,10 +2,13 @@ package jwtclient
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/filecoin-project/venus-auth/auth"
 	"github.com/filecoin-project/venus-auth/errcode"
+	"github.com/filecoin-project/venus-auth/util"
 	"github.com/go-resty/resty/v2"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/trace"
@@ -17,18 +20,59 @@ type JWTClient struct {
 	cli *resty.Client
 }
 
-func NewJWTClient(url string) *JWTClient {
+// Option configures the TLS connection of a JWTClient to an https url
+type Option func(cnf *tls.Config)
+
+// WithCA trusts the CAs of the pool for the certificate of venus-auth instead of those of the system,
+// the pool is read from a PEM file by util.LoadCertPool
+func WithCA(pool *x509.CertPool) Option {
+	return func(cnf *tls.Config) {
+		cnf.RootCAs = pool
+	}
+}
+
+// WithClientCert presents the certificate to venus-auth, which requires one when tls.requireClientCert is set,
+// the certificate is loaded by tls.LoadX509KeyPair
+func WithClientCert(cert tls.Certificate) Option {
+	return func(cnf *tls.Config) {
+		cnf.Certificates = append(cnf.Certificates, cert)
+	}
+}
+
+// NewJWTClient connects to venus-auth at url, which is http(s)://host:port,
+// or unix:///path/of/socket when venus-auth listens on a unix socket of the same host.
+func NewJWTClient(url string, opts ...Option) *JWTClient {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	if len(opts) > 0 {
+		tlsCnf := &tls.Config{MinVersion: tls.VersionTLS12}
+		for _, opt := range opts {
+			opt(tlsCnf)
+		}
+		base.TLSClientConfig = tlsCnf
+	}
+	if socket, ok := util.UnixSocket(url); ok {
+		util.DialUnix(base, socket)
+		url = util.UnixHostURL
+	}
+	transport := &ochttp.Transport{Base: base}
 	client := resty.New().
 		SetHostURL(url).
 		SetRetryCount(2).
 		SetHeader("Accept", "application/json").
-		SetTransport(&ochttp.Transport{})
+		SetTransport(transport)
 
 	return &JWTClient{
 		cli: client,
 	}
 }
 
+// SetToken presents the token in the Authorization header,
+// the queries of the users and their rate limits, and /ratelimit/take require an admin token
+func (c *JWTClient) SetToken(token string) *JWTClient {
+	c.cli.SetAuthToken(token)
+	return c
+}
+
 // Verify: post method for Verify token
 // @spanId: local service unique Id
 // @serviceName: e.g. venus
@@ -60,10 +104,79 @@ func (c *JWTClient) Verify(ctx context.Context, token string) (*auth.VerifyRespo
 			Code:    trace.StatusCodeUnauthenticated,
 			Message: string(response.Body()),
 		})
-		return nil, fmt.Errorf("response code is : %d, msg:%s", response.StatusCode(), response.Body())
+		return nil, newStatusError(response)
+	}
+}
+
+// StatusError is returned when venus-auth answers with an error status,
+// the token is rejected on a 4xx status. It matches the errcode sentinel of the code in the body by xerrors.Is.
+type StatusError struct {
+	Code int
+	Msg  string
+	err  error
+}
+
+func newStatusError(resp *resty.Response) *StatusError {
+	se := &StatusError{Code: resp.StatusCode(), Msg: string(resp.Body())}
+	var msg errcode.ErrMsg
+	if err := json.Unmarshal(resp.Body(), &msg); err == nil {
+		se.err = msg.Err()
+	}
+	return se
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("response code is : %d, msg:%s", e.Code, e.Msg)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.err
+}
+
+// Revocations: get method for the tokens revoked after seq, pass the epoch and seq of the last response
+func (c *JWTClient) Revocations(ctx context.Context, epoch string, seq uint64) (*auth.RevocationsResponse, error) {
+	resp, err := c.cli.R().SetContext(ctx).SetQueryParams(map[string]string{
+		"epoch": epoch,
+		"seq":   strconv.FormatUint(seq, 10),
+	}).SetResult(&auth.RevocationsResponse{}).SetError(&errcode.ErrMsg{}).Get("/revocations")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return resp.Result().(*auth.RevocationsResponse), nil
+	}
+	return nil, resp.Error().(*errcode.ErrMsg).Err()
+}
+
+// Introspect: post method for RFC 7662 token introspection,
+// an invalid token returns a response with Active false instead of an error
+func (c *JWTClient) Introspect(ctx context.Context, token string) (*auth.IntrospectResponse, error) {
+	resp, err := c.cli.R().SetContext(ctx).
+		SetFormData(map[string]string{"token": token}).
+		SetResult(&auth.IntrospectResponse{}).SetError(&errcode.ErrMsg{}).Post("/introspect")
+	if err != nil {
+		return nil, err
 	}
+	if resp.StatusCode() == http.StatusOK {
+		return resp.Result().(*auth.IntrospectResponse), nil
+	}
+	return nil, resp.Error().(*errcode.ErrMsg).Err()
+}
+
+// TakeRateLimit: post method for taking the cost of a call from the bucket of the user held by venus-auth
+func (c *JWTClient) TakeRateLimit(ctx context.Context, req *auth.TakeRateLimitRequest) (*auth.TakeRateLimitResponse, error) {
+	resp, err := c.cli.R().SetContext(ctx).SetBody(req).
+		SetResult(&auth.TakeRateLimitResponse{}).SetError(&errcode.ErrMsg{}).Post("/ratelimit/take")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return resp.Result().(*auth.TakeRateLimitResponse), nil
+	}
+	return nil, resp.Error().(*errcode.ErrMsg).Err()
 }
 
+// ListUsers requires an admin token, see SetToken
 func (c *JWTClient) ListUsers(req *auth.ListUsersRequest) (auth.ListUsersResponse, error) {
 	resp, err := c.cli.R().SetQueryParams(map[string]string{
 		"skip":       strconv.FormatInt(req.Skip, 10),
@@ -81,6 +194,7 @@ func (c *JWTClient) ListUsers(req *auth.ListUsersRequest) (auth.ListUsersRespons
 	return nil, resp.Error().(*errcode.ErrMsg).Err()
 }
 
+// GetUser requires an admin token, see SetToken
 func (c *JWTClient) GetUser(req *auth.GetUserRequest) (*auth.OutputUser, error) {
 	resp, err := c.cli.R().SetQueryParams(map[string]string{
 		"name": req.Name,
@@ -121,6 +235,7 @@ func (c *JWTClient) HasMiner(req *auth.HasMinerRequest) (bool, error) {
 	return false, resp.Error().(*errcode.ErrMsg).Err()
 }
 
+// GetUserRateLimit requires an admin token, see SetToken
 func (c *JWTClient) GetUserRateLimit(name string) (auth.GetUserRateLimitResponse, error) {
 	var res auth.GetUserRateLimitResponse
 	resp, err := c.cli.R().SetQueryParams(map[string]string{
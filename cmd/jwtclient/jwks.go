@@ -0,0 +1,141 @@
+package jwtclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/gbrlsnchs/jwt/v3"
+	"golang.org/x/xerrors"
+
+	auth2 "github.com/filecoin-project/venus-auth/auth"
+	"github.com/filecoin-project/venus-auth/errcode"
+)
+
+var errUnknownKey = xerrors.New("token is not signed by a known server key")
+
+// JWKS fetches the public keys the server signs tokens with
+func (c *JWTClient) JWKS(ctx context.Context) (*auth2.JWKSet, error) {
+	resp, err := c.cli.R().SetContext(ctx).
+		SetResult(&auth2.JWKSet{}).SetError(&errcode.ErrMsg{}).Get("/.well-known/jwks.json")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusOK {
+		return resp.Result().(*auth2.JWKSet), nil
+	}
+	return nil, resp.Error().(*errcode.ErrMsg).Err()
+}
+
+// jwksAuthClient checks the signature and the validity window of tokens signed by the server keys locally,
+// so that forged and expired tokens never reach venus-auth. A token passing the check is verified by venus-auth,
+// which alone knows all the revoked tokens, the result is cached while the revocations are polled without a gap.
+type jwksAuthClient struct {
+	*JWTClient
+	refreshInterval time.Duration
+	// server verifies the tokens on venus-auth and caches the results
+	server IJwtAuthClient
+
+	lk        sync.RWMutex
+	keys      map[string]jwt.Algorithm
+	lastFetch time.Time
+}
+
+var _ IJwtAuthClient = &jwksAuthClient{}
+
+// NewJWKSAuthClient returns a verifier caching the server public keys, the keys are fetched again
+// on an unknown kid, at most once per refreshInterval. The results of venus-auth are cached by cnf,
+// see NewCachedAuthClient, until ctx is done, cli must hold an admin token to poll the revocations. logger is optional.
+func NewJWKSAuthClient(ctx context.Context, cli *JWTClient, refreshInterval time.Duration, cnf *CacheConfig, logger Logger) IJwtAuthClient {
+	return &jwksAuthClient{
+		JWTClient:       cli,
+		refreshInterval: refreshInterval,
+		server:          NewCachedAuthClient(ctx, WarpIJwtAuthClient(cli), cli, cnf, logger),
+		keys:            make(map[string]jwt.Algorithm),
+	}
+}
+
+func (c *jwksAuthClient) Verify(ctx context.Context, token string) ([]auth.Permission, error) {
+	hd, err := tokenHeader(token)
+	if err != nil {
+		return nil, err
+	}
+	alg, err := c.key(ctx, hd.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	pl := new(auth2.JWTPayload)
+	if _, err = jwt.Verify([]byte(token), alg, pl, jwt.ValidateHeader); err != nil {
+		return nil, auth2.ErrorVerificationFailed
+	}
+	now := time.Now().Unix()
+	if pl.NotBefore > 0 && now < pl.NotBefore {
+		return nil, auth2.ErrorTokenNotValidYet
+	}
+	if pl.ExpireAt > 0 && now >= pl.ExpireAt {
+		return nil, auth2.ErrorTokenExpired
+	}
+	// the revoked tokens are only known by the server
+	return c.server.Verify(ctx, token)
+}
+
+func (c *jwksAuthClient) key(ctx context.Context, kid string) (jwt.Algorithm, error) {
+	if len(kid) == 0 {
+		return nil, errUnknownKey
+	}
+	c.lk.RLock()
+	alg, ok := c.keys[kid]
+	fresh := time.Since(c.lastFetch) < c.refreshInterval
+	c.lk.RUnlock()
+	if ok {
+		return alg, nil
+	}
+	if fresh {
+		return nil, errUnknownKey
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if alg, ok := c.keys[kid]; ok {
+		return alg, nil
+	}
+	if time.Since(c.lastFetch) < c.refreshInterval {
+		return nil, errUnknownKey
+	}
+	c.lastFetch = time.Now()
+	set, err := c.JWKS(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("fetch jwks: %w", err)
+	}
+	keys := make(map[string]jwt.Algorithm, len(set.Keys))
+	for _, k := range set.Keys {
+		if keys[k.Kid], err = k.Verifier(); err != nil {
+			return nil, err
+		}
+	}
+	c.keys = keys
+	if alg, ok := c.keys[kid]; ok {
+		return alg, nil
+	}
+	return nil, errUnknownKey
+}
+
+func tokenHeader(token string) (*jwt.Header, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, jwt.ErrMalformed
+	}
+	dec, err := auth2.DecodeToBytes([]byte(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	hd := new(jwt.Header)
+	if err = json.Unmarshal(dec, hd); err != nil {
+		return nil, err
+	}
+	return hd, nil
+}
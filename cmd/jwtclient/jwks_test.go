@@ -0,0 +1,160 @@
+package jwtclient
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc/auth"
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	auth2 "github.com/filecoin-project/venus-auth/auth"
+	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+// mockKeyServer publishes a key, verifies tokens and reports the revocations as venus-auth does
+type mockKeyServer struct {
+	t    *testing.T
+	jwks *auth2.JWKSet
+
+	lk       sync.Mutex
+	epoch    string
+	events   []*auth2.RevocationEvent
+	removed  map[string]bool
+	verifies int
+}
+
+// remove rejects the token, the revocation is reported unless the server is restarted after it
+func (s *mockKeyServer) remove(token string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	hash := storage.Token(token).Hash().String()
+	s.removed[hash] = true
+	s.events = append(s.events, &auth2.RevocationEvent{Seq: uint64(len(s.events) + 1), Hash: hash})
+}
+
+// restart loses the revocations
+func (s *mockKeyServer) restart() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.epoch += "+"
+	s.events = nil
+}
+
+func (s *mockKeyServer) verifyCalls() int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.verifies
+}
+
+func (s *mockKeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	var res interface{}
+	switch r.URL.Path {
+	case "/.well-known/jwks.json":
+		res = s.jwks
+	case "/revocations":
+		seq, _ := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+		out := &auth2.RevocationsResponse{Epoch: s.epoch, Seq: uint64(len(s.events)), Events: []*auth2.RevocationEvent{}}
+		if r.URL.Query().Get("epoch") != s.epoch || seq > out.Seq {
+			out.Reset = true
+		} else {
+			out.Events = append(out.Events, s.events[seq:]...)
+		}
+		res = out
+	case "/verify":
+		s.verifies++
+		token := r.FormValue("token")
+		if s.removed[storage.Token(token).Hash().String()] {
+			w.WriteHeader(http.StatusUnauthorized)
+			res = map[string]string{"error": auth2.ErrorNonRegisteredToken.Error()}
+			break
+		}
+		_, pl, err := tokenClaims(token)
+		require.NoError(s.t, err)
+		res = pl
+	default:
+		s.t.Errorf("unexpected request %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func TestJWKSAuthClient(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	kid := "ed-key"
+	srv := &mockKeyServer{t: t, epoch: "epoch", removed: map[string]bool{}, jwks: &auth2.JWKSet{Keys: []*auth2.JWK{{
+		Kty: "OKP", Crv: "Ed25519", Alg: "EdDSA", Use: "sig", Kid: kid,
+		X: base64.RawURLEncoding.EncodeToString(pub),
+	}}}}
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	sign := func(name string, key ed25519.PrivateKey) string {
+		tk, err := jwt.Sign(&auth2.JWTPayload{Name: name, Perm: core.PermWrite}, jwt.NewEd25519(jwt.Ed25519PrivateKey(key)), jwt.KeyID(kid))
+		require.NoError(t, err)
+		return string(tk)
+	}
+	removedBefore, revoked, valid := sign("removed-before", priv), sign("revoked", priv), sign("valid", priv)
+	srv.remove(removedBefore)
+	srv.restart()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	poll := 10 * time.Millisecond
+	c := NewJWKSAuthClient(ctx, NewJWTClient(hs.URL), time.Minute, &CacheConfig{MaxSize: 10, TTL: time.Hour, PollInterval: poll}, nil)
+	// the first poll tells the position in the feed
+	time.Sleep(5 * poll)
+
+	_, err = c.Verify(ctx, removedBefore)
+	assert.Error(t, err, "a token removed before the client starts is rejected by the server")
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	calls := srv.verifyCalls()
+	_, err = c.Verify(ctx, sign("forged", otherKey))
+	assert.True(t, xerrors.Is(err, auth2.ErrorVerificationFailed), err)
+	assert.Equal(t, calls, srv.verifyCalls(), "a forged token is rejected locally")
+
+	for i := 0; i < 3; i++ {
+		perms, err := c.Verify(ctx, valid)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []auth.Permission{core.PermRead, core.PermWrite}, perms)
+		_, err = c.Verify(ctx, revoked)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, calls+2, srv.verifyCalls(), "the results of the server are cached")
+
+	srv.remove(revoked)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err = c.Verify(ctx, revoked); err != nil {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "the revoked token is still accepted")
+		time.Sleep(poll)
+	}
+
+	// the cached results are dropped once the revocations are lost
+	srv.restart()
+	time.Sleep(5 * poll)
+	calls = srv.verifyCalls()
+	_, err = c.Verify(ctx, valid)
+	require.NoError(t, err)
+	assert.Equal(t, calls+1, srv.verifyCalls())
+}
@@ -1,8 +1,14 @@
 package jwtclient
 
 import (
+	"context"
 	"errors"
+	"reflect"
+
 	"github.com/ipfs-force-community/metrics/ratelimit"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/auth"
 )
 
 type limitFinder struct {
@@ -13,6 +19,7 @@ var _ ratelimit.ILimitFinder = (*limitFinder)(nil)
 
 var errNilJwtClient = errors.New("jwt client is nil")
 
+// WarpLimitFinder finds the limits of the users through client, which must hold an admin token, see JWTClient.SetToken
 func WarpLimitFinder(client *JWTClient) ratelimit.ILimitFinder {
 	return &limitFinder{JWTClient: client}
 }
@@ -35,3 +42,93 @@ func (l *limitFinder) GetUserLimit(name, service, api string) (*ratelimit.Limit,
 
 	return limit, nil
 }
+
+// RemoteLimiter limits the calls of users with the counts held by venus-auth,
+// instead of counting them in every replica of the service like ratelimit.RateLimiter does.
+type RemoteLimiter struct {
+	ratelimit.IValueFromCtx
+	cli     *JWTClient
+	service string
+	logger  Logger
+}
+
+var _ ratelimit.IJSONRPCLimiterWarper = (*RemoteLimiter)(nil)
+
+var (
+	ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// NewRemoteLimiter limits the calls to the service, the user is read from the context by vfc,
+// e.g. ValueFromCtx with AuthMux. cli must hold an admin token, see JWTClient.SetToken. logger is optional.
+func NewRemoteLimiter(cli *JWTClient, service string, vfc ratelimit.IValueFromCtx, logger Logger) *RemoteLimiter {
+	return &RemoteLimiter{IValueFromCtx: vfc, cli: cli, service: service, logger: logger}
+}
+
+// Allow takes a call of the api from the bucket of the user in the context, an error is returned when it's limited.
+// The call is allowed when the user is unknown or venus-auth can't be reached.
+func (l *RemoteLimiter) Allow(ctx context.Context, api string) error {
+	user, ok := l.AccFromCtx(ctx)
+	if !ok {
+		l.warnf("rate-limit, api %s: no user in the context", api)
+		return nil
+	}
+	res, err := l.cli.TakeRateLimit(ctx, &auth.TakeRateLimitRequest{User: user, Service: l.service, API: api})
+	if err != nil {
+		l.warnf("rate-limit, user %s, api %s: %s", user, api, err)
+		return nil
+	}
+	if !res.Allowed {
+		return xerrors.Errorf("rate-limit, user %s, api %s is limited, cap:%d, retry in %s", user, api, res.Cap, res.RetryAfter)
+	}
+	return nil
+}
+
+// WarperLimiter fills the func fields of out with the ones of in limited by Allow,
+// the fields of the nested structs of in are filled as well, like ratelimit.RateLimiter does.
+func (l *RemoteLimiter) WarperLimiter(in interface{}, out interface{}) {
+	vin := reflect.ValueOf(in)
+	rout := reflect.ValueOf(out).Elem()
+	for i := 0; i < vin.NumField(); i++ {
+		method := vin.Type().Field(i).Name
+		if vin.Field(i).Kind() == reflect.Struct {
+			l.WarperLimiter(vin.Field(i).Interface(), out)
+			continue
+		}
+		field, exists := rout.Type().FieldByName(method)
+		if !exists || field.Type.Kind() != reflect.Func {
+			continue
+		}
+		fn := vin.Field(i)
+		if fn.Kind() != reflect.Func || fn.IsNil() {
+			continue
+		}
+		// only the calls taking a context and returning an error can be limited
+		ft := fn.Type()
+		if ft.NumIn() == 0 || ft.In(0) != ctxType || ft.NumOut() == 0 || ft.Out(ft.NumOut()-1) != errType {
+			rout.FieldByName(method).Set(fn)
+			continue
+		}
+		rout.FieldByName(method).Set(reflect.MakeFunc(field.Type, func(args []reflect.Value) []reflect.Value {
+			ctx, ok := args[0].Interface().(context.Context)
+			if !ok {
+				return fn.Call(args)
+			}
+			if err := l.Allow(ctx, method); err != nil {
+				res := make([]reflect.Value, ft.NumOut())
+				for i := range res {
+					res[i] = reflect.Zero(ft.Out(i))
+				}
+				res[len(res)-1] = reflect.ValueOf(&err).Elem()
+				return res
+			}
+			return fn.Call(args)
+		}))
+	}
+}
+
+func (l *RemoteLimiter) warnf(template string, args ...interface{}) {
+	if l.logger != nil {
+		l.logger.Warnf(template, args...)
+	}
+}
@@ -29,11 +29,11 @@ func main() {
 		return
 	}
 	log.InitLog(cnf.Log)
-	app, err := auth.NewOAuthApp(cnf.Secret, dataPath, cnf.DB)
+	srv, err := auth.NewOAuthService(dataPath, cnf)
 	if err != nil {
 		log.Fatalf("Failed to init venus-auth: %s", err)
 	}
-	router := auth.InitRouter(app)
+	router := auth.InitRouter(auth.NewOAuthApp(srv))
 	server := &http.Server{
 		Addr:         ":8989",
 		Handler:      router,
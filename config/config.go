@@ -10,25 +10,66 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Port         string               `json:"port"`
-	Secret       string               `json:"secret"`
-	ReadTimeout  time.Duration        `json:"readTimeout"`
-	WriteTimeout time.Duration        `json:"writeTimeout"`
-	IdleTimeout  time.Duration        `json:"idleTimeout"`
-	Log          *LogConfig           `json:"log"`
-	DB           *DBConfig            `json:"db"`
-	Trace        *metrics.TraceConfig `json:"traceConfig"`
+	Port         string        `json:"port"`
+	Secret       string        `json:"secret"`
+	SignAlg      SignAlg       `json:"signAlg"`
+	RequireUser  bool          `json:"requireUser"`
+	ReadTimeout  time.Duration `json:"readTimeout"`
+	WriteTimeout time.Duration `json:"writeTimeout"`
+	IdleTimeout  time.Duration `json:"idleTimeout"`
+	// ShutdownTimeout is how long the requests in flight are waited for on SIGINT or SIGTERM
+	ShutdownTimeout time.Duration        `json:"shutdownTimeout"`
+	Log             *LogConfig           `json:"log"`
+	DB              *DBConfig            `json:"db"`
+	Encryption      *EncryptionConfig    `json:"encryption"`
+	TLS             *TLSConfig           `json:"tls"`
+	Socket          *SocketConfig        `json:"socket"`
+	Trace           *metrics.TraceConfig `json:"traceConfig"`
+}
+
+// SignAlg is the algorithm used to sign new tokens
+type SignAlg = string
+
+const (
+	// SignHS256 signs tokens with a secret held by the server, the first one is Secret
+	SignHS256 SignAlg = "HS256"
+	// SignEd25519 and SignES256 sign tokens with a key pair held by the server,
+	// so that other services can verify them with the published public key
+	SignEd25519 SignAlg = "Ed25519"
+	SignES256   SignAlg = "ES256"
+)
+
+// DefaultShutdownTimeout is the ShutdownTimeout of the configs written before it
+const DefaultShutdownTimeout = 30 * time.Second
+
+// SocketConfig is a unix socket listened on besides Port, or instead of it when Port is empty.
+// The requests through the socket are served over plain http, even when TLS is enabled.
+type SocketConfig struct {
+	Path string `json:"path"`
+	// Mode is the octal permission of the socket file, e.g. "0660", 0600 when empty
+	Mode string `json:"mode"`
+	// Owner and Group are names or numeric ids, the socket file is kept by the user of the daemon when empty
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+}
+
+// Enabled tells whether the daemon listens on the socket
+func (c *SocketConfig) Enabled() bool {
+	return c != nil && len(c.Path) > 0
 }
 
 type DBType = string
 
 const (
-	Mysql  DBType = "mysql"
-	Badger DBType = "badger"
+	Mysql    DBType = "mysql"
+	Badger   DBType = "badger"
+	SQLite   DBType = "sqlite"
+	Postgres DBType = "postgres"
 )
 
 type DBConfig struct {
@@ -41,6 +82,47 @@ type DBConfig struct {
 	Debug        bool          `json:"debug"`
 }
 
+// EnvKEK holds the hex encoded key-encryption key, it takes precedence over the config
+const EnvKEK = "VENUS_AUTH_KEK"
+
+// EncryptionConfig is the key-encryption key protecting the token secrets and signing keys at rest,
+// nothing is encrypted when no key is set.
+type EncryptionConfig struct {
+	// hex encoded 32 bytes key
+	Key string `json:"key"`
+	// path of a file holding the hex encoded key, takes precedence over Key
+	KeyFile string `json:"keyFile"`
+}
+
+// LoadKEK returns the key-encryption key from EnvKEK, KeyFile or Key in order, nil if none is set
+func (c *EncryptionConfig) LoadKEK() ([]byte, error) {
+	key := os.Getenv(EnvKEK)
+	if len(key) == 0 && c != nil {
+		key = c.Key
+		if len(c.KeyFile) > 0 {
+			buf, err := ioutil.ReadFile(c.KeyFile)
+			if err != nil {
+				return nil, xerrors.Errorf("read key file: %w", err)
+			}
+			key = string(buf)
+		}
+	}
+	return DecodeKEK(key)
+}
+
+// DecodeKEK decodes a hex encoded key-encryption key, nil if key is empty
+func DecodeKEK(key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, nil
+	}
+	kek, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, xerrors.Errorf("decode key-encryption key: %w", err)
+	}
+	return kek, nil
+}
+
 // RandSecret If the daemon does not have a secret key configured, it is automatically generated
 func RandSecret() ([]byte, error) {
 	sk, err := ioutil.ReadAll(io.LimitReader(rand.Reader, 32))
@@ -56,11 +138,13 @@ func DefaultConfig() (*Config, error) {
 		return nil, err
 	}
 	return &Config{
-		Port:         "8989",
-		Secret:       hex.EncodeToString(secret),
-		ReadTimeout:  time.Minute,
-		WriteTimeout: time.Minute,
-		IdleTimeout:  time.Minute,
+		Port:            "8989",
+		Secret:          hex.EncodeToString(secret),
+		SignAlg:         SignHS256,
+		ReadTimeout:     time.Minute,
+		WriteTimeout:    time.Minute,
+		IdleTimeout:     time.Minute,
+		ShutdownTimeout: DefaultShutdownTimeout,
 		Trace: &metrics.TraceConfig{
 			JaegerTracingEnabled: false,
 			ProbabilitySampler:   1.0,
@@ -74,6 +158,9 @@ func DefaultConfig() (*Config, error) {
 		DB: &DBConfig{
 			Type: Badger,
 		},
+		Encryption: &EncryptionConfig{},
+		TLS:        &TLSConfig{},
+		Socket:     &SocketConfig{},
 	}, nil
 }
 
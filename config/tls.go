@@ -0,0 +1,54 @@
+package config
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/util"
+)
+
+// TLSConfig serves over TLS when the certificate and the key are set, the files are PEM encoded
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ClientCAFile holds the CAs issuing the client certificates, the clients are asked for one when it's set.
+	// The certificate only gates the connection, it grants no permission, its common name is only logged.
+	ClientCAFile string `json:"clientCAFile"`
+	// RequireClientCert rejects the clients without a certificate issued by a CA of ClientCAFile
+	RequireClientCert bool `json:"requireClientCert"`
+	// LocalCertFile and LocalKeyFile are the client certificate of the local cli, when a client certificate is required
+	LocalCertFile string `json:"localCertFile"`
+	LocalKeyFile  string `json:"localKeyFile"`
+}
+
+// Enabled tells whether the server listens over TLS
+func (c *TLSConfig) Enabled() bool {
+	return c != nil && len(c.CertFile) > 0 && len(c.KeyFile) > 0
+}
+
+// ServerConfig loads the certificate of the server and the client CAs
+func (c *TLSConfig) ServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf("load certificate: %w", err)
+	}
+	cnf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(c.ClientCAFile) == 0 {
+		if c.RequireClientCert {
+			return nil, xerrors.New("client certificates are required, but no client CA is configured")
+		}
+		return cnf, nil
+	}
+	if cnf.ClientCAs, err = util.LoadCertPool(c.ClientCAFile); err != nil {
+		return nil, xerrors.Errorf("load client CA: %w", err)
+	}
+	cnf.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.RequireClientCert {
+		cnf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cnf, nil
+}
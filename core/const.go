@@ -93,6 +93,8 @@ const (
 	FieldPreHost LogField = "preHost"
 	FieldElapsed LogField = "elapsed"
 	FieldToken   LogField = "token"
+	// FieldClient is the identity of the verified client certificate
+	FieldClient LogField = "client"
 )
 
 var TagFields = []LogField{
@@ -110,6 +112,13 @@ const (
 	Miner SourceType = 1
 )
 
+type UserState = int
+
+const (
+	UserStateDisabled UserState = 0
+	UserStateEnabled  UserState = 1
+)
+
 type Page struct {
 	Skip  int64 `form:"skip" json:"skip"`
 	Limit int64 `form:"limit" json:"limit"`
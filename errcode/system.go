@@ -4,13 +4,90 @@ import "errors"
 
 type ErrMsg struct {
 	Error string `json:"error"`
+	// Code is the machine readable kind of the error, one of the Code constants
+	Code string `json:"code,omitempty"`
 }
 
+// Err turns the message back into an error, which matches the sentinel of its code by errors.Is
 func (err *ErrMsg) Err() error {
+	for _, k := range kinds {
+		if k.code == err.Code {
+			return Wrap(k.err, errors.New(err.Error))
+		}
+	}
 	return errors.New(err.Error)
 }
 
 var (
 	ErrDataNotExists    = errors.New("data not exists")
 	ErrSystemExecFailed = errors.New("program execution error")
+
+	// ErrNotFound is the kind of the errors of missing data
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is the kind of the errors of creating data which exists
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrInvalidArgument is the kind of the errors of malformed requests
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrUnavailable is the kind of the errors of reaching the db or another service,
+	// the same request may succeed later.
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// The codes of the error kinds in ErrMsg, they are part of the API and must not change
+const (
+	CodeNotFound        = "not_found"
+	CodeAlreadyExists   = "already_exists"
+	CodeInvalidArgument = "invalid_argument"
+	CodeUnavailable     = "unavailable"
+	CodeUnknown         = "unknown"
 )
+
+var kinds = []struct {
+	code string
+	err  error
+}{
+	{CodeNotFound, ErrNotFound},
+	{CodeAlreadyExists, ErrAlreadyExists},
+	{CodeInvalidArgument, ErrInvalidArgument},
+	{CodeUnavailable, ErrUnavailable},
+}
+
+// Code returns the code of the kind of err, CodeUnknown if it has none
+func Code(err error) string {
+	for _, k := range kinds {
+		if errors.Is(err, k.err) {
+			return k.code
+		}
+	}
+	return CodeUnknown
+}
+
+// New returns an error of the kind with the message
+func New(kind error, msg string) error {
+	return Wrap(kind, errors.New(msg))
+}
+
+// Wrap returns err as an error of the kind, the message and the chain of err are kept
+func Wrap(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
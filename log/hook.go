@@ -8,6 +8,7 @@ import (
 	"github.com/influxdata/influxdb-client-go/v2/api"
 	"github.com/sirupsen/logrus"
 	"strconv"
+	"sync"
 )
 
 const (
@@ -19,6 +20,9 @@ type InfluxHook struct {
 	client   influxdb2.Client
 	writeAPI api.WriteAPI
 	tags     []string
+	// the entries fired after Close are dropped, the write api is closed
+	lk     sync.RWMutex
+	closed bool
 }
 
 func NewInfluxHook(c *config.InfluxDBConfig) *InfluxHook {
@@ -37,6 +41,18 @@ func NewInfluxHook(c *config.InfluxDBConfig) *InfluxHook {
 	}
 }
 
+// Close writes the buffered points, then closes the client
+func (h *InfluxHook) Close() {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	h.writeAPI.Flush()
+	h.client.Close()
+}
+
 func (h *InfluxHook) Levels() []logrus.Level {
 	return logrus.AllLevels
 }
@@ -65,7 +81,11 @@ func (h *InfluxHook) Fire(entry *logrus.Entry) error {
 	}
 
 	pt := influxdb2.NewPoint(measurement.(string), tags, fields, entry.Time)
-	h.writeAPI.WritePoint(pt)
+	h.lk.RLock()
+	defer h.lk.RUnlock()
+	if !h.closed {
+		h.writeAPI.WritePoint(pt)
+	}
 	return nil
 }
 
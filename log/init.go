@@ -32,5 +32,17 @@ func InitLog(c *config.LogConfig) {
 func WithInflux(c *config.InfluxDBConfig) error {
 	hook := NewInfluxHook(c)
 	localLog.AddHook(hook)
+	influxHooks = append(influxHooks, hook)
 	return nil
 }
+
+// influxHooks are flushed by Close
+var influxHooks []*InfluxHook
+
+// Close flushes the points buffered by the influxdb hooks, the entries logged afterwards are not sent
+func Close() {
+	for _, hook := range influxHooks {
+		hook.Close()
+	}
+	influxHooks = nil
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"golang.org/x/xerrors"
+)
+
+// BackupVersion is the version of the archives written by Backup, Restore reads the versions up to it
+const BackupVersion = 1
+
+// Record is a token, user, rate limit or signing key of a store, one of the fields is set
+type Record struct {
+	Token      *KeyPair       `json:"token,omitempty"`
+	User       *User          `json:"user,omitempty"`
+	RateLimit  *UserRateLimit `json:"rateLimit,omitempty"`
+	SigningKey *SigningKey    `json:"signingKey,omitempty"`
+}
+
+// BackupSummary counts the records of an archive
+type BackupSummary struct {
+	Tokens      int `json:"tokens"`
+	Users       int `json:"users"`
+	Miners      int `json:"miners"`
+	RateLimits  int `json:"rateLimits"`
+	SigningKeys int `json:"signingKeys"`
+}
+
+func (s *BackupSummary) add(r *Record) {
+	switch {
+	case r.Token != nil:
+		s.Tokens++
+	case r.User != nil:
+		s.Users++
+		s.Miners += len(r.User.Miners)
+	case r.RateLimit != nil:
+		s.RateLimits++
+	case r.SigningKey != nil:
+		s.SigningKeys++
+	}
+}
+
+// backupLine is a line of the gzipped json lines of an archive,
+// the header comes first, then the records, the summary ends it.
+type backupLine struct {
+	Version    int       `json:"version,omitempty"`
+	CreateTime time.Time `json:"createTime,omitempty"`
+	Record
+	End *BackupSummary `json:"end,omitempty"`
+}
+
+// Backup writes the records of the store to w, they are read from one snapshot of the db.
+// The secrets are written as they are stored, the encrypted ones need the same key-encryption key after restore.
+func Backup(s Store, w io.Writer) (*BackupSummary, error) {
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	if err := enc.Encode(&backupLine{Version: BackupVersion, CreateTime: time.Now()}); err != nil {
+		return nil, err
+	}
+	sum := new(BackupSummary)
+	err := s.Export(func(r *Record) error {
+		sum.add(r)
+		return enc.Encode(&backupLine{Record: *r})
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("export: %w", err)
+	}
+	if err = enc.Encode(&backupLine{End: sum}); err != nil {
+		return nil, err
+	}
+	return sum, zw.Close()
+}
+
+var errStoreNotEmpty = xerrors.New("store is not empty")
+
+// Restore writes the records of the archive to the store, which must be empty.
+// The archive is validated as a whole before anything is written.
+func Restore(s Store, r io.Reader) (*BackupSummary, error) {
+	if err := s.Export(func(*Record) error { return errStoreNotEmpty }); err != nil {
+		return nil, xerrors.Errorf("restore into an empty store: %w", err)
+	}
+	records, sum, err := readBackup(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		switch {
+		case rec.SigningKey != nil:
+			err = s.PutSigningKey(rec.SigningKey)
+		case rec.User != nil:
+			err = restoreUser(s, rec.User)
+		case rec.Token != nil:
+			err = s.Put(rec.Token)
+		case rec.RateLimit != nil:
+			_, err = s.PutRateLimit(rec.RateLimit)
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("restore: %w", err)
+		}
+	}
+	return sum, nil
+}
+
+func restoreUser(s Store, user *User) error {
+	if err := s.PutUser(user); err != nil {
+		return err
+	}
+	for _, m := range user.Miners {
+		maddr, err := address.NewFromString(m)
+		if err != nil {
+			return err
+		}
+		if err = s.AddMiner(user.Name, maddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckBackup reads the whole archive, and returns its summary if it can be restored
+func CheckBackup(r io.Reader) (*BackupSummary, error) {
+	_, sum, err := readBackup(r)
+	return sum, err
+}
+
+// readBackup reads and checks the archive, the records are ordered to be written:
+// the signing keys, then the users, the tokens and the rate limits
+func readBackup(r io.Reader) ([]*Record, *BackupSummary, error) {
+	zr, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("read archive: %w", err)
+	}
+	dec := json.NewDecoder(zr)
+	var header backupLine
+	if err = dec.Decode(&header); err != nil {
+		return nil, nil, xerrors.Errorf("read archive header: %w", err)
+	}
+	if header.Version <= 0 || header.Version > BackupVersion {
+		return nil, nil, xerrors.Errorf("unsupported archive version %d, %d at most", header.Version, BackupVersion)
+	}
+
+	var keys, users, tokens, limits []*Record
+	sum := new(BackupSummary)
+	for {
+		var line backupLine
+		if err = dec.Decode(&line); err != nil {
+			if err == io.EOF {
+				return nil, nil, xerrors.New("archive is truncated, the summary is missing")
+			}
+			return nil, nil, xerrors.Errorf("read archive: %w", err)
+		}
+		if line.End != nil {
+			if *line.End != *sum {
+				return nil, nil, xerrors.Errorf("archive has %+v, but its summary tells %+v", *sum, *line.End)
+			}
+			break
+		}
+		rec := line.Record
+		switch {
+		case rec.SigningKey != nil:
+			keys = append(keys, &rec)
+		case rec.User != nil:
+			users = append(users, &rec)
+		case rec.Token != nil:
+			tokens = append(tokens, &rec)
+		case rec.RateLimit != nil:
+			limits = append(limits, &rec)
+		default:
+			return nil, nil, xerrors.New("archive has an empty record")
+		}
+		sum.add(&rec)
+	}
+	if err = checkBackup(keys, users, tokens, limits); err != nil {
+		return nil, nil, err
+	}
+	records := append(append(append(keys, users...), tokens...), limits...)
+	return records, sum, nil
+}
+
+// checkBackup makes sure the records can be written to an empty store
+func checkBackup(keys, users, tokens, limits []*Record) error {
+	kids := make(map[string]bool)
+	for _, r := range keys {
+		if len(r.SigningKey.Kid) == 0 || kids[r.SigningKey.Kid] {
+			return xerrors.Errorf("signing key with empty or duplicate kid %q", r.SigningKey.Kid)
+		}
+		kids[r.SigningKey.Kid] = true
+	}
+	names := make(map[string]bool)
+	miners := make(map[string]string)
+	for _, r := range users {
+		u := r.User
+		if len(u.Name) == 0 || len(u.Id) == 0 || names[u.Name] {
+			return xerrors.Errorf("user with empty or duplicate name %q, or empty id", u.Name)
+		}
+		names[u.Name] = true
+		for _, m := range u.Miners {
+			if _, err := address.NewFromString(m); err != nil {
+				return xerrors.Errorf("miner %s of user %s: %w", m, u.Name, err)
+			}
+			if owner, ok := miners[m]; ok {
+				return xerrors.Errorf("miner %s belongs to both user %s and %s", m, owner, u.Name)
+			}
+			miners[m] = u.Name
+		}
+	}
+	hashes := make(map[TokenHash]bool)
+	for _, r := range tokens {
+		kp := r.Token
+		if len(kp.Hash) == 0 || hashes[kp.Hash] {
+			return xerrors.Errorf("token of %s with empty or duplicate hash %q", kp.Name, kp.Hash)
+		}
+		hashes[kp.Hash] = true
+	}
+	ids := make(map[string]bool)
+	for _, r := range limits {
+		l := r.RateLimit
+		if len(l.Id) == 0 || ids[l.Id] {
+			return xerrors.Errorf("rate limit with empty or duplicate id %q", l.Id)
+		}
+		if !names[l.Name] {
+			return xerrors.Errorf("rate limit %s of user %s, who is not in the archive", l.Id, l.Name)
+		}
+		ids[l.Id] = true
+	}
+	return nil
+}
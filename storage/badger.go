@@ -2,43 +2,103 @@ package storage
 
 import (
 	"encoding/json"
-	"errors"
-	"github.com/google/uuid"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/dgraph-io/badger/v3"
 	"github.com/filecoin-project/go-address"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/errcode"
 )
 
 var _ Store = &badgerStore{}
 
 type badgerStore struct {
 	db *badger.DB
+	// schemaMu is held by Migrate
+	schemaMu sync.Mutex
+	// closing stops the value log GC, gcDone is closed once it's stopped
+	closing   chan struct{}
+	gcDone    chan struct{}
+	closeOnce sync.Once
 }
 
+// gcInterval is how often the value log is garbage collected
+const gcInterval = 5 * time.Minute
+
 func newBadgerStore(filePath string) (Store, error) {
 	db, err := badger.Open(badger.DefaultOptions(filePath))
 	if err != nil {
 		return nil, xerrors.Errorf("open db failed :%s", err)
 	}
 	s := &badgerStore{
-		db: db,
-	}
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
-		for range ticker.C {
-		again:
-			err := db.RunValueLogGC(0.7)
-			if err == nil {
-				goto again
+		db:      db,
+		closing: make(chan struct{}),
+		gcDone:  make(chan struct{}),
+	}
+	// not a numbered migration, the index keys may be lost at any version
+	if err = s.ensureMinerIndex(); err != nil {
+		_ = db.Close()
+		return nil, xerrors.Errorf("build miner index: %w", err)
+	}
+	go s.runGC()
+	return s, nil
+}
+
+func (s *badgerStore) runGC() {
+	defer close(s.gcDone)
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		// collect until a run rewrites nothing, or the store is closed
+		for {
+			select {
+			case <-s.closing:
+				return
+			default:
+			}
+			if s.db.RunValueLogGC(0.7) != nil {
+				break
 			}
 		}
-	}()
-	return s, nil
+	}
+}
+
+// Close waits for the value log GC to stop, then closes the db, which syncs the writes to disk
+func (s *badgerStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		<-s.gcDone
+		err = s.db.Close()
+	})
+	return err
+}
+
+// view and update run fn in a transaction, the errors of a closed db wrap ErrUnavailable
+func (s *badgerStore) view(fn func(txn *badger.Txn) error) error {
+	return badgerError(s.db.View(fn))
+}
+
+func (s *badgerStore) update(fn func(txn *badger.Txn) error) error {
+	return badgerError(s.db.Update(fn))
+}
+
+func badgerError(err error) error {
+	if xerrors.Is(err, badger.ErrDBClosed) || xerrors.Is(err, badger.ErrBlockedWrites) {
+		return errcode.Wrap(ErrUnavailable, err)
+	}
+	return err
 }
 
 func (s *badgerStore) Put(kp *KeyPair) error {
@@ -46,23 +106,28 @@ func (s *badgerStore) Put(kp *KeyPair) error {
 	if err != nil {
 		return xerrors.Errorf("failed to marshal time :%s", err)
 	}
-	key := s.tokenKey(kp.Token.String())
-	return s.db.Update(func(txn *badger.Txn) error {
+	key := s.tokenKey(kp.Hash.String())
+	return s.update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); err == nil {
+			return xerrors.Errorf("token %s: %w", kp.Hash, ErrAlreadyExists)
+		} else if !xerrors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
 		return txn.Set(key, val)
 	})
 }
 
-func (s *badgerStore) Delete(token Token) error {
-	key := s.tokenKey(token.String())
-	return s.db.Update(func(txn *badger.Txn) error {
+func (s *badgerStore) Delete(hash TokenHash) error {
+	key := s.tokenKey(hash.String())
+	return s.update(func(txn *badger.Txn) error {
 		return txn.Delete(key)
 	})
 }
 
-func (s *badgerStore) Has(token Token) (bool, error) {
-	key := s.tokenKey(token.String())
+func (s *badgerStore) Has(hash TokenHash) (bool, error) {
+	key := s.tokenKey(hash.String())
 	var value []byte
-	err := s.db.View(func(txn *badger.Txn) error {
+	err := s.view(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
 		if err != nil {
 			return err
@@ -72,7 +137,7 @@ func (s *badgerStore) Has(token Token) (bool, error) {
 		return err
 	})
 	if err != nil {
-		if err.Error() == "Key not found" {
+		if xerrors.Is(err, badger.ErrKeyNotFound) {
 			return false, nil
 		}
 		return false, err
@@ -80,22 +145,27 @@ func (s *badgerStore) Has(token Token) (bool, error) {
 	return true, nil
 }
 
-func (s *badgerStore) Get(token Token) (*KeyPair, error) {
+func (s *badgerStore) Get(hash TokenHash) (*KeyPair, error) {
 	kp := new(KeyPair)
-	key := s.tokenKey(token.String())
+	key := s.tokenKey(hash.String())
 
-	err := s.db.View(func(txn *badger.Txn) error {
+	err := s.view(func(txn *badger.Txn) error {
 		val, err := txn.Get(key)
-		if err != nil || err == badger.ErrKeyNotFound {
-			return xerrors.Errorf("token %s not exit", token)
+		if err != nil {
+			if xerrors.Is(err, badger.ErrKeyNotFound) {
+				return xerrors.Errorf("token %s: %w", hash, ErrNotFound)
+			}
+			return err
 		}
 
 		return val.Value(func(val []byte) error {
 			return kp.FromBytes(val)
 		})
 	})
-
-	return kp, err
+	if err != nil {
+		return nil, err
+	}
+	return kp, nil
 }
 
 func (s *badgerStore) UpdateToken(kp *KeyPair) error {
@@ -103,94 +173,187 @@ func (s *badgerStore) UpdateToken(kp *KeyPair) error {
 	if err != nil {
 		return err
 	}
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(s.tokenKey(kp.Token.String()), val)
+	key := s.tokenKey(kp.Hash.String())
+	return s.update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); err != nil {
+			if xerrors.Is(err, badger.ErrKeyNotFound) {
+				return xerrors.Errorf("token %s: %w", kp.Hash, ErrNotFound)
+			}
+			return err
+		}
+		return txn.Set(key, val)
 	})
 }
 
+// List scans all the tokens, they are keyed by hash
 func (s *badgerStore) List(skip, limit int64) ([]*KeyPair, error) {
-	data := make(chan *KeyPair, limit)
-	err := s.db.View(func(txn *badger.Txn) error {
-		opts := badger.IteratorOptions{
-			PrefetchValues: true,
-			Reverse:        false,
-			AllVersions:    false,
-			Prefix:         []byte(PrefixToken),
+	kps, err := s.scanTokens(func(kp *KeyPair) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(kps, func(i, j int) bool {
+		if kps[i].Name != kps[j].Name {
+			return kps[i].Name < kps[j].Name
 		}
-		it := txn.NewIterator(opts)
+		return lessKeyPair(kps[i], kps[j])
+	})
+	lo, hi := pageRange(len(kps), skip, limit)
+	return kps[lo:hi], nil
+}
+
+// ListByName scans all the tokens, they are keyed by hash only
+func (s *badgerStore) ListByName(name string, skip, limit int64) ([]*KeyPair, error) {
+	kps, err := s.scanTokens(func(kp *KeyPair) bool { return kp.Name == name })
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(kps, func(i, j int) bool {
+		return lessKeyPair(kps[i], kps[j])
+	})
+	lo, hi := pageRange(len(kps), skip, limit)
+	return kps[lo:hi], nil
+}
+
+func (s *badgerStore) scanTokens(filter func(kp *KeyPair) bool) ([]*KeyPair, error) {
+	res := make([]*KeyPair, 0)
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte(PrefixToken)})
 		defer it.Close()
-		idx := int64(0)
-		for it.Rewind(); it.Valid() && idx < skip+limit; it.Next() {
-			if idx >= skip {
-				item := it.Item()
-				val := new([]byte)
-				err := item.Value(func(v []byte) error {
-					val = &v
-					return nil
-				})
-				if err != nil {
-					close(data)
-					return err
-				}
-				kp := new(KeyPair)
-				err = kp.FromBytes(*val)
-				if err != nil {
-					close(data)
-					return err
-				}
-				data <- kp
+		for it.Rewind(); it.Valid(); it.Next() {
+			kp := new(KeyPair)
+			if err := it.Item().Value(func(v []byte) error {
+				return kp.FromBytes(v)
+			}); err != nil {
+				return err
+			}
+			if filter(kp) {
+				res = append(res, kp)
 			}
-			idx++
 		}
-		close(data)
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	res := make([]*KeyPair, 0, limit)
-	for ch := range data {
-		res = append(res, ch)
-	}
 	return res, nil
 }
 
-func (s *badgerStore) GetUser(name string) (*User, error) {
-	user := new(User)
-	err := s.db.View(func(txn *badger.Txn) error {
-		val, err := txn.Get(s.userKey(name))
-		if err != nil || err == badger.ErrKeyNotFound {
-			return xerrors.Errorf("users %s not exit", name)
-		}
+// lessKeyPair orders the tokens by create time, the hash breaks a tie
+func lessKeyPair(a, b *KeyPair) bool {
+	if !a.CreateTime.Equal(b.CreateTime) {
+		return a.CreateTime.Before(b.CreateTime)
+	}
+	return a.Hash < b.Hash
+}
 
-		return val.Value(func(val []byte) error {
-			return user.FromBytes(val)
-		})
-	})
+// pageRange returns the range of the page in n records
+func pageRange(n int, skip, limit int64) (int, int) {
+	lo := n
+	if skip < int64(n) {
+		lo = int(skip)
+	}
+	if lo < 0 {
+		lo = 0
+	}
+	if limit > 0 && limit < int64(n-lo) {
+		return lo, lo + int(limit)
+	}
+	return lo, n
+}
+
+func (s *badgerStore) getUser(txn *badger.Txn, name string) (*User, error) {
+	val, err := txn.Get(s.userKey(name))
 	if err != nil {
+		if xerrors.Is(err, badger.ErrKeyNotFound) {
+			return nil, xerrors.Errorf("user %s: %w", name, ErrNotFound)
+		}
+		return nil, err
+	}
+	user := new(User)
+	if err = val.Value(func(val []byte) error {
+		return user.FromBytes(val)
+	}); err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-func (s *badgerStore) UpdateUser(user *User) error {
-	old, err := s.GetUser(user.Name)
+// putUser writes the user, and the changes of its miners to the miner index in the same txn
+func (s *badgerStore) putUser(txn *badger.Txn, user *User) error {
+	var oldMiners []string
+	if old, err := s.getUser(txn, user.Name); err == nil {
+		oldMiners = old.Miners
+	}
+	for _, m := range user.Miners {
+		owner, err := s.minerIndex(txn, m)
+		if err != nil {
+			return err
+		}
+		if len(owner) > 0 && owner != user.Name {
+			return xerrors.Errorf("miner %s belongs to user %s: %w", m, owner, ErrAlreadyExists)
+		}
+		if len(owner) == 0 {
+			if err = txn.Set(s.minerKey(m), []byte(user.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range oldMiners {
+		if !user.HasMiner(m) {
+			if err := txn.Delete(s.minerKey(m)); err != nil {
+				return err
+			}
+		}
+	}
+	val, err := user.Bytes()
 	if err != nil {
 		return err
 	}
-	user.Id = old.Id
-	val, err := user.Bytes()
+	return txn.Set(s.userKey(user.Name), val)
+}
+
+// minerIndex returns the name of the user the miner belongs to, empty if there is none
+func (s *badgerStore) minerIndex(txn *badger.Txn, maddr string) (string, error) {
+	item, err := txn.Get(s.minerKey(maddr))
 	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	name, err := item.ValueCopy(nil)
+	return string(name), err
+}
+
+func (s *badgerStore) GetUser(name string) (*User, error) {
+	var user *User
+	err := s.view(func(txn *badger.Txn) (err error) {
+		user, err = s.getUser(txn, name)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(s.userKey(user.Name), val)
+	return user, nil
+}
+
+// UpdateUser keeps the stored miners, they are changed by AddMiner and DelMiner only
+func (s *badgerStore) UpdateUser(user *User) error {
+	return s.update(func(txn *badger.Txn) error {
+		old, err := s.getUser(txn, user.Name)
+		if err != nil {
+			return err
+		}
+		updated := *user
+		updated.Id = old.Id
+		updated.Miners = old.Miners
+		return s.putUser(txn, &updated)
 	})
 }
 
 func (s *badgerStore) HasUser(name string) (bool, error) {
 	var value []byte
-	err := s.db.View(func(txn *badger.Txn) error {
+	err := s.view(func(txn *badger.Txn) error {
 		item, err := txn.Get(s.userKey(name))
 		if err != nil {
 			return err
@@ -200,7 +363,7 @@ func (s *badgerStore) HasUser(name string) (bool, error) {
 		return err
 	})
 	if err != nil {
-		if err.Error() == "Key not found" {
+		if xerrors.Is(err, badger.ErrKeyNotFound) {
 			return false, nil
 		}
 		return false, err
@@ -208,112 +371,110 @@ func (s *badgerStore) HasUser(name string) (bool, error) {
 	return true, nil
 }
 
+// PutUser ignores the miners, they are added by AddMiner only
 func (s *badgerStore) PutUser(user *User) error {
-	val, err := user.Bytes()
-	if err != nil {
-		return err
-	}
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(s.userKey(user.Name), val)
+	return s.update(func(txn *badger.Txn) error {
+		if _, err := s.getUser(txn, user.Name); err == nil {
+			return xerrors.Errorf("user %s: %w", user.Name, ErrAlreadyExists)
+		} else if !xerrors.Is(err, ErrNotFound) {
+			return err
+		}
+		created := *user
+		created.Miners = nil
+		return s.putUser(txn, &created)
 	})
 }
 
-func (s *badgerStore) ListUsers(skip, limit int64, state int, sourceType core.SourceType, code core.KeyCode) ([]*User, error) {
-	var data []*User
-	err := s.db.View(func(txn *badger.Txn) error {
-		opts := badger.IteratorOptions{
-			PrefetchValues: true,
-			Reverse:        false,
-			AllVersions:    false,
-			Prefix:         []byte(PrefixUser),
+func (s *badgerStore) DelUser(name string) error {
+	return s.update(func(txn *badger.Txn) error {
+		user, err := s.getUser(txn, name)
+		if err != nil {
+			return err
 		}
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		idx := int64(0)
-		for it.Rewind(); it.Valid() && idx < skip+limit; it.Next() {
-			if idx >= skip {
-				item := it.Item()
-				// k := item.Key()
-				val := new([]byte)
-				err := item.Value(func(v []byte) error {
-					val = &v
-					return nil
-				})
-				if err != nil {
-					return err
-				}
-				user := new(User)
-				err = user.FromBytes(*val)
-				if err != nil {
-					return err
-				}
-				// aggregation multi-select
-				need := false
-				if code&1 == 1 {
-					need = user.SourceType == sourceType
-				} else {
-					need = true
-				}
-
-				if !need {
-					continue
-				}
-				if code&2 == 2 {
-					need = need && user.State == state
-				} else {
-					need = need && true
-				}
-				if need {
-
-					data = append(data, user)
-					idx++
-				}
+		for _, m := range user.Miners {
+			if err := txn.Delete(s.minerKey(m)); err != nil {
+				return err
 			}
 		}
-		return nil
+		if err := txn.Delete(s.userKey(name)); err != nil {
+			return err
+		}
+		item, err := txn.Get(s.rateLimitKey(name))
+		if xerrors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var mRateLimits map[string]*UserRateLimit
+		if err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &mRateLimits)
+		}); err != nil {
+			return err
+		}
+		for id := range mRateLimits {
+			if err := txn.Delete(s.rateBucketKey(RateBucketKey(name, id))); err != nil {
+				return err
+			}
+		}
+		return txn.Delete(s.rateLimitKey(name))
 	})
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
 }
 
-func (s *badgerStore) HasMiner(maddr address.Address) (bool, error) {
-	var has bool
-	err := s.db.View(func(txn *badger.Txn) error {
-		opts := badger.IteratorOptions{
-			PrefetchValues: true,
-			Reverse:        false,
-			AllVersions:    false,
-			Prefix:         []byte(PrefixUser),
-		}
-		it := txn.NewIterator(opts)
+// ListUsers scans all the users, they are keyed by name
+func (s *badgerStore) ListUsers(skip, limit int64, state int, sourceType core.SourceType, code core.KeyCode) ([]*User, error) {
+	data := make([]*User, 0)
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte(PrefixUser)})
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			// k := item.Key()
-			val := new([]byte)
-			err := item.Value(func(v []byte) error {
-				// fmt.Printf("key=%s, value=%s\n", k, v)
-				val = &v
-				return nil
-			})
-			if err != nil {
-				return err
-			}
 			user := new(User)
-			err = user.FromBytes(*val)
-			if err != nil {
+			if err := it.Item().Value(user.FromBytes); err != nil {
 				return err
 			}
-
-			if user.Miner == maddr.String() {
-				has = true
-				return nil
+			if user.IsDeleted {
+				continue
+			}
+			// aggregation multi-select
+			if code&1 == 1 && user.SourceType != sourceType {
+				continue
+			}
+			if code&2 == 2 && user.State != state {
+				continue
 			}
+			data = append(data, user)
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(data, func(i, j int) bool {
+		if !data[i].CreateTime.Equal(data[j].CreateTime) {
+			return data[i].CreateTime.Before(data[j].CreateTime)
+		}
+		return data[i].Name < data[j].Name
+	})
+	lo, hi := pageRange(len(data), skip, limit)
+	return data[lo:hi], nil
+}
+
+// minerOwner returns the user the miner belongs to, nil if there is none
+func (s *badgerStore) minerOwner(txn *badger.Txn, maddr address.Address) (*User, error) {
+	name, err := s.minerIndex(txn, maddr.String())
+	if err != nil || len(name) == 0 {
+		return nil, err
+	}
+	return s.getUser(txn, name)
+}
+
+func (s *badgerStore) HasMiner(maddr address.Address) (bool, error) {
+	var has bool
+	err := s.view(func(txn *badger.Txn) error {
+		user, err := s.minerOwner(txn, maddr)
+		has = user != nil && !user.IsDeleted
+		return err
+	})
 	if err != nil {
 		return false, err
 	}
@@ -322,103 +483,167 @@ func (s *badgerStore) HasMiner(maddr address.Address) (bool, error) {
 
 func (s *badgerStore) GetMiner(maddr address.Address) (*User, error) {
 	var data *User
-	err := s.db.View(func(txn *badger.Txn) error {
-		opts := badger.IteratorOptions{
-			PrefetchValues: true,
-			Reverse:        false,
-			AllVersions:    false,
-			Prefix:         []byte(PrefixUser),
-		}
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			// k := item.Key()
-			val := new([]byte)
-			err := item.Value(func(v []byte) error {
-				// fmt.Printf("key=%s, value=%s\n", k, v)
-				val = &v
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-			user := new(User)
-			err = user.FromBytes(*val)
-			if err != nil {
-				return err
-			}
-			if user.Miner == maddr.String() {
-				data = user
-				return nil
-			}
-		}
-		return nil
+	err := s.view(func(txn *badger.Txn) (err error) {
+		data, err = s.minerOwner(txn, maddr)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
-	if data == nil {
-		return nil, xerrors.Errorf("miner %s not exit", maddr)
+	if data == nil || data.IsDeleted {
+		return nil, xerrors.Errorf("miner %s: %w", maddr, ErrNotFound)
 	}
 	return data, nil
 }
 
+func (s *badgerStore) AddMiner(name string, maddr address.Address) error {
+	return s.update(func(txn *badger.Txn) error {
+		user, err := s.getUser(txn, name)
+		if err != nil {
+			return err
+		}
+		owner, err := s.minerOwner(txn, maddr)
+		if err != nil {
+			return err
+		}
+		if owner != nil {
+			if owner.Name != name {
+				return xerrors.Errorf("miner %s belongs to user %s: %w", maddr, owner.Name, ErrAlreadyExists)
+			}
+			return nil
+		}
+		user.Miners = append(user.Miners, maddr.String())
+		return s.putUser(txn, user)
+	})
+}
+
+func (s *badgerStore) DelMiner(name string, maddr address.Address) error {
+	return s.update(func(txn *badger.Txn) error {
+		user, err := s.getUser(txn, name)
+		if err != nil {
+			return err
+		}
+		if !user.HasMiner(maddr.String()) {
+			return xerrors.Errorf("miner %s of user %s: %w", maddr, name, ErrNotFound)
+		}
+		miners := make([]string, 0, len(user.Miners)-1)
+		for _, m := range user.Miners {
+			if m != maddr.String() {
+				miners = append(miners, m)
+			}
+		}
+		user.Miners = miners
+		return s.putUser(txn, user)
+	})
+}
+
 func (s *badgerStore) GetRateLimits(name, id string) ([]*UserRateLimit, error) {
 	mRateLimits, err := s.listRateLimits(name, id)
 	if err != nil {
+		if xerrors.Is(err, badger.ErrKeyNotFound) {
+			return []*UserRateLimit{}, nil
+		}
 		return nil, err
 	}
 
-	var rateLimits = make([]*UserRateLimit, len(mRateLimits))
-	var idx = 0
+	var rateLimits = make([]*UserRateLimit, 0, len(mRateLimits))
 	for _, l := range mRateLimits {
-		rateLimits[idx] = l
-		idx++
+		rateLimits = append(rateLimits, l)
 	}
+	sort.Slice(rateLimits, func(i, j int) bool {
+		return rateLimits[i].Id < rateLimits[j].Id
+	})
 
-	return rateLimits, err
+	return rateLimits, nil
 }
 
+// PutRateLimit adds the limit, or replaces the one of the same id of the user
 func (s *badgerStore) PutRateLimit(limit *UserRateLimit) (string, error) {
+	return s.putRateLimit(limit, false)
+}
+
+func (s *badgerStore) AddRateLimit(limit *UserRateLimit) (string, error) {
+	return s.putRateLimit(limit, true)
+}
+
+// putRateLimit fails if the id is taken by another user, or by the user as well when create is set
+func (s *badgerStore) putRateLimit(limit *UserRateLimit, create bool) (string, error) {
+	if len(limit.Name) == 0 {
+		return "", errcode.New(errcode.ErrInvalidArgument, "user is required for rate limit")
+	}
 	if limit.Id == "" {
 		limit.Id = uuid.NewString()
 	}
-	limits, err := s.listRateLimits(limit.Name, "")
-	if err != nil {
-		if !xerrors.Is(err, badger.ErrKeyNotFound) {
-			return "", err
+	return limit.Id, s.update(func(txn *badger.Txn) error {
+		// the limits are kept by user, the id may be taken by another user
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte(PrefixReqLimit)})
+		defer it.Close()
+		limits := make(map[string]*UserRateLimit)
+		for it.Rewind(); it.Valid(); it.Next() {
+			var mRateLimits map[string]*UserRateLimit
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &mRateLimits)
+			}); err != nil {
+				return err
+			}
+			if string(it.Item().Key()) == string(s.rateLimitKey(limit.Name)) {
+				limits = mRateLimits
+			} else if l, ok := mRateLimits[limit.Id]; ok {
+				return xerrors.Errorf("rate limit %s belongs to user %s: %w", limit.Id, l.Name, ErrAlreadyExists)
+			}
 		}
-		limits = make(map[string]*UserRateLimit)
-	}
-
-	limits[limit.Id] = limit
-
-	return limit.Id, s.updateUserRateLimit(limit.Name, limits)
+		if _, ok := limits[limit.Id]; ok && create {
+			return xerrors.Errorf("rate limit %s of user %s: %w", limit.Id, limit.Name, ErrAlreadyExists)
+		}
+		limits[limit.Id] = limit
+		val, err := json.Marshal(limits)
+		if err != nil {
+			return err
+		}
+		return txn.Set(s.rateLimitKey(limit.Name), val)
+	})
 }
 
 func (s *badgerStore) DelRateLimit(name, id string) error {
 	if len(name) == 0 || len(id) == 0 {
-		return errors.New("user and rate-limit id is required for removing rate limit regulation")
+		return errcode.New(errcode.ErrInvalidArgument, "user and rate-limit id is required for removing rate limit regulation")
 	}
 
-	mRateLimit, err := s.listRateLimits(name, id)
-	if err != nil {
-		return err
-	}
-	if _, exist := mRateLimit[id]; !exist {
-		return nil
-	}
-	delete(mRateLimit, id)
-	return s.updateUserRateLimit(name, mRateLimit)
+	return s.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(s.rateLimitKey(name))
+		if xerrors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var mRateLimits map[string]*UserRateLimit
+		if err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &mRateLimits)
+		}); err != nil {
+			return err
+		}
+		if _, exist := mRateLimits[id]; !exist {
+			return nil
+		}
+		delete(mRateLimits, id)
+		val, err := json.Marshal(mRateLimits)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(s.rateBucketKey(RateBucketKey(name, id))); err != nil {
+			return err
+		}
+		return txn.Set(s.rateLimitKey(name), val)
+	})
 }
 
 func (s *badgerStore) listRateLimits(user, id string) (map[string]*UserRateLimit, error) {
 	var mRateLimits map[string]*UserRateLimit
-	if err := s.db.View(func(txn *badger.Txn) error {
+	if err := s.view(func(txn *badger.Txn) error {
 		val, err := txn.Get(s.rateLimitKey(user))
-		if err != nil || err == badger.ErrKeyNotFound {
-			return xerrors.Errorf("users %s not exit, %w", user, err)
+		if err != nil {
+			return xerrors.Errorf("rate limits of user %s: %w", user, err)
 		}
 		return val.Value(func(val []byte) error {
 			return json.Unmarshal(val, &mRateLimits)
@@ -439,12 +664,129 @@ func (s *badgerStore) listRateLimits(user, id string) (map[string]*UserRateLimit
 
 }
 
-func (s *badgerStore) updateUserRateLimit(name string, limits map[string]*UserRateLimit) error {
-	val, err := json.Marshal(limits)
+// UpdateRateBucket retries on a conflict with a concurrent update
+func (s *badgerStore) UpdateRateBucket(key string, update func(b *RateBucket) error) error {
+	for {
+		err := s.update(func(txn *badger.Txn) error {
+			b := &RateBucket{Key: key}
+			item, err := txn.Get(s.rateBucketKey(key))
+			if err == nil {
+				err = item.Value(func(val []byte) error {
+					return json.Unmarshal(val, b)
+				})
+			}
+			if err != nil && !xerrors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			if err = update(b); err != nil {
+				return err
+			}
+			val, err := json.Marshal(b)
+			if err != nil {
+				return err
+			}
+			return txn.Set(s.rateBucketKey(key), val)
+		})
+		if !xerrors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (s *badgerStore) PutSigningKey(key *SigningKey) error {
+	val, err := key.Bytes()
 	if err != nil {
 		return err
 	}
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(s.rateLimitKey(name), val)
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Set(s.signKey(key.Kid), val)
+	})
+}
+
+func (s *badgerStore) ListSigningKeys() ([]*SigningKey, error) {
+	var keys []*SigningKey
+	err := s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			Prefix:         []byte(PrefixSignKey),
+		})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := new(SigningKey)
+			if err := it.Item().Value(key.FromBytes); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreateTime.Equal(keys[j].CreateTime) {
+			return keys[i].CreateTime.Before(keys[j].CreateTime)
+		}
+		return keys[i].Kid < keys[j].Kid
+	})
+	return keys, nil
+}
+
+func (s *badgerStore) Export(fn func(*Record) error) error {
+	return s.view(func(txn *badger.Txn) error {
+		scan := func(prefix Prefix, each func(val []byte) error) error {
+			it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte(prefix)})
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				if err := it.Item().Value(each); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := scan(PrefixSignKey, func(val []byte) error {
+			key := new(SigningKey)
+			if err := key.FromBytes(val); err != nil {
+				return err
+			}
+			return fn(&Record{SigningKey: key})
+		}); err != nil {
+			return err
+		}
+		if err := scan(PrefixUser, func(val []byte) error {
+			user := new(User)
+			if err := user.FromBytes(val); err != nil {
+				return err
+			}
+			return fn(&Record{User: user})
+		}); err != nil {
+			return err
+		}
+		if err := scan(PrefixToken, func(val []byte) error {
+			kp := new(KeyPair)
+			if err := kp.FromBytes(val); err != nil {
+				return err
+			}
+			return fn(&Record{Token: kp})
+		}); err != nil {
+			return err
+		}
+		return scan(PrefixReqLimit, func(val []byte) error {
+			var limits map[string]*UserRateLimit
+			if err := json.Unmarshal(val, &limits); err != nil {
+				return err
+			}
+			ids := make([]string, 0, len(limits))
+			for id := range limits {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				if err := fn(&Record{RateLimit: limits[id]}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
 	})
 }
@@ -6,8 +6,31 @@ const (
 	PrefixToken    Prefix = "TOKEN:"
 	PrefixUser     Prefix = "USER:"
 	PrefixReqLimit Prefix = "ReqLimit:"
+	PrefixSignKey  Prefix = "SIGNKEY:"
+	// PrefixRateBucket keys the token buckets of rate limits
+	PrefixRateBucket Prefix = "RateBucket:"
+	// PrefixMiner indexes the user a miner belongs to
+	PrefixMiner Prefix = "MINER:"
+	PrefixMeta  Prefix = "META:"
+	// PrefixMigration records the applied migrations by version
+	PrefixMigration Prefix = PrefixMeta + "migration:"
 )
 
+// metaMinerIndex is set once the miner index is built
+const metaMinerIndex = PrefixMeta + "miner-index"
+
+func (s *badgerStore) minerKey(maddr string) []byte {
+	return []byte(PrefixMiner + maddr)
+}
+
+func (s *badgerStore) rateBucketKey(key string) []byte {
+	return []byte(PrefixRateBucket + key)
+}
+
+func (s *badgerStore) signKey(kid string) []byte {
+	return []byte(PrefixSignKey + kid)
+}
+
 func (s *badgerStore) rateLimitKey(name string) []byte {
 	return []byte(PrefixReqLimit + name)
 }
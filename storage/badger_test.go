@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func newTestBadgerStore(t testing.TB) (*badgerStore, func()) {
+	dir, err := ioutil.TempDir("", "badger-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBadgerStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := store.(*badgerStore)
+	return bs, func() {
+		_ = bs.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func testMiner(t testing.TB, id int) address.Address {
+	maddr, err := address.NewIDAddress(uint64(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return maddr
+}
+
+func TestBadgerMinerIndex(t *testing.T) {
+	store, clean := newTestBadgerStore(t)
+	defer clean()
+
+	for _, name := range []string{"user1", "user2"} {
+		assert.NoError(t, store.PutUser(&User{Id: name, Name: name, CreateTime: time.Now()}))
+	}
+	m1, m2 := testMiner(t, 1001), testMiner(t, 1002)
+	assert.NoError(t, store.AddMiner("user1", m1))
+	assert.NoError(t, store.AddMiner("user1", m2))
+	assert.Error(t, store.AddMiner("user2", m1), "a miner can't be bound to two users")
+	// a user written with a miner of another user is rejected as well
+	assert.Error(t, store.db.Update(func(txn *badger.Txn) error {
+		return store.putUser(txn, &User{Id: "user2", Name: "user2", Miners: []string{m2.String()}})
+	}))
+
+	user, err := store.GetMiner(m2)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", user.Name)
+	assert.NoError(t, store.DelMiner("user1", m2))
+	has, err := store.HasMiner(m2)
+	assert.NoError(t, err)
+	assert.False(t, has)
+	assert.NoError(t, store.AddMiner("user2", m2))
+
+	// the index is rebuilt on open when it's missing, whatever the schema version of the db
+	_, err = Migrate(store, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, store.db.DropPrefix([]byte(PrefixMiner), []byte(metaMinerIndex)))
+	has, err = store.HasMiner(m1)
+	assert.NoError(t, err)
+	assert.False(t, has)
+	dir := store.db.Opts().Dir
+	assert.NoError(t, store.Close())
+	reopened, err := newBadgerStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = reopened.(*badgerStore)
+	defer store.Close() // nolint
+	for m, name := range map[address.Address]string{m1: "user1", m2: "user2"} {
+		user, err := store.GetMiner(m)
+		assert.NoError(t, err)
+		assert.Equal(t, name, user.Name)
+	}
+
+	assert.NoError(t, store.DelUser("user2"))
+	has, err = store.HasMiner(m2)
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestBadgerRateBucket(t *testing.T) {
+	store, clean := newTestBadgerStore(t)
+	defer clean()
+
+	// the concurrent updates conflict, and are retried
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.UpdateRateBucket("user1/l1", func(b *RateBucket) error {
+				b.Tokens++
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, store.UpdateRateBucket("user1/l1", func(b *RateBucket) error {
+		assert.Equal(t, float64(20), b.Tokens)
+		return nil
+	}))
+}
+
+func TestBadgerRateLimits(t *testing.T) {
+	store, clean := newTestBadgerStore(t)
+	defer clean()
+
+	limits, err := store.GetRateLimits("user1", "")
+	assert.NoError(t, err)
+	assert.Len(t, limits, 0)
+
+	limit := ReqLimit{Cap: 10, ResetDur: time.Minute}
+	id1, err := store.PutRateLimit(&UserRateLimit{Name: "user1", API: "ChainHead", ReqLimit: limit})
+	assert.NoError(t, err)
+	id2, err := store.PutRateLimit(&UserRateLimit{Name: "user1", API: "MpoolPush", ReqLimit: limit})
+	assert.NoError(t, err)
+	_, err = store.PutRateLimit(&UserRateLimit{Id: id1, Name: "user2", ReqLimit: limit})
+	assert.Error(t, err, "the id belongs to user1")
+	_, err = store.PutRateLimit(&UserRateLimit{ReqLimit: limit})
+	assert.Error(t, err)
+
+	assert.NoError(t, store.DelRateLimit("user1", id1))
+	limits, err = store.GetRateLimits("user1", "")
+	assert.NoError(t, err)
+	assert.Len(t, limits, 1)
+	assert.Equal(t, id2, limits[0].Id)
+	assert.NoError(t, store.DelRateLimit("user2", id2))
+}
+
+// go test ./storage -run none -bench BadgerGetMiner -benchtime 2000x
+const benchUsers = 10000
+
+func benchBadgerStore(b *testing.B) (*badgerStore, func()) {
+	store, clean := newTestBadgerStore(b)
+	for i := 0; i < benchUsers; i++ {
+		name := fmt.Sprintf("user%d", i)
+		if err := store.PutUser(&User{Id: name, Name: name, CreateTime: time.Now()}); err != nil {
+			b.Fatal(err)
+		}
+		if err := store.AddMiner(name, testMiner(b, 10000+i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return store, clean
+}
+
+// scanMinerOwner is the lookup before the miner index, it decodes every user
+func scanMinerOwner(txn *badger.Txn, maddr address.Address) (*User, error) {
+	it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte(PrefixUser)})
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		user := new(User)
+		if err := it.Item().Value(func(v []byte) error {
+			return user.FromBytes(v)
+		}); err != nil {
+			return nil, err
+		}
+		if user.HasMiner(maddr.String()) {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func BenchmarkBadgerGetMiner(b *testing.B) {
+	store, clean := benchBadgerStore(b)
+	defer clean()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetMiner(testMiner(b, 10000+i%benchUsers)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBadgerGetMinerScan(b *testing.B) {
+	store, clean := benchBadgerStore(b)
+	defer clean()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := store.db.View(func(txn *badger.Txn) error {
+			user, err := scanMinerOwner(txn, testMiner(b, 10000+i%benchUsers))
+			if user == nil && err == nil {
+				return fmt.Errorf("miner not found")
+			}
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBadgerUnavailable(t *testing.T) {
+	store, clean := newTestBadgerStore(t)
+	defer clean()
+
+	assert.NoError(t, store.Close())
+	_, err := store.GetUser("user1")
+	assert.True(t, xerrors.Is(err, ErrUnavailable), err)
+	assert.False(t, xerrors.Is(err, ErrNotFound))
+	select {
+	case <-store.gcDone:
+	default:
+		t.Fatal("the value log GC is stopped by Close")
+	}
+	assert.NoError(t, store.Close(), "closing again does nothing")
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	"golang.org/x/xerrors"
+)
+
+// CopySummary counts the records of a Copy
+type CopySummary struct {
+	// Copied are written to the destination, or would be in a dry run
+	Copied BackupSummary
+	// Existing are in the destination already, they are skipped
+	Existing BackupSummary
+	// Conflicts are the records which differ in the destination, they are left as they are
+	Conflicts []string
+}
+
+// Copy writes the records of src which are missing in dst, the secrets are copied as they are stored.
+// A record of dst is never changed, so the copy can be run again, e.g. after new records are written to src.
+// Nothing is written in a dry run.
+func Copy(src, dst Store, dryRun bool) (*CopySummary, error) {
+	idx, err := indexStore(dst)
+	if err != nil {
+		return nil, xerrors.Errorf("read destination: %w", err)
+	}
+	sum := new(CopySummary)
+	err = src.Export(func(r *Record) error {
+		return idx.copy(dst, r, sum, dryRun)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+// storeIndex holds the records of a store by key
+type storeIndex struct {
+	keys   map[string]*SigningKey
+	users  map[string]*User
+	miners map[string]string
+	tokens map[TokenHash]*KeyPair
+	limits map[string]*UserRateLimit
+	// skipped are the users of src which are other users in dst, by name,
+	// their tokens and rate limits are not copied, the users are exported before them
+	skipped map[string]bool
+}
+
+func indexStore(s Store) (*storeIndex, error) {
+	idx := &storeIndex{
+		keys:    make(map[string]*SigningKey),
+		users:   make(map[string]*User),
+		miners:  make(map[string]string),
+		tokens:  make(map[TokenHash]*KeyPair),
+		limits:  make(map[string]*UserRateLimit),
+		skipped: make(map[string]bool),
+	}
+	return idx, s.Export(func(r *Record) error {
+		idx.add(r)
+		return nil
+	})
+}
+
+func (idx *storeIndex) add(r *Record) {
+	switch {
+	case r.SigningKey != nil:
+		idx.keys[r.SigningKey.Kid] = r.SigningKey
+	case r.User != nil:
+		idx.users[r.User.Name] = r.User
+		for _, m := range r.User.Miners {
+			idx.miners[m] = r.User.Name
+		}
+	case r.Token != nil:
+		idx.tokens[r.Token.Hash] = r.Token
+	case r.RateLimit != nil:
+		idx.limits[r.RateLimit.Id] = r.RateLimit
+	}
+}
+
+func (idx *storeIndex) copy(dst Store, r *Record, sum *CopySummary, dryRun bool) error {
+	conflict := func(format string, args ...interface{}) {
+		sum.Conflicts = append(sum.Conflicts, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case r.SigningKey != nil:
+		k := r.SigningKey
+		if old, ok := idx.keys[k.Kid]; ok {
+			if old.Alg != k.Alg || old.PrivateKey != k.PrivateKey {
+				conflict("signing key %s differs", k.Kid)
+			} else {
+				sum.Existing.SigningKeys++
+			}
+			return nil
+		}
+		sum.Copied.SigningKeys++
+		if !dryRun {
+			return dst.PutSigningKey(k)
+		}
+	case r.User != nil:
+		return idx.copyUser(dst, r.User, sum, dryRun, conflict)
+	case r.Token != nil:
+		kp := r.Token
+		if idx.skipped[kp.Name] {
+			conflict("token %s of user %s is skipped, the user differs", kp.Hash, kp.Name)
+			return nil
+		}
+		if old, ok := idx.tokens[kp.Hash]; ok {
+			if old.Name != kp.Name || old.Secret != kp.Secret || old.Kid != kp.Kid {
+				conflict("token %s of %s differs", kp.Hash, kp.Name)
+			} else {
+				sum.Existing.Tokens++
+			}
+			return nil
+		}
+		sum.Copied.Tokens++
+		if !dryRun {
+			return dst.Put(kp)
+		}
+	case r.RateLimit != nil:
+		l := r.RateLimit
+		if idx.skipped[l.Name] {
+			conflict("rate limit %s of user %s is skipped, the user differs", l.Id, l.Name)
+			return nil
+		}
+		if old, ok := idx.limits[l.Id]; ok {
+			if old.Name != l.Name || old.Service != l.Service || old.API != l.API || old.ReqLimit != l.ReqLimit {
+				conflict("rate limit %s of user %s differs", l.Id, l.Name)
+			} else {
+				sum.Existing.RateLimits++
+			}
+			return nil
+		}
+		sum.Copied.RateLimits++
+		if !dryRun {
+			_, err := dst.PutRateLimit(l)
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUser copies the user if it's missing, then its miners which belong to nobody in dst.
+// A user of the name which differs in dst is skipped along with its miners, tokens and rate limits.
+func (idx *storeIndex) copyUser(dst Store, user *User, sum *CopySummary, dryRun bool, conflict func(string, ...interface{})) error {
+	if old, ok := idx.users[user.Name]; ok {
+		if old.Id != user.Id {
+			conflict("user %s differs, its id is %s instead of %s", user.Name, old.Id, user.Id)
+			idx.skipped[user.Name] = true
+			for _, m := range user.Miners {
+				conflict("miner %s of user %s is skipped, the user differs", m, user.Name)
+			}
+			return nil
+		}
+		sum.Existing.Users++
+	} else {
+		sum.Copied.Users++
+		if !dryRun {
+			if err := dst.PutUser(user); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range user.Miners {
+		owner, ok := idx.miners[m]
+		switch {
+		case ok && owner == user.Name:
+			sum.Existing.Miners++
+		case ok:
+			conflict("miner %s of user %s belongs to user %s", m, user.Name, owner)
+		default:
+			sum.Copied.Miners++
+			if dryRun {
+				continue
+			}
+			maddr, err := address.NewFromString(m)
+			if err != nil {
+				return xerrors.Errorf("miner %s of user %s: %w", m, user.Name, err)
+			}
+			if err = dst.AddMiner(user.Name, maddr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/config"
+	"github.com/filecoin-project/venus-auth/log"
+)
+
+// prefix of an encrypted value: enc:<kek id>:<base64 of nonce and ciphertext>
+const encPrefix = "enc:"
+
+var ErrNoKEK = xerrors.New("the secret is encrypted, but no key-encryption key is configured")
+
+// KEK is a key-encryption key protecting the secrets at rest with AES-256-GCM
+type KEK struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func NewKEK(key []byte) (*KEK, error) {
+	if len(key) != 32 {
+		return nil, xerrors.Errorf("key-encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte("venus-auth kek:"), key...))
+	return &KEK{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// ID identifies the key in the encrypted values, without revealing it
+func (k *KEK) ID() string {
+	return k.id
+}
+
+// encrypt seals the value, ad binds it to its record so that it can't be copied to another one
+func (k *KEK) encrypt(value, ad string) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(value), []byte(ad))
+	return encPrefix + k.id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *KEK) decrypt(sealed []byte, ad string) (string, error) {
+	ns := k.aead.NonceSize()
+	if len(sealed) < ns {
+		return "", xerrors.New("encrypted value is too short")
+	}
+	plain, err := k.aead.Open(nil, sealed[:ns], sealed[ns:], []byte(ad))
+	if err != nil {
+		return "", xerrors.Errorf("decrypt with key-encryption key %s: %w", k.id, err)
+	}
+	return string(plain), nil
+}
+
+// IsEncrypted reports whether the stored value is encrypted
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encPrefix)
+}
+
+// encryptedStore encrypts the token secrets and signing keys before they reach the wrapped store,
+// and decrypts them on the way back. Values written before encryption was enabled are read as is.
+type encryptedStore struct {
+	Store
+	current *KEK
+	keks    map[string]*KEK
+}
+
+// NewEncryptedStore wraps the store, new values are encrypted with current,
+// old keys are only used to read the values not re-encrypted yet.
+// A nil current keeps writing plain values, and fails to read the encrypted ones with ErrNoKEK.
+func NewEncryptedStore(store Store, current *KEK, old ...*KEK) Store {
+	s := &encryptedStore{Store: store, current: current, keks: make(map[string]*KEK)}
+	for _, k := range append(old, current) {
+		if k != nil {
+			s.keks[k.id] = k
+		}
+	}
+	return s
+}
+
+func (s *encryptedStore) seal(value, ad string) (string, error) {
+	if s.current == nil || len(value) == 0 {
+		return value, nil
+	}
+	return s.current.encrypt(value, ad)
+}
+
+func (s *encryptedStore) open(value, ad string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if len(s.keks) == 0 {
+		return "", ErrNoKEK
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", xerrors.New("malformed encrypted value")
+	}
+	kek, ok := s.keks[parts[0]]
+	if !ok {
+		return "", xerrors.Errorf("encrypted by an unknown key-encryption key %s", parts[0])
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", xerrors.Errorf("decode encrypted value: %w", err)
+	}
+	return kek.decrypt(sealed, ad)
+}
+
+// stale reports whether the value has to be re-encrypted with the current key
+func (s *encryptedStore) stale(value string) bool {
+	if s.current == nil || len(value) == 0 {
+		return false
+	}
+	return !strings.HasPrefix(value, encPrefix+s.current.id+":")
+}
+
+func (s *encryptedStore) sealKeyPair(kp *KeyPair) (*KeyPair, error) {
+	sealed := *kp
+	var err error
+	if sealed.Secret, err = s.seal(kp.Secret, kp.Hash.String()); err != nil {
+		return nil, xerrors.Errorf("encrypt secret of token %s: %w", kp.Hash, err)
+	}
+	return &sealed, nil
+}
+
+func (s *encryptedStore) openKeyPair(kp *KeyPair) error {
+	var err error
+	if kp.Secret, err = s.open(kp.Secret, kp.Hash.String()); err != nil {
+		return xerrors.Errorf("decrypt secret of token %s: %w", kp.Hash, err)
+	}
+	return nil
+}
+
+func (s *encryptedStore) Get(hash TokenHash) (*KeyPair, error) {
+	kp, err := s.Store.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.openKeyPair(kp); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+func (s *encryptedStore) Put(kp *KeyPair) error {
+	sealed, err := s.sealKeyPair(kp)
+	if err != nil {
+		return err
+	}
+	return s.Store.Put(sealed)
+}
+
+func (s *encryptedStore) UpdateToken(kp *KeyPair) error {
+	sealed, err := s.sealKeyPair(kp)
+	if err != nil {
+		return err
+	}
+	return s.Store.UpdateToken(sealed)
+}
+
+func (s *encryptedStore) List(skip, limit int64) ([]*KeyPair, error) {
+	kps, err := s.Store.List(skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, kp := range kps {
+		if err = s.openKeyPair(kp); err != nil {
+			return nil, err
+		}
+	}
+	return kps, nil
+}
+
+func (s *encryptedStore) ListByName(name string, skip, limit int64) ([]*KeyPair, error) {
+	kps, err := s.Store.ListByName(name, skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, kp := range kps {
+		if err = s.openKeyPair(kp); err != nil {
+			return nil, err
+		}
+	}
+	return kps, nil
+}
+
+func (s *encryptedStore) PutSigningKey(key *SigningKey) error {
+	sealed := *key
+	var err error
+	if sealed.PrivateKey, err = s.seal(key.PrivateKey, key.Kid); err != nil {
+		return xerrors.Errorf("encrypt signing key %s: %w", key.Kid, err)
+	}
+	return s.Store.PutSigningKey(&sealed)
+}
+
+func (s *encryptedStore) ListSigningKeys() ([]*SigningKey, error) {
+	keys, err := s.Store.ListSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.PrivateKey, err = s.open(k.PrivateKey, k.Kid); err != nil {
+			return nil, xerrors.Errorf("decrypt signing key %s: %w", k.Kid, err)
+		}
+	}
+	return keys, nil
+}
+
+// WithEncryption wraps the store with the key-encryption key set in the config,
+// old keys are hex encoded and only used for decryption.
+func WithEncryption(store Store, cnf *config.EncryptionConfig, old ...string) (Store, error) {
+	key, err := cnf.LoadKEK()
+	if err != nil {
+		return nil, err
+	}
+	var current *KEK
+	if key != nil {
+		if current, err = NewKEK(key); err != nil {
+			return nil, err
+		}
+	}
+	olds := make([]*KEK, 0, len(old))
+	for _, o := range old {
+		key, err := config.DecodeKEK(o)
+		if err != nil {
+			return nil, err
+		}
+		kek, err := NewKEK(key)
+		if err != nil {
+			return nil, err
+		}
+		olds = append(olds, kek)
+	}
+	return NewEncryptedStore(store, current, olds...), nil
+}
+
+// ReEncrypt rewrites the token secrets and signing keys which are plain or encrypted by an old key
+// with the current key, it returns the number of tokens and keys rewritten.
+func ReEncrypt(store Store) (tokens, keys int, err error) {
+	s, ok := store.(*encryptedStore)
+	if !ok || s.current == nil {
+		return 0, 0, xerrors.New("no key-encryption key to re-encrypt with")
+	}
+
+	skip, limit := int64(0), int64(100)
+	for {
+		kps, err := s.Store.List(skip, limit)
+		if err != nil {
+			return tokens, keys, xerrors.Errorf("list token: %w", err)
+		}
+		for _, kp := range kps {
+			if !s.stale(kp.Secret) {
+				continue
+			}
+			if err = s.openKeyPair(kp); err != nil {
+				return tokens, keys, err
+			}
+			if err = s.UpdateToken(kp); err != nil {
+				return tokens, keys, xerrors.Errorf("update token %s: %w", kp.Hash, err)
+			}
+			tokens++
+		}
+		if int64(len(kps)) < limit {
+			break
+		}
+		skip += limit
+	}
+
+	sks, err := s.Store.ListSigningKeys()
+	if err != nil {
+		return tokens, keys, xerrors.Errorf("list signing keys: %w", err)
+	}
+	for _, k := range sks {
+		if !s.stale(k.PrivateKey) {
+			continue
+		}
+		if k.PrivateKey, err = s.open(k.PrivateKey, k.Kid); err != nil {
+			return tokens, keys, xerrors.Errorf("decrypt signing key %s: %w", k.Kid, err)
+		}
+		if err = s.PutSigningKey(k); err != nil {
+			return tokens, keys, err
+		}
+		keys++
+	}
+	log.Infof("re-encrypted %d token secrets and %d signing keys with key-encryption key %s", tokens, keys, s.current.id)
+	return tokens, keys, nil
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func randKEK(t *testing.T) *KEK {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	kek, err := NewKEK(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kek
+}
+
+// rawValues returns every value in the badger dir, as it's written on disk
+func rawValues(t *testing.T, dir string) [][]byte {
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint
+	var vals [][]byte
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			vals = append(vals, val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vals
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := "88b8a61690ee648bef9bc73463b8a05917f1916df169c775a3896719466be04a"
+	privateKey := "302e020100300506032b657004220420a6e1d5cb7f1f4c0e3c6ffb0a8f4a3b9d2c1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a"
+	plain := &KeyPair{Name: "plain", Perm: "read", Secret: secret, Hash: Token("plain.token.sig").Hash(), CreateTime: time.Now()}
+	sealed := &KeyPair{Name: "sealed", Perm: "read", Secret: secret, Hash: Token("sealed.token.sig").Hash(), CreateTime: time.Now()}
+
+	raw, err := newBadgerStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written before encryption was enabled
+	assert.NoError(t, raw.Put(plain))
+
+	oldKEK := randKEK(t)
+	store := NewEncryptedStore(raw, oldKEK)
+	assert.NoError(t, store.Put(sealed))
+	assert.NoError(t, store.PutSigningKey(&SigningKey{Kid: "k1", Alg: "Ed25519", PrivateKey: privateKey, CreateTime: time.Now()}))
+
+	stored, err := raw.Get(sealed.Hash)
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(stored.Secret))
+	kp, err := store.Get(sealed.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, secret, kp.Secret)
+	kp, err = store.Get(plain.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, secret, kp.Secret)
+	keys, err := store.ListSigningKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, keys[0].PrivateKey)
+
+	// a secret copied to another token can't be decrypted
+	plainStored, err := raw.Get(plain.Hash)
+	assert.NoError(t, err)
+	plainStored.Secret = stored.Secret
+	assert.NoError(t, raw.UpdateToken(plainStored))
+	_, err = store.Get(plain.Hash)
+	assert.Error(t, err)
+	assert.NoError(t, store.UpdateToken(plain))
+
+	// rotate the key-encryption key, plain values are encrypted as well
+	newKEK := randKEK(t)
+	tokens, signKeys, err := ReEncrypt(NewEncryptedStore(raw, newKEK, oldKEK))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tokens)
+	assert.Equal(t, 1, signKeys)
+
+	_, err = NewEncryptedStore(raw, oldKEK).Get(sealed.Hash)
+	assert.Error(t, err, "the old key must be useless after re-encryption")
+	_, err = NewEncryptedStore(raw, nil).Get(sealed.Hash)
+	assert.True(t, xerrors.Is(err, ErrNoKEK))
+	store = NewEncryptedStore(raw, newKEK)
+	kps, err := store.List(0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, kps, 2)
+	for _, kp := range kps {
+		assert.Equal(t, secret, kp.Secret)
+	}
+
+	assert.NoError(t, raw.(*badgerStore).db.Close())
+	for _, val := range rawValues(t, dir) {
+		assert.False(t, bytes.Contains(val, []byte(secret)), "token secret is stored in plain")
+		assert.False(t, bytes.Contains(val, []byte(privateKey)), "signing key is stored in plain")
+	}
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "gorm.io/gorm"
+
+// ResetStore removes every record of a sql db shared by the tests
+func ResetStore(s Store) error {
+	st, ok := s.(*mysqlStore)
+	if !ok {
+		return nil
+	}
+	for _, model := range sqlModels {
+		if err := st.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
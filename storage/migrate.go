@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/filecoin-project/go-address"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+
+	"github.com/filecoin-project/venus-auth/log"
+)
+
+// legacyKeyPair holds the bearer token of records stored before tokens were kept by hash
+type legacyKeyPair struct {
+	Token Token
+}
+
+// migrateTokenHash moves token records keyed by the bearer token to keys by its hash,
+// records already migrated are left untouched, so it's safe to run again.
+func (s *badgerStore) migrateTokenHash() error {
+	var legacyKeys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte(PrefixToken)})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			// hex encoded hashes never contain the separator of jwt
+			if bytes.Contains(it.Item().Key(), []byte(".")) {
+				legacyKeys = append(legacyKeys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range legacyKeys {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var legacy legacyKeyPair
+			if err = json.Unmarshal(val, &legacy); err != nil {
+				return err
+			}
+			kp := new(KeyPair)
+			if err = kp.FromBytes(val); err != nil {
+				return err
+			}
+			kp.Hash, kp.Prefix = legacy.Token.Hash(), legacy.Token.Prefix()
+			if val, err = kp.Bytes(); err != nil {
+				return err
+			}
+			if err = txn.Set(s.tokenKey(kp.Hash.String()), val); err != nil {
+				return err
+			}
+			return txn.Delete(key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(legacyKeys) > 0 {
+		log.Infof("%d tokens are migrated to be stored by hash", len(legacyKeys))
+	}
+	return nil
+}
+
+// migrateTokenHash replaces the bearer tokens in the token column with their hashes,
+// records already migrated are left untouched, so it's safe to run again.
+func (s *mysqlStore) migrateTokenHash() error {
+	count := 0
+	for {
+		var tokens []string
+		// hex encoded hashes never contain the separator of jwt
+		err := s.db.Table("token").Where("token LIKE ?", "%.%").Limit(100).Pluck("token", &tokens).Error
+		if err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			break
+		}
+		for _, t := range tokens {
+			tk := Token(t)
+			err = s.db.Table("token").Where("token = ?", t).
+				UpdateColumns(map[string]interface{}{"token": tk.Hash(), "prefix": tk.Prefix()}).Error
+			if err != nil {
+				return err
+			}
+		}
+		count += len(tokens)
+	}
+	if count > 0 {
+		log.Infof("%d tokens are migrated to be stored by hash", count)
+	}
+	return nil
+}
+
+// migrateUserMiners moves the single miner of users into the miners relation, the miner column is cleared,
+// so it's safe to run again. A miner found in several users is kept by the first one.
+func (s *badgerStore) migrateUserMiners() error {
+	var legacy []*User
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte(PrefixUser)})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			user := new(User)
+			if err := it.Item().Value(func(v []byte) error {
+				return user.FromBytes(v)
+			}); err != nil {
+				return err
+			}
+			if len(user.Miner) > 0 {
+				legacy = append(legacy, user)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, u := range legacy {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			maddr, err := address.NewFromString(u.Miner)
+			if err != nil {
+				log.Warnf("user %s has an invalid miner %s, drop it: %s", u.Name, u.Miner, err)
+			} else if owner, err := s.minerOwner(txn, maddr); err != nil {
+				return err
+			} else if owner != nil && owner.Name != u.Name {
+				log.Warnf("miner %s of user %s already belongs to user %s, drop it", u.Miner, u.Name, owner.Name)
+			} else if owner == nil {
+				u.Miners = append(u.Miners, maddr.String())
+			}
+			u.Miner = ""
+			return s.putUser(txn, u)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(legacy) > 0 {
+		log.Infof("miners of %d users are migrated to the miners relation", len(legacy))
+	}
+	return nil
+}
+
+// migrateUserMiners copies the miner column of users into the user_miners relation, the miner column is cleared,
+// so it's safe to run again. A miner found in several users is kept by the first one.
+func (s *mysqlStore) migrateUserMiners() error {
+	var legacy []*User
+	if err := s.db.Table("users").Where("miner <> ''").Order(orderByCreateTime).Find(&legacy).Error; err != nil {
+		return err
+	}
+	for _, u := range legacy {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var owners []string
+			if err := tx.Table("user_miners").Where("miner = ?", u.Miner).Pluck("name", &owners).Error; err != nil {
+				return err
+			}
+			if len(owners) == 0 {
+				err := tx.Table("user_miners").Create(&UserMiner{Miner: u.Miner, Name: u.Name, CreateTime: u.CreateTime}).Error
+				if err != nil {
+					return err
+				}
+			} else if owners[0] != u.Name {
+				log.Warnf("miner %s of user %s already belongs to user %s, drop it", u.Miner, u.Name, owners[0])
+			}
+			return tx.Table("users").Where("name = ?", u.Name).UpdateColumn("miner", "").Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(legacy) > 0 {
+		log.Infof("miners of %d users are migrated to the user_miners relation", len(legacy))
+	}
+	return nil
+}
+
+// ensureMinerIndex builds the miner index when it's missing, for dbs created before the index,
+// or after the index keys are lost. It runs on every open, apart from the numbered migrations,
+// and does nothing once the index is built. A miner found in several users is kept by the first one.
+func (s *badgerStore) ensureMinerIndex() error {
+	built := false
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(metaMinerIndex))
+		if err == nil {
+			built = true
+			return nil
+		}
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil || built {
+		return err
+	}
+	if err = s.db.DropPrefix([]byte(PrefixMiner)); err != nil {
+		return err
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	owners := make(map[string]string)
+	err = s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte(PrefixUser)})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			user := new(User)
+			if err := it.Item().Value(func(v []byte) error {
+				return user.FromBytes(v)
+			}); err != nil {
+				return err
+			}
+			miners := make([]string, 0, len(user.Miners))
+			for _, m := range user.Miners {
+				if owner, ok := owners[m]; ok {
+					log.Warnf("miner %s of user %s already belongs to user %s, drop it", m, user.Name, owner)
+					continue
+				}
+				owners[m] = user.Name
+				miners = append(miners, m)
+				if err := wb.Set(s.minerKey(m), []byte(user.Name)); err != nil {
+					return err
+				}
+			}
+			if len(miners) != len(user.Miners) {
+				user.Miners = miners
+				val, err := user.Bytes()
+				if err != nil {
+					return err
+				}
+				if err = wb.Set(s.userKey(user.Name), val); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = wb.Set([]byte(metaMinerIndex), []byte{1}); err != nil {
+		return err
+	}
+	if err = wb.Flush(); err != nil {
+		return err
+	}
+	log.Infof("miner index is built for %d miners", len(owners))
+	return nil
+}
+
+// migrateMasterKid gives the kid of the master secret to the tokens which have neither a secret nor a kid,
+// they were signed by the master secret, which is now a key of the keyring.
+func migrateMasterKid(s Store, opts *MigrateOptions) error {
+	count := 0
+	skip, limit := int64(0), int64(100)
+	for {
+		kps, err := s.List(skip, limit)
+		if err != nil {
+			return err
+		}
+		for _, kp := range kps {
+			if len(kp.Secret) > 0 || len(kp.Kid) > 0 {
+				continue
+			}
+			if len(opts.MasterKid) == 0 {
+				return xerrors.Errorf("token %s of %s needs the kid of the master secret, migrate with the config of the daemon", kp.Hash, kp.Name)
+			}
+			kp.Kid = opts.MasterKid
+			if err = s.UpdateToken(kp); err != nil {
+				return xerrors.Errorf("update token %s: %w", kp.Hash, err)
+			}
+			count++
+		}
+		if len(kps) < int(limit) {
+			break
+		}
+		skip += limit
+	}
+	if count > 0 {
+		log.Infof("%d tokens are given the kid %s of the master secret", count, opts.MasterKid)
+	}
+	return nil
+}
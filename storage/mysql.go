@@ -1,19 +1,31 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"math"
+	"net"
+	"time"
+
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/venus-auth/config"
 	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/errcode"
 	"github.com/filecoin-project/venus-auth/util"
 	"github.com/google/uuid"
 	"golang.org/x/xerrors"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// mysqlStore is the gorm implementation of Store, sqlite and postgres share it
 type mysqlStore struct {
-	db  *gorm.DB
-	pkg string
+	db *gorm.DB
+	// schema creates the tables, with the table options of the db
+	schema *gorm.DB
+	pkg    string
 }
 
 func newMySQLStore(cnf *config.DBConfig) (Store, error) {
@@ -21,7 +33,7 @@ func newMySQLStore(cnf *config.DBConfig) (Store, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("[db connection failed] Database name: %s %w", cnf.DSN, err)
 	}
-	if cnf.Debug || true {
+	if cnf.Debug {
 		db = db.Debug()
 	}
 	sqlDB, err := db.DB()
@@ -56,40 +68,125 @@ func newMySQLStore(cnf *config.DBConfig) (Store, error) {
 		}
 	}
 
-	if err = session.AutoMigrate(&KeyPair{}, &User{}, &UserRateLimit{}); err != nil {
-		return nil, err
+	return openSQLStore(db, session)
+}
+
+// sqlModels are the tables of the sql dbs
+var sqlModels = []interface{}{&KeyPair{}, &User{}, &UserRateLimit{}, &SigningKey{}, &UserMiner{}, &RateBucket{}}
+
+// orderByCreateTime quotes the column, postgres folds the unquoted names to lower case
+var orderByCreateTime = clause.OrderByColumn{Column: clause.Column{Name: "createTime"}}
+
+// paginate skips the first skip records, a limit of zero takes all the rest,
+// since mysql doesn't take an offset without a limit.
+func paginate(db *gorm.DB, skip, limit int64) *gorm.DB {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	return db.Offset(int(skip)).Limit(int(limit))
+}
+
+// notFound wraps ErrNotFound for gorm.ErrRecordNotFound
+func notFound(err error, format string, args ...interface{}) error {
+	if xerrors.Is(err, gorm.ErrRecordNotFound) {
+		return xerrors.Errorf(format+": %w", append(args, ErrNotFound)...)
+	}
+	return err
+}
+
+// sqlError wraps ErrUnavailable for the errors of reaching the db
+func sqlError(err error) error {
+	if err == nil || xerrors.Is(err, ErrUnavailable) {
+		return err
+	}
+	var netErr net.Error
+	if xerrors.Is(err, driver.ErrBadConn) || xerrors.Is(err, sql.ErrConnDone) ||
+		xerrors.Is(err, context.DeadlineExceeded) || xerrors.As(err, &netErr) {
+		return errcode.Wrap(ErrUnavailable, err)
+	}
+	return err
+}
+
+// registerErrorCallbacks classifies the errors of every statement by sqlError
+func registerErrorCallbacks(db *gorm.DB) error {
+	classify := func(db *gorm.DB) {
+		db.Error = sqlError(db.Error)
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Register("venus:classify_error", classify),
+		cb.Query().Register("venus:classify_error", classify),
+		cb.Update().Register("venus:classify_error", classify),
+		cb.Delete().Register("venus:classify_error", classify),
+		cb.Row().Register("venus:classify_error", classify),
+		cb.Raw().Register("venus:classify_error", classify),
+	} {
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return &mysqlStore{db: db, pkg: util.PackagePath(mysqlStore{})}, nil
+func (s *mysqlStore) transaction(fc func(tx *gorm.DB) error) error {
+	return sqlError(s.db.Transaction(fc))
+}
+
+// openSQLStore keeps session to create the tables by Migrate, it may carry the table options of the db,
+// the gorm models and queries are shared by the sql dbs.
+func openSQLStore(db, session *gorm.DB) (*mysqlStore, error) {
+	if err := registerErrorCallbacks(db); err != nil {
+		return nil, err
+	}
+	return &mysqlStore{db: db, schema: session, pkg: util.PackagePath(mysqlStore{})}, nil
 }
 
 func (s *mysqlStore) Put(kp *KeyPair) error {
-	return s.db.Create(kp).Error
+	return s.transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Table("token").Where("token = ?", kp.Hash.String()).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return xerrors.Errorf("token %s: %w", kp.Hash, ErrAlreadyExists)
+		}
+		return tx.Create(kp).Error
+	})
 }
 
-func (s mysqlStore) Delete(token Token) error {
-	return s.db.Table("token").Delete(&KeyPair{}, "token=?", token).Error
+func (s mysqlStore) Delete(hash TokenHash) error {
+	return s.db.Table("token").Delete(&KeyPair{}, "token=?", hash).Error
 }
 
-func (s mysqlStore) Has(token Token) (bool, error) {
+func (s mysqlStore) Has(hash TokenHash) (bool, error) {
 	var count int64
-	err := s.db.Table("token").Where("token=?", token).Count(&count).Error
+	err := s.db.Table("token").Where("token=?", hash).Count(&count).Error
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-func (s mysqlStore) Get(token Token) (*KeyPair, error) {
+func (s mysqlStore) Get(hash TokenHash) (*KeyPair, error) {
 	var kp KeyPair
-	err := s.db.Table("token").Take(&kp, "token = ?", token.String()).Error
-
-	return &kp, err
+	if err := s.db.Table("token").Take(&kp, "token = ?", hash.String()).Error; err != nil {
+		return nil, notFound(err, "token %s", hash)
+	}
+	return &kp, nil
 }
 
 func (s mysqlStore) List(skip, limit int64) ([]*KeyPair, error) {
 	var tokens []*KeyPair
-	err := s.db.Offset(int(skip)).Limit(int(limit)).Order("name").Find(&tokens).Error
+	err := paginate(s.db, skip, limit).Order("name").Order(orderByCreateTime).Order("token").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s mysqlStore) ListByName(name string, skip, limit int64) ([]*KeyPair, error) {
+	var tokens []*KeyPair
+	err := paginate(s.db.Where("name = ?", name), skip, limit).Order(orderByCreateTime).Order("token").Find(&tokens).Error
 	if err != nil {
 		return nil, err
 	}
@@ -101,12 +198,26 @@ func (s *mysqlStore) UpdateToken(kp *KeyPair) error {
 		"name":       kp.Name,
 		"perm":       kp.Perm,
 		"secret":     kp.Secret,
+		"kid":        kp.Kid,
+		"user_id":    kp.UserID,
 		"extra":      kp.Extra,
-		"token":      kp.Token,
+		"token":      kp.Hash,
+		"prefix":     kp.Prefix,
 		"createTime": kp.CreateTime,
+		"expireAt":   kp.ExpireAt,
+		"notBefore":  kp.NotBefore,
 	}
-	return s.db.Table("token").Where("token = ?", kp.Token.String()).UpdateColumns(columns).Error
-
+	res := s.db.Table("token").Where("token = ?", kp.Hash.String()).UpdateColumns(columns)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// the row may be unchanged
+		if has, err := s.Has(kp.Hash); err != nil || !has {
+			return notFound(gorm.ErrRecordNotFound, "token %s", kp.Hash)
+		}
+	}
+	return nil
 }
 
 func (s mysqlStore) HasUser(name string) (bool, error) {
@@ -119,15 +230,61 @@ func (s mysqlStore) HasUser(name string) (bool, error) {
 }
 
 func (s *mysqlStore) UpdateUser(user *User) error {
-	return s.db.Table("users").Save(user).Error
+	return s.transaction(func(tx *gorm.DB) error {
+		var old User
+		if err := tx.Table("users").Take(&old, "name = ?", user.Name).Error; err != nil {
+			return notFound(err, "user %s", user.Name)
+		}
+		updated := *user
+		updated.Id = old.Id
+		return tx.Table("users").Save(&updated).Error
+	})
 }
 
 func (s *mysqlStore) PutUser(user *User) error {
-	return s.db.Table("users").Save(user).Error
+	return s.transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Table("users").Where("name = ?", user.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return xerrors.Errorf("user %s: %w", user.Name, ErrAlreadyExists)
+		}
+		return tx.Table("users").Create(user).Error
+	})
+}
+
+func (s *mysqlStore) DelUser(name string) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		res := tx.Table("users").Where("name = ?", name).Delete(nil)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return notFound(gorm.ErrRecordNotFound, "user %s", name)
+		}
+		if err := tx.Table("user_miners").Where("name = ?", name).Delete(nil).Error; err != nil {
+			return err
+		}
+		var ids []string
+		if err := tx.Table("user_rate_limits").Where("name = ?", name).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			keys := make([]string, 0, len(ids))
+			for _, id := range ids {
+				keys = append(keys, RateBucketKey(name, id))
+			}
+			if err := tx.Table("rate_buckets").Where("bucket_key in ?", keys).Delete(nil).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Table("user_rate_limits").Where("name = ?", name).Delete(nil).Error
+	})
 }
 
 func (s *mysqlStore) ListUsers(skip, limit int64, state int, sourceType core.SourceType, code core.KeyCode) ([]*User, error) {
-	exec := s.db.Table("users")
+	exec := s.db.Table("users").Where("is_deleted = ?", false)
 	if code&1 == 1 {
 		exec = exec.Where("stype=?", sourceType)
 	}
@@ -135,23 +292,51 @@ func (s *mysqlStore) ListUsers(skip, limit int64, state int, sourceType core.Sou
 		exec = exec.Where("state=?", state)
 	}
 	arr := make([]*User, 0)
-	err := exec.Order("createTime").Offset(int(skip)).Limit(int(limit)).Scan(&arr).Error
+	err := paginate(exec.Order(orderByCreateTime).Order("name"), skip, limit).Scan(&arr).Error
 	if err != nil {
 		return nil, err
 	}
-	return arr, nil
+	return arr, s.fillMiners(arr...)
+}
+
+// fillMiners loads the miners of the users from the user_miners relation
+func (s *mysqlStore) fillMiners(users ...*User) error {
+	if len(users) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	var miners []*UserMiner
+	if err := s.db.Table("user_miners").Where("name in ?", names).Order(orderByCreateTime).Find(&miners).Error; err != nil {
+		return err
+	}
+	for _, u := range users {
+		u.Miners = nil
+		for _, m := range miners {
+			if m.Name == u.Name {
+				u.Miners = append(u.Miners, m.Miner)
+			}
+		}
+	}
+	return nil
 }
 
 func (s *mysqlStore) GetUser(name string) (*User, error) {
 	var user User
-	err := s.db.Table("users").Take(&user, "name=?", name).Error
-
-	return &user, err
+	if err := s.db.Table("users").Take(&user, "name=?", name).Error; err != nil {
+		return nil, notFound(err, "user %s", name)
+	}
+	return &user, s.fillMiners(&user)
 }
 
 func (s mysqlStore) HasMiner(maddr address.Address) (bool, error) {
 	var count int64
-	err := s.db.Table("users").Where("miner=?", maddr.String()).Count(&count).Error
+	err := s.db.Table("user_miners").
+		Joins("join users on users.name = user_miners.name").
+		Where("user_miners.miner=? and users.is_deleted=?", maddr.String(), false).
+		Count(&count).Error
 	if err != nil {
 		return false, err
 	}
@@ -160,11 +345,66 @@ func (s mysqlStore) HasMiner(maddr address.Address) (bool, error) {
 
 func (s *mysqlStore) GetMiner(maddr address.Address) (*User, error) {
 	var user User
-	err := s.db.Table("users").Take(&user, "miner=?", maddr.String()).Error
+	err := s.db.Table("users").
+		Joins("join user_miners on users.name = user_miners.name").
+		Where("user_miners.miner=? and users.is_deleted=?", maddr.String(), false).
+		Select("users.*").
+		Take(&user).Error
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "miner %s", maddr)
 	}
-	return &user, nil
+	return &user, s.fillMiners(&user)
+}
+
+func (s *mysqlStore) AddMiner(name string, maddr address.Address) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Table("users").Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return notFound(gorm.ErrRecordNotFound, "user %s", name)
+		}
+		var exist []*UserMiner
+		if err := tx.Table("user_miners").Where("miner = ?", maddr.String()).Find(&exist).Error; err != nil {
+			return err
+		}
+		if len(exist) > 0 {
+			if exist[0].Name != name {
+				return xerrors.Errorf("miner %s belongs to user %s: %w", maddr, exist[0].Name, ErrAlreadyExists)
+			}
+			return nil
+		}
+		return tx.Table("user_miners").Create(&UserMiner{Miner: maddr.String(), Name: name, CreateTime: time.Now()}).Error
+	})
+}
+
+func (s *mysqlStore) DelMiner(name string, maddr address.Address) error {
+	res := s.db.Table("user_miners").Where("miner = ? and name = ?", maddr.String(), name).Delete(nil)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return notFound(gorm.ErrRecordNotFound, "miner %s of user %s", maddr, name)
+	}
+	return nil
+}
+
+func (s *mysqlStore) UpdateRateBucket(key string, update func(b *RateBucket) error) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		// the row is created first, so that the concurrent updates of a new bucket wait for each other
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&RateBucket{Key: key}).Error; err != nil {
+			return err
+		}
+		var b RateBucket
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(&b, "bucket_key = ?", key).Error; err != nil {
+			return err
+		}
+		if err := update(&b); err != nil {
+			return err
+		}
+		return tx.Save(&b).Error
+	})
 }
 
 func (s *mysqlStore) GetRateLimits(name string, id string) ([]*UserRateLimit, error) {
@@ -173,18 +413,138 @@ func (s *mysqlStore) GetRateLimits(name string, id string) ([]*UserRateLimit, er
 	if len(id) != 0 {
 		tmp = tmp.Where("id = ?", id)
 	}
-	return limits, tmp.Find(&limits).Error
+	return limits, tmp.Order("id").Find(&limits).Error
 }
 
+// PutRateLimit adds the limit, or replaces the one of the same id of the user
 func (s *mysqlStore) PutRateLimit(limit *UserRateLimit) (string, error) {
+	return s.putRateLimit(limit, false)
+}
+
+func (s *mysqlStore) AddRateLimit(limit *UserRateLimit) (string, error) {
+	return s.putRateLimit(limit, true)
+}
+
+// putRateLimit fails if the id is taken by another user, or by the user as well when create is set,
+// the insert of create fails on the primary key if the id is taken meanwhile
+func (s *mysqlStore) putRateLimit(limit *UserRateLimit, create bool) (string, error) {
+	if len(limit.Name) == 0 {
+		return "", errcode.New(errcode.ErrInvalidArgument, "user is required for rate limit")
+	}
 	if len(limit.Id) == 0 {
 		limit.Id = uuid.NewString()
 	}
-	return limit.Id, s.db.Table("user_rate_limits").Save(limit).Error
+	return limit.Id, s.transaction(func(tx *gorm.DB) error {
+		var exist []*UserRateLimit
+		if err := tx.Table("user_rate_limits").Where("id = ?", limit.Id).Find(&exist).Error; err != nil {
+			return err
+		}
+		if len(exist) > 0 && exist[0].Name != limit.Name {
+			return xerrors.Errorf("rate limit %s belongs to user %s: %w", limit.Id, exist[0].Name, ErrAlreadyExists)
+		}
+		if create {
+			if len(exist) > 0 {
+				return xerrors.Errorf("rate limit %s of user %s: %w", limit.Id, limit.Name, ErrAlreadyExists)
+			}
+			return tx.Table("user_rate_limits").Create(limit).Error
+		}
+		return tx.Table("user_rate_limits").Save(limit).Error
+	})
 }
 
 func (s *mysqlStore) DelRateLimit(name, id string) error {
-	return s.db.Table("user_rate_limits").
-		Where("id = ? and name= ?", id, name).
-		Delete(nil).Error
+	if len(name) == 0 || len(id) == 0 {
+		return errcode.New(errcode.ErrInvalidArgument, "user and rate-limit id is required for removing rate limit regulation")
+	}
+	return s.transaction(func(tx *gorm.DB) error {
+		if err := tx.Table("user_rate_limits").Where("id = ? and name= ?", id, name).Delete(nil).Error; err != nil {
+			return err
+		}
+		return tx.Table("rate_buckets").Where("bucket_key = ?", RateBucketKey(name, id)).Delete(nil).Error
+	})
+}
+
+// PutSigningKey adds the key, or updates it if the kid exists
+func (s *mysqlStore) PutSigningKey(key *SigningKey) error {
+	return s.db.Table("signing_keys").Save(key).Error
+}
+
+func (s *mysqlStore) ListSigningKeys() ([]*SigningKey, error) {
+	var keys []*SigningKey
+	err := s.db.Table("signing_keys").Order(orderByCreateTime).Order("kid").Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Close closes the connections of the db
+func (s *mysqlStore) Close() error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// Export reads the tables in a read-only transaction, which is a consistent read of mysql and postgres
+func (s *mysqlStore) Export(fn func(*Record) error) error {
+	opts := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	return sqlError(s.db.Transaction(func(tx *gorm.DB) error {
+		var keys []*SigningKey
+		if err := tx.Table("signing_keys").Order("kid").Find(&keys).Error; err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(&Record{SigningKey: key}); err != nil {
+				return err
+			}
+		}
+
+		var miners []*UserMiner
+		if err := tx.Table("user_miners").Order(orderByCreateTime).Order("miner").Find(&miners).Error; err != nil {
+			return err
+		}
+		userMiners := make(map[string][]string)
+		for _, m := range miners {
+			userMiners[m.Name] = append(userMiners[m.Name], m.Miner)
+		}
+		var users []*User
+		if err := tx.Table("users").Order("name").Find(&users).Error; err != nil {
+			return err
+		}
+		for _, user := range users {
+			user.Miners = userMiners[user.Name]
+			if err := fn(&Record{User: user}); err != nil {
+				return err
+			}
+		}
+
+		// the tokens are read in pages, the token table has no primary key to read them in batches by gorm
+		for skip, page := int64(0), int64(500); ; skip += page {
+			var tokens []*KeyPair
+			if err := paginate(tx.Table("token").Order("token"), skip, page).Find(&tokens).Error; err != nil {
+				return err
+			}
+			for _, kp := range tokens {
+				if err := fn(&Record{Token: kp}); err != nil {
+					return err
+				}
+			}
+			if int64(len(tokens)) < page {
+				break
+			}
+		}
+
+		var limits []*UserRateLimit
+		if err := tx.Table("user_rate_limits").Order("id").Find(&limits).Error; err != nil {
+			return err
+		}
+		for _, l := range limits {
+			if err := fn(&Record{RateLimit: l}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, opts))
 }
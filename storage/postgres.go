@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"golang.org/x/xerrors"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/filecoin-project/venus-auth/config"
+)
+
+// postgresTypes replaces the column types of the models which postgres lacks
+var postgresTypes = map[schema.DataType]schema.DataType{
+	"tinyint(4)": "smallint",
+	"datetime":   "timestamptz",
+	"double":     "double precision",
+}
+
+func newPostgresStore(cnf *config.DBConfig) (Store, error) {
+	db, err := gorm.Open(postgres.Open(cnf.DSN))
+	if err != nil {
+		return nil, xerrors.Errorf("[db connection failed] Database name: %s %w", cnf.DSN, err)
+	}
+	if cnf.Debug {
+		db = db.Debug()
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB.SetMaxOpenConns(cnf.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cnf.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cnf.MaxLifeTime)
+	sqlDB.SetConnMaxIdleTime(cnf.MaxIdleTime)
+
+	// the parsed models are cached by db, so the types are replaced for this db only
+	for _, model := range append(schemaModels, sqlModels...) {
+		stmt := &gorm.Statement{DB: db}
+		if err = stmt.Parse(model); err != nil {
+			return nil, err
+		}
+		for _, field := range stmt.Schema.Fields {
+			if typ, ok := postgresTypes[field.DataType]; ok {
+				field.DataType = typ
+			}
+		}
+	}
+
+	return openSQLStore(db, db.Session(&gorm.Session{}))
+}
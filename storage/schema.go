@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+
+	"github.com/filecoin-project/venus-auth/errcode"
+	"github.com/filecoin-project/venus-auth/log"
+)
+
+// MigrateOptions passes what the migrations can't find in the db
+type MigrateOptions struct {
+	// MasterKid is the kid of the master secret of the config, the legacy tokens signed by it are given the kid
+	MasterKid string
+}
+
+// migration is a numbered step of the schema, the steps are applied in order and recorded once applied.
+// A step and its record are not written in one transaction, so a step must be safe to run again.
+// The db of a step may be nil when it has nothing to do there, store is run after it for every db.
+type migration struct {
+	version int
+	name    string
+	badger  func(s *badgerStore, opts *MigrateOptions) error
+	sql     func(s *mysqlStore, opts *MigrateOptions) error
+	store   func(s Store, opts *MigrateOptions) error
+}
+
+// migrations are the steps of the schema, a step is never changed once released,
+// e.g. a new column of a model needs a new step adding it.
+var migrations = []*migration{
+	{
+		version: 1,
+		name:    "create tables",
+		sql: func(s *mysqlStore, _ *MigrateOptions) error {
+			return s.schema.AutoMigrate(sqlModels...)
+		},
+	},
+	{
+		version: 2,
+		name:    "store tokens by hash",
+		badger: func(s *badgerStore, _ *MigrateOptions) error {
+			return s.migrateTokenHash()
+		},
+		sql: func(s *mysqlStore, _ *MigrateOptions) error {
+			return s.migrateTokenHash()
+		},
+	},
+	{
+		version: 3,
+		name:    "move user miners to the miners relation",
+		// the miner index is built on open
+		badger: func(s *badgerStore, _ *MigrateOptions) error {
+			return s.migrateUserMiners()
+		},
+		sql: func(s *mysqlStore, _ *MigrateOptions) error {
+			return s.migrateUserMiners()
+		},
+	},
+	{
+		version: 4,
+		name:    "set the kid of tokens signed by the master secret",
+		store:   migrateMasterKid,
+	},
+}
+
+// SchemaVersion is the version of the schema written by this build, the version of its last migration
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// MigrationStatus tells whether a migration is applied to a db
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is zero for a pending migration
+	AppliedAt time.Time
+	// Unknown is set for a migration applied by a newer build
+	Unknown bool
+}
+
+func (m *MigrationStatus) Applied() bool {
+	return !m.AppliedAt.IsZero()
+}
+
+// schemaStore records the migrations applied to a db
+type schemaStore interface {
+	// lockSchema waits until no other migrator holds the schema, unlock releases it
+	lockSchema() (unlock func(), err error)
+	appliedMigrations() (map[int]*MigrationStatus, error)
+	applyMigration(m *migration, opts *MigrateOptions) error
+	recordMigration(m *migration) error
+}
+
+func schemaOf(s Store) (schemaStore, error) {
+	switch st := s.(type) {
+	case *encryptedStore:
+		return schemaOf(st.Store)
+	case *badgerStore:
+		return st, nil
+	case *mysqlStore:
+		return st, nil
+	}
+	return nil, xerrors.Errorf("store %T has no schema", s)
+}
+
+// rawStore is the store under the encryption, the migrations leave the secrets as they are stored
+func rawStore(s Store) Store {
+	if st, ok := s.(*encryptedStore); ok {
+		return rawStore(st.Store)
+	}
+	return s
+}
+
+// SchemaStatus lists the migrations of this build, then those applied by a newer build
+func SchemaStatus(s Store) ([]*MigrationStatus, error) {
+	schema, err := schemaOf(s)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := schema.appliedMigrations()
+	if err != nil {
+		return nil, xerrors.Errorf("read applied migrations: %w", err)
+	}
+	status := make([]*MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st := &MigrationStatus{Version: m.version, Name: m.name}
+		if a, ok := applied[m.version]; ok {
+			st.AppliedAt = a.AppliedAt
+			delete(applied, m.version)
+		}
+		status = append(status, st)
+	}
+	for _, a := range applied {
+		a.Unknown = true
+		status = append(status, a)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Version < status[j].Version
+	})
+	return status, nil
+}
+
+// Migrate applies the pending migrations in order, and returns them.
+// It holds the lock of the schema, so migrators of the same db run one after another,
+// and it fails when a newer build has migrated the db.
+func Migrate(s Store, opts *MigrateOptions) ([]*MigrationStatus, error) {
+	if opts == nil {
+		opts = new(MigrateOptions)
+	}
+	schema, err := schemaOf(s)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := schema.lockSchema()
+	if err != nil {
+		return nil, xerrors.Errorf("lock schema: %w", err)
+	}
+	defer unlock()
+
+	status, err := SchemaStatus(s)
+	if err != nil {
+		return nil, err
+	}
+	if last := status[len(status)-1]; last.Unknown {
+		return nil, xerrors.Errorf("db schema version %d is newer than %d of this build", last.Version, SchemaVersion)
+	}
+	var done []*MigrationStatus
+	for i, st := range status {
+		if st.Applied() {
+			continue
+		}
+		m := migrations[i]
+		log.Infof("apply migration %d: %s", m.version, m.name)
+		if err = schema.applyMigration(m, opts); err == nil && m.store != nil {
+			err = m.store(rawStore(s), opts)
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+		if err = schema.recordMigration(m); err != nil {
+			return nil, xerrors.Errorf("record migration %d: %w", m.version, err)
+		}
+		st.AppliedAt = time.Now()
+		done = append(done, st)
+	}
+	return done, nil
+}
+
+// badger: the db is held by one process, the lock only keeps the migrators of the process apart
+
+func (s *badgerStore) migrationKey(version int) []byte {
+	return []byte(PrefixMigration + strconv.Itoa(version))
+}
+
+func (s *badgerStore) lockSchema() (func(), error) {
+	s.schemaMu.Lock()
+	return s.schemaMu.Unlock, nil
+}
+
+func (s *badgerStore) appliedMigrations() (map[int]*MigrationStatus, error) {
+	applied := make(map[int]*MigrationStatus)
+	return applied, s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte(PrefixMigration)})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			st := new(MigrationStatus)
+			if err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, st)
+			}); err != nil {
+				return err
+			}
+			applied[st.Version] = st
+		}
+		return nil
+	})
+}
+
+func (s *badgerStore) applyMigration(m *migration, opts *MigrateOptions) error {
+	if m.badger == nil {
+		return nil
+	}
+	return m.badger(s, opts)
+}
+
+func (s *badgerStore) recordMigration(m *migration) error {
+	val, err := json.Marshal(&MigrationStatus{Version: m.version, Name: m.name, AppliedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return s.update(func(txn *badger.Txn) error {
+		return txn.Set(s.migrationKey(m.version), val)
+	})
+}
+
+// sql: the applied migrations are rows of schema_migrations, the lock is the row of schema_lock
+
+// schemaMigration is an applied migration of a sql db
+type schemaMigration struct {
+	Version   int       `gorm:"column:version;primary_key;autoIncrement:false"`
+	Name      string    `gorm:"column:name;type:varchar(128);NOT NULL"`
+	AppliedAt time.Time `gorm:"column:appliedAt;type:datetime;NOT NULL"`
+}
+
+func (*schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// schemaLock is held by a migrator of a sql db, the holder refreshes it,
+// a lock left by a crashed migrator is taken over once it's stale.
+type schemaLock struct {
+	ID       int       `gorm:"column:id;primary_key;autoIncrement:false"`
+	Owner    string    `gorm:"column:owner;type:varchar(128);NOT NULL"`
+	LockedAt time.Time `gorm:"column:lockedAt;type:datetime;NOT NULL"`
+}
+
+func (*schemaLock) TableName() string {
+	return "schema_lock"
+}
+
+// schemaModels are the tables of the migrations of the sql dbs
+var schemaModels = []interface{}{&schemaMigration{}, &schemaLock{}}
+
+var (
+	// schemaLockRefresh is how often the holder refreshes the lock
+	schemaLockRefresh = 30 * time.Second
+	// schemaLockStale is how long a lock is kept without being refreshed
+	schemaLockStale = 2 * time.Minute
+	// schemaLockWait is how long a migrator waits for the lock
+	schemaLockWait = 5 * time.Minute
+)
+
+func (s *mysqlStore) createSchemaTables() error {
+	err := s.schema.AutoMigrate(schemaModels...)
+	if err != nil && s.db.Migrator().HasTable(&schemaMigration{}) && s.db.Migrator().HasTable(&schemaLock{}) {
+		// created by another migrator meanwhile
+		return nil
+	}
+	return err
+}
+
+func (s *mysqlStore) lockSchema() (func(), error) {
+	if err := s.createSchemaTables(); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%s", host, os.Getpid(), uuid.New().String()[:8])
+	deadline := time.Now().Add(schemaLockWait)
+	retried := false
+	for {
+		err := s.db.Create(&schemaLock{ID: 1, Owner: owner, LockedAt: time.Now()}).Error
+		if err == nil {
+			break
+		}
+		var held schemaLock
+		if terr := s.db.Take(&held, 1).Error; xerrors.Is(terr, gorm.ErrRecordNotFound) {
+			// released meanwhile, or the create fails for another reason
+			if retried {
+				return nil, err
+			}
+			retried = true
+			continue
+		} else if terr != nil {
+			return nil, terr
+		}
+		retried = false
+		if time.Since(held.LockedAt) > schemaLockStale {
+			log.Warnf("take over the schema lock of %s, which is stale since %s", held.Owner, held.LockedAt)
+			err = s.db.Where("id = ? AND owner = ?", 1, held.Owner).Delete(&schemaLock{}).Error
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errcode.Wrap(ErrUnavailable, xerrors.Errorf("schema is locked by %s since %s", held.Owner, held.LockedAt))
+		}
+		log.Infof("wait for the schema lock of %s", held.Owner)
+		time.Sleep(time.Second)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(schemaLockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := s.db.Model(&schemaLock{}).Where("id = ? AND owner = ?", 1, owner).Update("lockedAt", time.Now()).Error
+				if err != nil {
+					log.Warnf("refresh schema lock: %s", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if err := s.db.Where("id = ? AND owner = ?", 1, owner).Delete(&schemaLock{}).Error; err != nil {
+			log.Warnf("release schema lock: %s", err)
+		}
+	}, nil
+}
+
+func (s *mysqlStore) appliedMigrations() (map[int]*MigrationStatus, error) {
+	applied := make(map[int]*MigrationStatus)
+	if !s.db.Migrator().HasTable(&schemaMigration{}) {
+		return applied, nil
+	}
+	var rows []*schemaMigration
+	if err := s.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		applied[r.Version] = &MigrationStatus{Version: r.Version, Name: r.Name, AppliedAt: r.AppliedAt}
+	}
+	return applied, nil
+}
+
+func (s *mysqlStore) applyMigration(m *migration, opts *MigrateOptions) error {
+	if m.sql == nil {
+		return nil
+	}
+	return sqlError(m.sql(s, opts))
+}
+
+func (s *mysqlStore) recordMigration(m *migration) error {
+	return s.db.Create(&schemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/filecoin-project/venus-auth/config"
+)
+
+// SQLiteFile is the db file in the data dir, when no DSN is configured
+const SQLiteFile = "auth.db"
+
+// newSQLiteStore opens the single file db of the DSN, which is the path of the file
+func newSQLiteStore(cnf *config.DBConfig, dataPath string) (Store, error) {
+	dsn := cnf.DSN
+	if len(dsn) == 0 {
+		dsn = filepath.Join(dataPath, SQLiteFile)
+	}
+	// the writers wait for each other instead of failing at once
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	dsn += sep + "_busy_timeout=5000&_journal_mode=WAL"
+
+	db, err := gorm.Open(sqlite.Open(dsn))
+	if err != nil {
+		return nil, xerrors.Errorf("[db connection failed] Database name: %s %w", dsn, err)
+	}
+	if cnf.Debug {
+		db = db.Debug()
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	// sqlite has no row locking, the transactions reading then writing a row are serialized
+	sqlDB.SetMaxOpenConns(1)
+
+	return openSQLStore(db, db.Session(&gorm.Session{}))
+}
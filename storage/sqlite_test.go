@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/filecoin-project/venus-auth/config"
+	"github.com/filecoin-project/venus-auth/core"
+)
+
+func TestSQLiteReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint
+	cnf := &config.DBConfig{Type: config.SQLite}
+	store, err := NewStore(cnf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := Migrate(store, nil)
+	assert.NoError(t, err)
+	assert.Len(t, done, SchemaVersion)
+	now := time.Now()
+	assert.NoError(t, store.PutUser(&User{Id: "u1", Name: "user1", State: core.UserStateEnabled, CreateTime: now, UpdateTime: now}))
+	assert.NoError(t, store.Close())
+
+	// the migrations are applied once
+	store, err = NewStore(cnf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close() // nolint
+	done, err = Migrate(store, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, done)
+	has, err := store.HasUser("user1")
+	assert.NoError(t, err)
+	assert.True(t, has)
+}
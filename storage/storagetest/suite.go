@@ -0,0 +1,538 @@
+// Package storagetest is the behavior suite every storage.Store passes, whatever the db behind it.
+package storagetest
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/storage"
+)
+
+// NewStore returns an empty store, which is released by the cleanup of t
+type NewStore func(t *testing.T) storage.Store
+
+// TestStore runs the suite, every test gets a new store
+func TestStore(t *testing.T, newStore NewStore) {
+	for _, tc := range []struct {
+		name string
+		test func(t *testing.T, s storage.Store)
+	}{
+		{"Tokens", testTokens},
+		{"TokenPages", testTokenPages},
+		{"Users", testUsers},
+		{"ListUsers", testListUsers},
+		{"Miners", testMiners},
+		{"RateLimits", testRateLimits},
+		{"RateBucket", testRateBucket},
+		{"RateBucketRemoved", testRateBucketRemoved},
+		{"SigningKeys", testSigningKeys},
+		{"Concurrency", testConcurrency},
+		{"Export", testExport},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStore(t))
+		})
+	}
+}
+
+// the sql dbs keep the times in seconds
+var epoch = time.Unix(1600000000, 0)
+
+func at(sec int) time.Time {
+	return epoch.Add(time.Duration(sec) * time.Second)
+}
+
+func keyPair(name string, sec int) *storage.KeyPair {
+	tk := storage.Token(fmt.Sprintf("header.%s-%d.signature-%s-%d", name, sec, name, sec))
+	return &storage.KeyPair{
+		Name:       name,
+		Perm:       core.PermRead,
+		Secret:     "secret-" + name,
+		Hash:       tk.Hash(),
+		Prefix:     tk.Prefix(),
+		CreateTime: at(sec),
+		ExpireAt:   at(sec).Add(time.Hour).Unix(),
+	}
+}
+
+func user(name string, sec int) *storage.User {
+	return &storage.User{
+		Id:         "id-" + name,
+		Name:       name,
+		Comment:    "comment of " + name,
+		State:      core.UserStateEnabled,
+		CreateTime: at(sec),
+		UpdateTime: at(sec),
+	}
+}
+
+func miner(t *testing.T, id uint64) address.Address {
+	maddr, err := address.NewIDAddress(id)
+	require.NoError(t, err)
+	return maddr
+}
+
+func tokenNames(kps []*storage.KeyPair) []string {
+	res := make([]string, 0, len(kps))
+	for _, kp := range kps {
+		res = append(res, fmt.Sprintf("%s@%d", kp.Name, kp.CreateTime.Unix()-epoch.Unix()))
+	}
+	return res
+}
+
+func userNames(users []*storage.User) []string {
+	res := make([]string, 0, len(users))
+	for _, u := range users {
+		res = append(res, u.Name)
+	}
+	return res
+}
+
+func testTokens(t *testing.T, s storage.Store) {
+	kp := keyPair("alice", 1)
+	_, err := s.Get(kp.Hash)
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "get a missing token: %v", err)
+	has, err := s.Has(kp.Hash)
+	assert.NoError(t, err)
+	assert.False(t, has)
+	err = s.UpdateToken(kp)
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "update a missing token: %v", err)
+	assert.NoError(t, s.Delete(kp.Hash), "delete a missing token")
+
+	require.NoError(t, s.Put(kp))
+	err = s.Put(kp)
+	assert.True(t, xerrors.Is(err, storage.ErrAlreadyExists), "put a token twice: %v", err)
+	has, err = s.Has(kp.Hash)
+	assert.NoError(t, err)
+	assert.True(t, has)
+	got, err := s.Get(kp.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, kp.Name, got.Name)
+	assert.Equal(t, kp.Perm, got.Perm)
+	assert.Equal(t, kp.Secret, got.Secret)
+	assert.Equal(t, kp.Prefix, got.Prefix)
+	assert.Equal(t, kp.ExpireAt, got.ExpireAt)
+	assert.True(t, kp.CreateTime.Equal(got.CreateTime), "create time %s, want %s", got.CreateTime, kp.CreateTime)
+
+	kp.Perm, kp.Kid, kp.UserID = core.PermAdmin, "kid", "id-alice"
+	require.NoError(t, s.UpdateToken(kp))
+	got, err = s.Get(kp.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, core.PermAdmin, got.Perm)
+	assert.Equal(t, "kid", got.Kid)
+	assert.Equal(t, "id-alice", got.UserID)
+
+	require.NoError(t, s.Delete(kp.Hash))
+	has, err = s.Has(kp.Hash)
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func testTokenPages(t *testing.T, s storage.Store) {
+	for i, name := range []string{"bob", "alice", "bob", "carol", "alice"} {
+		require.NoError(t, s.Put(keyPair(name, 5-i)))
+	}
+
+	all, err := s.List(0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice@1", "alice@4", "bob@3", "bob@5", "carol@2"}, tokenNames(all))
+	page, err := s.List(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice@4", "bob@3"}, tokenNames(page))
+	page, err = s.List(4, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"carol@2"}, tokenNames(page))
+	page, err = s.List(5, 2)
+	require.NoError(t, err)
+	assert.Len(t, page, 0)
+
+	page, err = s.ListByName("bob", 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob@3", "bob@5"}, tokenNames(page))
+	page, err = s.ListByName("bob", 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob@5"}, tokenNames(page))
+	page, err = s.ListByName("dave", 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, page, 0)
+}
+
+func testUsers(t *testing.T, s storage.Store) {
+	_, err := s.GetUser("alice")
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "get a missing user: %v", err)
+	err = s.UpdateUser(user("alice", 1))
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "update a missing user: %v", err)
+	err = s.DelUser("alice")
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "delete a missing user: %v", err)
+	has, err := s.HasUser("alice")
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	u := user("alice", 1)
+	require.NoError(t, s.PutUser(u))
+	again := user("alice", 2)
+	again.Id = "another-id"
+	err = s.PutUser(again)
+	assert.True(t, xerrors.Is(err, storage.ErrAlreadyExists), "put a user twice: %v", err)
+	got, err := s.GetUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, u.Id, got.Id)
+	assert.Equal(t, u.Comment, got.Comment)
+	assert.Equal(t, u.State, got.State)
+	assert.True(t, u.CreateTime.Equal(got.CreateTime), "create time %s, want %s", got.CreateTime, u.CreateTime)
+	assert.Len(t, got.Miners, 0)
+
+	// the id and the miners are kept
+	require.NoError(t, s.AddMiner("alice", miner(t, 1000)))
+	updated := user("alice", 1)
+	updated.Id = "another-id"
+	updated.Comment = "updated"
+	updated.State = core.UserStateDisabled
+	updated.IsDeleted = true
+	require.NoError(t, s.UpdateUser(updated))
+	got, err = s.GetUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, u.Id, got.Id)
+	assert.Equal(t, "updated", got.Comment)
+	assert.Equal(t, core.UserStateDisabled, got.State)
+	assert.True(t, got.IsDeleted)
+	assert.Equal(t, []string{miner(t, 1000).String()}, got.Miners)
+	has, err = s.HasUser("alice")
+	assert.NoError(t, err)
+	assert.True(t, has, "a soft deleted user is found")
+
+	// the rate limits and miners go with the user
+	_, err = s.PutRateLimit(&storage.UserRateLimit{Name: "alice", ReqLimit: storage.ReqLimit{Cap: 1, ResetDur: time.Minute}})
+	require.NoError(t, err)
+	require.NoError(t, s.DelUser("alice"))
+	has, err = s.HasUser("alice")
+	assert.NoError(t, err)
+	assert.False(t, has)
+	limits, err := s.GetRateLimits("alice", "")
+	assert.NoError(t, err)
+	assert.Len(t, limits, 0)
+	require.NoError(t, s.PutUser(user("bob", 2)))
+	assert.NoError(t, s.AddMiner("bob", miner(t, 1000)), "the miner is free")
+}
+
+func testListUsers(t *testing.T, s storage.Store) {
+	// created in the reverse order of the names
+	for i, name := range []string{"u5", "u4", "u3", "u2", "u1", "u0"} {
+		u := user(name, i)
+		u.SourceType = core.SourceType(i % 2)
+		if i%3 == 0 {
+			u.State = core.UserStateDisabled
+		}
+		require.NoError(t, s.PutUser(u))
+	}
+	deleted := user("u1", 4)
+	deleted.IsDeleted = true
+	require.NoError(t, s.UpdateUser(deleted))
+
+	list := func(skip, limit int64, state int, sourceType core.SourceType, code core.KeyCode) []string {
+		users, err := s.ListUsers(skip, limit, state, sourceType, code)
+		require.NoError(t, err)
+		return userNames(users)
+	}
+	assert.Equal(t, []string{"u5", "u4", "u3", "u2", "u0"}, list(0, 0, 0, 0, 0))
+	assert.Equal(t, []string{"u4", "u3"}, list(1, 2, 0, 0, 0))
+	assert.Equal(t, []string{"u0"}, list(4, 10, 0, 0, 0))
+	assert.Len(t, list(5, 10, 0, 0, 0), 0)
+	// the skipped users are the ones matching the filters
+	assert.Equal(t, []string{"u5", "u2"}, list(0, 0, core.UserStateDisabled, 0, 2))
+	assert.Equal(t, []string{"u2"}, list(1, 1, core.UserStateDisabled, 0, 2))
+	assert.Equal(t, []string{"u4", "u2", "u0"}, list(0, 0, 0, 1, 1))
+	assert.Equal(t, []string{"u2", "u0"}, list(1, 0, 0, 1, 1))
+	assert.Equal(t, []string{"u4", "u0"}, list(0, 0, core.UserStateEnabled, 1, 3))
+}
+
+func testMiners(t *testing.T, s storage.Store) {
+	m1, m2 := miner(t, 1001), miner(t, 1002)
+	err := s.AddMiner("alice", m1)
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "add a miner to a missing user: %v", err)
+	_, err = s.GetMiner(m1)
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "get a missing miner: %v", err)
+
+	require.NoError(t, s.PutUser(user("alice", 1)))
+	require.NoError(t, s.PutUser(user("bob", 2)))
+	require.NoError(t, s.AddMiner("alice", m1))
+	require.NoError(t, s.AddMiner("alice", m2))
+	assert.NoError(t, s.AddMiner("alice", m1), "add a miner twice")
+	err = s.AddMiner("bob", m1)
+	assert.True(t, xerrors.Is(err, storage.ErrAlreadyExists), "add a miner of another user: %v", err)
+
+	has, err := s.HasMiner(m1)
+	assert.NoError(t, err)
+	assert.True(t, has)
+	owner, err := s.GetMiner(m2)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", owner.Name)
+	assert.ElementsMatch(t, []string{m1.String(), m2.String()}, owner.Miners)
+
+	err = s.DelMiner("bob", m1)
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "delete a miner of another user: %v", err)
+	require.NoError(t, s.DelMiner("alice", m1))
+	_, err = s.GetMiner(m1)
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "get a deleted miner: %v", err)
+	alice, err := s.GetUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{m2.String()}, alice.Miners)
+
+	// the miners of a soft deleted user are hidden, but not free
+	alice.IsDeleted = true
+	require.NoError(t, s.UpdateUser(alice))
+	has, err = s.HasMiner(m2)
+	assert.NoError(t, err)
+	assert.False(t, has)
+	_, err = s.GetMiner(m2)
+	assert.True(t, xerrors.Is(err, storage.ErrNotFound), "get a miner of a deleted user: %v", err)
+	err = s.AddMiner("bob", m2)
+	assert.True(t, xerrors.Is(err, storage.ErrAlreadyExists), "add a miner of a deleted user: %v", err)
+}
+
+func testRateLimits(t *testing.T, s storage.Store) {
+	limits, err := s.GetRateLimits("alice", "")
+	assert.NoError(t, err)
+	assert.Len(t, limits, 0)
+
+	limit := storage.ReqLimit{Cap: 10, ResetDur: time.Minute}
+	_, err = s.PutRateLimit(&storage.UserRateLimit{ReqLimit: limit})
+	assert.Error(t, err, "the user is required")
+	for _, id := range []string{"b", "a"} {
+		got, err := s.PutRateLimit(&storage.UserRateLimit{Id: id, Name: "alice", API: "api-" + id, ReqLimit: limit})
+		require.NoError(t, err)
+		assert.Equal(t, id, got)
+	}
+	generated, err := s.PutRateLimit(&storage.UserRateLimit{Name: "bob", ReqLimit: limit})
+	require.NoError(t, err)
+	assert.NotEmpty(t, generated)
+	_, err = s.PutRateLimit(&storage.UserRateLimit{Id: "a", Name: "bob", ReqLimit: limit})
+	assert.True(t, xerrors.Is(err, storage.ErrAlreadyExists), "put a limit of another user: %v", err)
+	_, err = s.AddRateLimit(&storage.UserRateLimit{Id: "a", Name: "alice", ReqLimit: limit})
+	assert.True(t, xerrors.Is(err, storage.ErrAlreadyExists), "add a taken id: %v", err)
+	_, err = s.AddRateLimit(&storage.UserRateLimit{Id: "a", Name: "bob", ReqLimit: limit})
+	assert.True(t, xerrors.Is(err, storage.ErrAlreadyExists), "add an id of another user: %v", err)
+	added, err := s.AddRateLimit(&storage.UserRateLimit{Name: "bob", API: "added", ReqLimit: limit})
+	require.NoError(t, err)
+	assert.NotEmpty(t, added)
+
+	limits, err = s.GetRateLimits("alice", "")
+	require.NoError(t, err)
+	require.Len(t, limits, 2)
+	assert.Equal(t, "a", limits[0].Id)
+	assert.Equal(t, "b", limits[1].Id)
+	assert.Equal(t, "api-a", limits[0].API)
+	assert.Equal(t, limit, limits[0].ReqLimit)
+
+	_, err = s.PutRateLimit(&storage.UserRateLimit{Id: "a", Name: "alice", Service: "venus", ReqLimit: storage.ReqLimit{Cap: 5, ResetDur: time.Hour}})
+	require.NoError(t, err)
+	limits, err = s.GetRateLimits("alice", "a")
+	require.NoError(t, err)
+	require.Len(t, limits, 1)
+	assert.Equal(t, "venus", limits[0].Service)
+	assert.Equal(t, storage.ReqLimit{Cap: 5, ResetDur: time.Hour}, limits[0].ReqLimit)
+	limits, err = s.GetRateLimits("bob", "a")
+	assert.NoError(t, err)
+	assert.Len(t, limits, 0)
+
+	assert.NoError(t, s.DelRateLimit("alice", "c"), "delete a missing limit")
+	assert.NoError(t, s.DelRateLimit("bob", "a"), "delete a limit of another user")
+	require.NoError(t, s.DelRateLimit("alice", "a"))
+	limits, err = s.GetRateLimits("alice", "")
+	require.NoError(t, err)
+	require.Len(t, limits, 1)
+	assert.Equal(t, "b", limits[0].Id)
+	limits, err = s.GetRateLimits("bob", "")
+	require.NoError(t, err)
+	assert.Len(t, limits, 2)
+}
+
+func testRateBucket(t *testing.T, s storage.Store) {
+	require.NoError(t, s.UpdateRateBucket("alice/l1", func(b *storage.RateBucket) error {
+		assert.Equal(t, storage.RateBucket{Key: "alice/l1"}, *b)
+		b.Tokens, b.RefillTime = 2.5, 42
+		return nil
+	}))
+	assert.Error(t, s.UpdateRateBucket("alice/l1", func(b *storage.RateBucket) error {
+		b.Tokens = 0
+		return xerrors.New("abort")
+	}))
+	require.NoError(t, s.UpdateRateBucket("alice/l1", func(b *storage.RateBucket) error {
+		assert.Equal(t, 2.5, b.Tokens, "an aborted update is not written")
+		assert.Equal(t, int64(42), b.RefillTime)
+		return nil
+	}))
+}
+
+// testRateBucketRemoved checks that the buckets are removed with their rate limits,
+// a limit added again under the id starts with a full bucket
+func testRateBucketRemoved(t *testing.T, s storage.Store) {
+	require.NoError(t, s.PutUser(user("alice", 1)))
+	for _, id := range []string{"l1", "l2"} {
+		_, err := s.PutRateLimit(&storage.UserRateLimit{Id: id, Name: "alice", ReqLimit: storage.ReqLimit{Cap: 10, ResetDur: time.Minute}})
+		require.NoError(t, err)
+		require.NoError(t, s.UpdateRateBucket(storage.RateBucketKey("alice", id), func(b *storage.RateBucket) error {
+			b.Tokens, b.RefillTime = 2, 42
+			return nil
+		}))
+	}
+	bucket := func(id string) storage.RateBucket {
+		var res storage.RateBucket
+		require.NoError(t, s.UpdateRateBucket(storage.RateBucketKey("alice", id), func(b *storage.RateBucket) error {
+			res = *b
+			return nil
+		}))
+		return res
+	}
+
+	require.NoError(t, s.DelRateLimit("alice", "l1"))
+	assert.Equal(t, storage.RateBucket{Key: "alice/l1"}, bucket("l1"), "the bucket of the removed limit")
+	assert.Equal(t, 2.0, bucket("l2").Tokens)
+
+	require.NoError(t, s.DelUser("alice"))
+	assert.Equal(t, storage.RateBucket{Key: "alice/l2"}, bucket("l2"), "the bucket of the removed user")
+}
+
+func testSigningKeys(t *testing.T, s storage.Store) {
+	keys, err := s.ListSigningKeys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 0)
+	for i, kid := range []string{"k2", "k1"} {
+		require.NoError(t, s.PutSigningKey(&storage.SigningKey{Kid: kid, Alg: "ES256", PrivateKey: "key-" + kid, CreateTime: at(2 - i)}))
+	}
+	require.NoError(t, s.PutSigningKey(&storage.SigningKey{Kid: "k2", Alg: "ES256", PrivateKey: "key-k2", CreateTime: at(2), Retired: true}))
+	keys, err = s.ListSigningKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "k1", keys[0].Kid)
+	assert.Equal(t, "key-k1", keys[0].PrivateKey)
+	assert.False(t, keys[0].Retired)
+	assert.Equal(t, "k2", keys[1].Kid)
+	assert.True(t, keys[1].Retired)
+}
+
+func testConcurrency(t *testing.T, s storage.Store) {
+	const workers = 8
+	run := func(f func(i int) error) int {
+		var wg sync.WaitGroup
+		var lk sync.Mutex
+		succeeded := 0
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if f(i) == nil {
+					lk.Lock()
+					succeeded++
+					lk.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		return succeeded
+	}
+
+	assert.Equal(t, workers, run(func(i int) error {
+		return s.PutUser(user(fmt.Sprintf("user%d", i), i))
+	}), "put different users")
+	assert.Equal(t, 1, run(func(i int) error {
+		u := user("same", i)
+		u.Id = fmt.Sprintf("id-%d", i)
+		return s.PutUser(u)
+	}), "put the same user")
+	assert.Equal(t, 1, run(func(i int) error {
+		return s.AddMiner(fmt.Sprintf("user%d", i), miner(t, 2000))
+	}), "add the same miner to different users")
+	owner, err := s.GetMiner(miner(t, 2000))
+	require.NoError(t, err)
+	assert.Len(t, owner.Miners, 1)
+
+	assert.Equal(t, workers, run(func(i int) error {
+		return s.UpdateRateBucket("same/l1", func(b *storage.RateBucket) error {
+			b.Tokens++
+			return nil
+		})
+	}), "update the same bucket")
+	require.NoError(t, s.UpdateRateBucket("same/l1", func(b *storage.RateBucket) error {
+		assert.Equal(t, float64(workers), b.Tokens)
+		return nil
+	}))
+}
+
+func testExport(t *testing.T, s storage.Store) {
+	var buf bytes.Buffer
+	sum, err := storage.Backup(s, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, storage.BackupSummary{}, *sum)
+	// an empty store takes the archive of an empty store
+	sum, err = storage.Restore(s, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, storage.BackupSummary{}, *sum)
+
+	require.NoError(t, s.PutSigningKey(&storage.SigningKey{Kid: "k1", Alg: "ES256", PrivateKey: "key-k1", CreateTime: at(0)}))
+	for i, name := range []string{"alice", "bob"} {
+		require.NoError(t, s.PutUser(user(name, i)))
+		require.NoError(t, s.Put(keyPair(name, i)))
+	}
+	require.NoError(t, s.AddMiner("alice", miner(t, 1001)))
+	require.NoError(t, s.AddMiner("alice", miner(t, 1002)))
+	for _, id := range []string{"l2", "l1"} {
+		_, err = s.PutRateLimit(&storage.UserRateLimit{Id: id, Name: "bob", ReqLimit: storage.ReqLimit{Cap: 1, ResetDur: time.Minute}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.UpdateRateBucket("bob/l1", func(b *storage.RateBucket) error {
+		b.Tokens = 1
+		return nil
+	}))
+
+	var tokens, users, limits []string
+	var kids []string
+	require.NoError(t, s.Export(func(r *storage.Record) error {
+		switch {
+		case r.Token != nil:
+			tokens = append(tokens, r.Token.Name)
+		case r.User != nil:
+			users = append(users, r.User.Name)
+			if r.User.Name == "alice" {
+				assert.ElementsMatch(t, []string{miner(t, 1001).String(), miner(t, 1002).String()}, r.User.Miners)
+			}
+		case r.RateLimit != nil:
+			limits = append(limits, r.RateLimit.Id)
+		case r.SigningKey != nil:
+			kids = append(kids, r.SigningKey.Kid)
+		default:
+			t.Errorf("empty record")
+		}
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"alice", "bob"}, tokens)
+	assert.ElementsMatch(t, []string{"alice", "bob"}, users)
+	assert.ElementsMatch(t, []string{"l1", "l2"}, limits, "the rate buckets are not exported")
+	assert.Equal(t, []string{"k1"}, kids)
+
+	abort := xerrors.New("abort")
+	calls := 0
+	err = s.Export(func(*storage.Record) error {
+		calls++
+		return abort
+	})
+	assert.True(t, xerrors.Is(err, abort), err)
+	assert.Equal(t, 1, calls)
+
+	buf.Reset()
+	sum, err = storage.Backup(s, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, storage.BackupSummary{Tokens: 2, Users: 2, Miners: 2, RateLimits: 2, SigningKeys: 1}, *sum)
+	_, err = storage.Restore(s, &buf)
+	assert.Error(t, err, "the store is not empty")
+}
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"crypto/sha256"
 	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -13,9 +15,11 @@ import (
 
 	"github.com/filecoin-project/venus-auth/config"
 	"github.com/filecoin-project/venus-auth/core"
+	"github.com/filecoin-project/venus-auth/errcode"
 	"github.com/filecoin-project/venus-auth/log"
 )
 
+// NewStore opens the db of the config, Migrate brings its schema up to date before it's used
 func NewStore(cnf *config.DBConfig, dataPath string) (Store, error) {
 	switch strings.ToLower(cnf.Type) {
 	case config.Mysql:
@@ -24,46 +28,109 @@ func NewStore(cnf *config.DBConfig, dataPath string) (Store, error) {
 	case config.Badger:
 		log.Warn("badger storage")
 		return newBadgerStore(dataPath)
+	case config.SQLite:
+		log.Warn("sqlite storage")
+		return newSQLiteStore(cnf, dataPath)
+	case config.Postgres:
+		log.Warn("postgres storage")
+		return newPostgresStore(cnf)
 	}
 	return nil, fmt.Errorf("the type %s is not currently supported", cnf.Type)
 }
 
+var (
+	// ErrNotFound is wrapped by the errors of a token, user, miner or rate limit which doesn't exist
+	ErrNotFound = errcode.ErrNotFound
+	// ErrAlreadyExists is wrapped by the errors of creating a record which exists,
+	// or of taking a miner or rate limit id of another user
+	ErrAlreadyExists = errcode.ErrAlreadyExists
+	// ErrUnavailable is wrapped by the errors of reaching the db
+	ErrUnavailable = errcode.ErrUnavailable
+)
+
+// Store is implemented by every db, they pass the suite of the storagetest package.
+// The lists skip the first skip records, and return limit records at most, all of them when limit is zero.
 type Store interface {
-	// token
-	Get(token Token) (*KeyPair, error)
+	// token, looked up by the digest of the bearer token
+	Get(hash TokenHash) (*KeyPair, error)
+	// Put fails with ErrAlreadyExists if the token exists
 	Put(kp *KeyPair) error
-	Delete(token Token) error
-	Has(token Token) (bool, error)
+	// Delete does nothing if the token doesn't exist
+	Delete(hash TokenHash) error
+	Has(hash TokenHash) (bool, error)
+	// List is ordered by name, then create time
 	List(skip, limit int64) ([]*KeyPair, error)
+	// ListByName lists the tokens issued under the name, ordered by create time
+	ListByName(name string, skip, limit int64) ([]*KeyPair, error)
 	UpdateToken(kp *KeyPair) error
 
-	// user
+	// user, the soft deleted users are found by HasUser and GetUser
 	HasUser(name string) (bool, error)
 	GetUser(name string) (*User, error)
-	HasMiner(maddr address.Address) (bool, error)
-	GetMiner(maddr address.Address) (*User, error)
+	// PutUser fails with ErrAlreadyExists if the name is taken
 	PutUser(*User) error
+	// UpdateUser keeps the id and the miners of the user
 	UpdateUser(*User) error
+	// DelUser removes the user, its rate limits and their buckets
+	DelUser(name string) error
+	// ListUsers is ordered by create time, the soft deleted users and the users not matching
+	// the filters selected by code are neither listed nor skipped
 	ListUsers(skip, limit int64, state int, sourceType core.SourceType, code core.KeyCode) ([]*User, error)
-	// rate limit
+	// miner, a miner belongs to one user at most, the miners of a soft deleted user are not found
+	HasMiner(maddr address.Address) (bool, error)
+	GetMiner(maddr address.Address) (*User, error)
+	// AddMiner does nothing if the miner belongs to the user already
+	AddMiner(name string, maddr address.Address) error
+	DelMiner(name string, maddr address.Address) error
+	// rate limit, the limits of a user without any are empty, they are ordered by id
 	GetRateLimits(name, id string) ([]*UserRateLimit, error)
+	// PutRateLimit adds the limit, or replaces the one of the same id of the user, an id is generated if it's empty
 	PutRateLimit(limit *UserRateLimit) (string, error)
+	// AddRateLimit adds the limit, it fails with ErrAlreadyExists if the id is taken, an id is generated if it's empty
+	AddRateLimit(limit *UserRateLimit) (string, error)
+	// DelRateLimit removes the limit and its bucket, it does nothing if the limit doesn't exist
 	DelRateLimit(name, id string) error
+	// UpdateRateBucket changes the bucket atomically, update gets a zero bucket when there is none,
+	// the bucket of a rate limit is keyed by RateBucketKey
+	UpdateRateBucket(key string, update func(b *RateBucket) error) error
+
+	// signing key
+	PutSigningKey(key *SigningKey) error
+	// ListSigningKeys is ordered by create time
+	ListSigningKeys() ([]*SigningKey, error)
+
+	// Export calls fn with every token, user with its miners, rate limit and signing key, which are read
+	// from one snapshot of the db, it stops at the first error of fn. The secrets are passed as they are stored.
+	Export(fn func(*Record) error) error
+
+	// Close releases the db, the store is not used afterwards, closing it again does nothing
+	Close() error
 }
 
 type KeyPair struct {
-	Name       string    `gorm:"column:name;type:varchar(50);NOT NULL"`
-	Perm       string    `gorm:"column:perm;type:varchar(50);NOT NULL"`
-	Secret     string    `gorm:"column:secret;type:varchar(255);NOT NULL"`
-	Extra      string    `gorm:"column:extra;type:varchar(255);"`
-	Token      Token     `gorm:"column:token;type:varchar(512);uniqueIndex:token_token_IDX,type:hash;not null"`
+	Name   string `gorm:"column:name;type:varchar(50);NOT NULL"`
+	Perm   string `gorm:"column:perm;type:varchar(50);NOT NULL"`
+	Secret string `gorm:"column:secret;type:varchar(255);NOT NULL"`
+	// Kid is set when the token is signed by a server key instead of its own secret
+	Kid string `gorm:"column:kid;type:varchar(64);default:''"`
+	// UserID links the token to the user record it's issued to, empty if there was none
+	UserID string `gorm:"column:user_id;type:varchar(64);default:''"`
+	Extra  string `gorm:"column:extra;type:varchar(255);"`
+	// the bearer token itself is never stored, the column keeps its legacy name
+	Hash       TokenHash `gorm:"column:token;type:varchar(512);uniqueIndex:token_token_IDX;not null"`
+	Prefix     string    `gorm:"column:prefix;type:varchar(32);default:''"`
 	CreateTime time.Time `gorm:"column:createTime;type:datetime;NOT NULL"`
+	// unix seconds, zero means the token never expires
+	ExpireAt int64 `gorm:"column:expireAt;type:bigint;default:0;NOT NULL"`
+	// unix seconds, zero means the token is valid right after creation
+	NotBefore int64 `gorm:"column:notBefore;type:bigint;default:0;NOT NULL"`
 }
 
 func (*KeyPair) TableName() string {
 	return "token"
 }
 
+// Token is a bearer token in its JWT form
 type Token string
 
 func (t Token) Bytes() []byte {
@@ -73,6 +140,39 @@ func (t Token) String() string {
 	return string(t)
 }
 
+// Hash returns the digest under which the token is stored
+func (t Token) Hash() TokenHash {
+	sum := sha256.Sum256(t.Bytes())
+	return TokenHash(hex.EncodeToString(sum[:]))
+}
+
+const prefixLen = 8
+
+// Prefix returns the beginning of the signature part, which is enough to tell tokens apart in a listing
+// without revealing a usable credential. The header and payload parts are mostly alike between tokens.
+func (t Token) Prefix() string {
+	sig := t.String()[strings.LastIndex(t.String(), ".")+1:]
+	if len(sig) > prefixLen {
+		sig = sig[:prefixLen]
+	}
+	return sig
+}
+
+// TokenHash is the hex encoded sha256 digest of a Token
+type TokenHash string
+
+func (h TokenHash) String() string {
+	return string(h)
+}
+
+// ParseTokenHash accepts either a token in its JWT form or its hash
+func ParseTokenHash(s string) TokenHash {
+	if strings.Contains(s, ".") {
+		return Token(s).Hash()
+	}
+	return TokenHash(s)
+}
+
 func (t *KeyPair) Bytes() ([]byte, error) {
 	buff, err := json.Marshal(t)
 	if err != nil {
@@ -94,14 +194,39 @@ func (t *KeyPair) FromBytes(val []byte) error {
 }
 
 type User struct {
-	Id         string          `gorm:"column:id;type:varchar(64);primary_key"`
-	Name       string          `gorm:"column:name;type:varchar(50);uniqueIndex:users_name_IDX,type:btree;not null"`
-	Miner      string          `gorm:"column:miner;type:varchar(255);index:users_miner_IDX,type:btree"`
+	Id   string `gorm:"column:id;type:varchar(64);primary_key"`
+	Name string `gorm:"column:name;type:varchar(50);uniqueIndex:users_name_IDX;not null"`
+	// Deprecated: moved to the user_miners relation by the migration, use Miners
+	Miner      string          `gorm:"column:miner;type:varchar(255);index:users_miner_IDX"`
 	Comment    string          `gorm:"column:comment;type:varchar(255);"`
 	SourceType core.SourceType `gorm:"column:stype;type:tinyint(4);default:0;NOT NULL"`
 	State      int             `gorm:"column:state;type:tinyint(4);default:0;NOT NULL"`
 	CreateTime time.Time       `gorm:"column:createTime;type:datetime;NOT NULL"`
 	UpdateTime time.Time       `gorm:"column:updateTime;type:datetime;NOT NULL"`
+	// tombstone of a soft deleted user, it's hidden from the list and miner queries, and its name stays taken
+	IsDeleted bool `gorm:"column:is_deleted;default:false"`
+	// filled from the user_miners relation, PutUser and UpdateUser ignore it
+	Miners []string `gorm:"-"`
+}
+
+func (t *User) HasMiner(maddr string) bool {
+	for _, m := range t.Miners {
+		if m == maddr {
+			return true
+		}
+	}
+	return false
+}
+
+// UserMiner relates a miner to the user it belongs to
+type UserMiner struct {
+	Miner      string    `gorm:"column:miner;type:varchar(128);primary_key"`
+	Name       string    `gorm:"column:name;type:varchar(50);index:user_miners_name_IDX;not null"`
+	CreateTime time.Time `gorm:"column:createTime;type:datetime;NOT NULL"`
+}
+
+func (*UserMiner) TableName() string {
+	return "user_miners"
 }
 
 type UserRateLimit struct {
@@ -122,8 +247,13 @@ type ReqLimit struct {
 }
 
 func (rl *ReqLimit) Scan(value interface{}) error {
-	bytes, ok := value.([]byte)
-	if !ok {
+	var bytes []byte
+	switch v := value.(type) {
+	case []byte:
+		bytes = v
+	case string:
+		bytes = []byte(v)
+	default:
 		return xerrors.Errorf("failed to unmarshal JSONB value: %v", value)
 	}
 	if len(bytes) == 0 {
@@ -137,6 +267,47 @@ func (rl ReqLimit) Value() (driver.Value, error) {
 	return json.Marshal(rl)
 }
 
+// RateBucket is the token bucket counting the requests under a rate limit
+type RateBucket struct {
+	Key    string  `gorm:"column:bucket_key;type:varchar(128);primary_key"`
+	Tokens float64 `gorm:"column:tokens;type:double;NOT NULL"`
+	// unix nanoseconds the tokens are counted at, zero for a new bucket.
+	// It isn't named UpdatedAt, which gorm would overwrite with unix seconds on every save.
+	RefillTime int64 `gorm:"column:updatedAt;type:bigint;NOT NULL" json:"UpdatedAt"`
+}
+
+func (*RateBucket) TableName() string {
+	return "rate_buckets"
+}
+
+// RateBucketKey is the key of the bucket of the rate limit id of the user
+func RateBucketKey(name, id string) string {
+	return name + "/" + id
+}
+
+// SigningKey is a private key held by the server to sign tokens,
+// the public part is published through the JWKS endpoint.
+type SigningKey struct {
+	Kid        string    `gorm:"column:kid;type:varchar(64);primary_key"`
+	Alg        string    `gorm:"column:alg;type:varchar(16);NOT NULL"`
+	PrivateKey string    `gorm:"column:privateKey;type:varchar(512);NOT NULL"` // hex encoded PKCS #8
+	CreateTime time.Time `gorm:"column:createTime;type:datetime;NOT NULL"`
+	// tokens signed by a retired key are rejected
+	Retired bool `gorm:"column:retired;default:false"`
+}
+
+func (*SigningKey) TableName() string {
+	return "signing_keys"
+}
+
+func (k *SigningKey) Bytes() ([]byte, error) {
+	return json.Marshal(k)
+}
+
+func (k *SigningKey) FromBytes(buff []byte) error {
+	return json.Unmarshal(buff, k)
+}
+
 func (*User) TableName() string {
 	return "users"
 }
@@ -0,0 +1,189 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/venus-auth/config"
+	"github.com/filecoin-project/venus-auth/storage"
+	"github.com/filecoin-project/venus-auth/storage/storagetest"
+)
+
+// the sql dbs shared by the tests, their records are removed before every test, e.g.
+//
+//	VENUS_AUTH_TEST_MYSQL_DSN="root:111111@(127.0.0.1:3306)/auth_test?parseTime=true&loc=Local"
+//	VENUS_AUTH_TEST_POSTGRES_DSN="host=127.0.0.1 user=postgres password=postgres dbname=auth_test sslmode=disable"
+const (
+	envTestMySQLDSN    = "VENUS_AUTH_TEST_MYSQL_DSN"
+	envTestPostgresDSN = "VENUS_AUTH_TEST_POSTGRES_DSN"
+)
+
+func openStore(t *testing.T, cnf *config.DBConfig) storage.Store {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewStore(cnf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(dir)
+	})
+	if _, err = storage.Migrate(store, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.ResetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestBadgerStore(t *testing.T) {
+	storagetest.TestStore(t, func(t *testing.T) storage.Store {
+		return openStore(t, &config.DBConfig{Type: config.Badger})
+	})
+}
+
+func TestEncryptedStoreSuite(t *testing.T) {
+	key := hex.EncodeToString(make([]byte, 32))
+	storagetest.TestStore(t, func(t *testing.T) storage.Store {
+		store, err := storage.WithEncryption(openStore(t, &config.DBConfig{Type: config.Badger}), &config.EncryptionConfig{Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	storagetest.TestStore(t, func(t *testing.T) storage.Store {
+		return openStore(t, &config.DBConfig{Type: config.SQLite})
+	})
+}
+
+func TestMySQLStore(t *testing.T) {
+	dsn := os.Getenv(envTestMySQLDSN)
+	if len(dsn) == 0 {
+		t.Skipf("%s is not set", envTestMySQLDSN)
+	}
+	storagetest.TestStore(t, func(t *testing.T) storage.Store {
+		return openStore(t, &config.DBConfig{Type: config.Mysql, DSN: dsn, MaxOpenConns: 8, MaxIdleConns: 8})
+	})
+}
+
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv(envTestPostgresDSN)
+	if len(dsn) == 0 {
+		t.Skipf("%s is not set", envTestPostgresDSN)
+	}
+	storagetest.TestStore(t, func(t *testing.T) storage.Store {
+		return openStore(t, &config.DBConfig{Type: config.Postgres, DSN: dsn, MaxOpenConns: 8, MaxIdleConns: 8})
+	})
+}
+
+func TestBackupRestore(t *testing.T) {
+	src := openStore(t, &config.DBConfig{Type: config.Badger})
+	maddr, err := address.NewIDAddress(1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := storage.Token("header.payload.signature")
+	kp := &storage.KeyPair{Name: "alice", Perm: "read", Secret: "secret", Hash: tk.Hash(), Prefix: tk.Prefix(), CreateTime: time.Unix(1600000000, 0)}
+	require.NoError(t, src.PutUser(&storage.User{Id: "id-alice", Name: "alice", CreateTime: kp.CreateTime, UpdateTime: kp.CreateTime}))
+	require.NoError(t, src.AddMiner("alice", maddr))
+	require.NoError(t, src.Put(kp))
+	_, err = src.PutRateLimit(&storage.UserRateLimit{Id: "l1", Name: "alice", ReqLimit: storage.ReqLimit{Cap: 10, ResetDur: time.Minute}})
+	require.NoError(t, err)
+	require.NoError(t, src.PutSigningKey(&storage.SigningKey{Kid: "k1", Alg: "ES256", PrivateKey: "key", CreateTime: kp.CreateTime}))
+
+	var buf bytes.Buffer
+	sum, err := storage.Backup(src, &buf)
+	require.NoError(t, err)
+	archive := buf.Bytes()
+
+	// the archive doesn't depend on the db
+	dst := openStore(t, &config.DBConfig{Type: config.SQLite})
+	_, err = storage.Restore(dst, bytes.NewReader(archive[:len(archive)/2]))
+	assert.Error(t, err, "a truncated archive is rejected")
+	restored, err := storage.Restore(dst, bytes.NewReader(archive))
+	require.NoError(t, err)
+	assert.Equal(t, sum, restored)
+
+	got, err := dst.Get(kp.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, kp.Secret, got.Secret)
+	user, err := dst.GetMiner(maddr)
+	require.NoError(t, err)
+	assert.Equal(t, "id-alice", user.Id)
+	limits, err := dst.GetRateLimits("alice", "")
+	require.NoError(t, err)
+	require.Len(t, limits, 1)
+	assert.Equal(t, int64(10), limits[0].ReqLimit.Cap)
+	keys, err := dst.ListSigningKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "key", keys[0].PrivateKey)
+}
+
+func TestCopy(t *testing.T) {
+	src := openStore(t, &config.DBConfig{Type: config.Badger})
+	dst := openStore(t, &config.DBConfig{Type: config.SQLite})
+	created := time.Unix(1600000000, 0)
+	for _, name := range []string{"alice", "bob"} {
+		require.NoError(t, src.PutUser(&storage.User{Id: "id-" + name, Name: name, CreateTime: created, UpdateTime: created}))
+		tk := storage.Token("header." + name + ".signature")
+		require.NoError(t, src.Put(&storage.KeyPair{Name: name, Secret: "secret", Hash: tk.Hash(), Prefix: tk.Prefix(), CreateTime: created}))
+	}
+	for i, name := range []string{"alice", "bob"} {
+		maddr, err := address.NewIDAddress(uint64(1001 + i))
+		require.NoError(t, err)
+		require.NoError(t, src.AddMiner(name, maddr))
+	}
+	for _, name := range []string{"alice", "bob"} {
+		_, err := src.PutRateLimit(&storage.UserRateLimit{Id: "l-" + name, Name: name, ReqLimit: storage.ReqLimit{Cap: 10, ResetDur: time.Minute}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, src.PutSigningKey(&storage.SigningKey{Kid: "k1", Alg: "ES256", PrivateKey: "key", CreateTime: created}))
+	// bob of dst is another user
+	require.NoError(t, dst.PutUser(&storage.User{Id: "id-other", Name: "bob", CreateTime: created, UpdateTime: created}))
+
+	// the user, miner, token and rate limit of bob are skipped
+	sum, err := storage.Copy(src, dst, true)
+	require.NoError(t, err)
+	assert.Equal(t, storage.BackupSummary{Tokens: 1, Users: 1, Miners: 1, RateLimits: 1, SigningKeys: 1}, sum.Copied)
+	assert.Len(t, sum.Conflicts, 4)
+	has, err := dst.HasUser("alice")
+	require.NoError(t, err)
+	assert.False(t, has, "nothing is written in a dry run")
+
+	copied, err := storage.Copy(src, dst, false)
+	require.NoError(t, err)
+	assert.Equal(t, sum, copied)
+	user, err := dst.GetUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, "id-alice", user.Id)
+	assert.Len(t, user.Miners, 1)
+	tks, err := dst.ListByName("bob", 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, tks, 0, "the tokens of bob of src are not given to bob of dst")
+	limits, err := dst.GetRateLimits("bob", "")
+	require.NoError(t, err)
+	assert.Len(t, limits, 0)
+
+	// a copy can be run again
+	again, err := storage.Copy(src, dst, false)
+	require.NoError(t, err)
+	assert.Equal(t, storage.BackupSummary{}, again.Copied)
+	assert.Equal(t, storage.BackupSummary{Tokens: 1, Users: 1, Miners: 1, RateLimits: 1, SigningKeys: 1}, again.Existing)
+	assert.Equal(t, sum.Conflicts, again.Conflicts)
+}
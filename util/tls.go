@@ -0,0 +1,21 @@
+package util
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+
+	"golang.org/x/xerrors"
+)
+
+// LoadCertPool reads the PEM encoded certificates of the file into a pool
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, xerrors.Errorf("no certificate is found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// UnixURLPrefix starts the url of a unix socket, e.g. unix:///run/venus-auth.sock
+const UnixURLPrefix = "unix://"
+
+// UnixSocket returns the path of the socket of a unix url, ok is false for other urls
+func UnixSocket(url string) (path string, ok bool) {
+	if !strings.HasPrefix(url, UnixURLPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(url, UnixURLPrefix), true
+}
+
+// DialUnix makes the transport connect to the socket whatever the host of the request,
+// the requests are sent to UnixHostURL.
+func DialUnix(transport *http.Transport, path string) {
+	var dialer net.Dialer
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
+
+// UnixHostURL is the base url of the requests sent through a unix socket
+const UnixHostURL = "http://unix"